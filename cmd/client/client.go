@@ -3,21 +3,49 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	pb "chat_app/pb"
 
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
 )
 
 func main() {
-	conn, err := grpc.NewClient("app:50051", grpc.WithInsecure())
+	addr := flag.String("addr", "app:50051", "address of the gRPC server")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	caFile := flag.String("ca", "", "CA certificate to verify the server with instead of the system roots (implies -tls)")
+	certFile := flag.String("cert", "", "client certificate for servers that require mutual TLS (implies -tls)")
+	keyFile := flag.String("key", "", "key of the client certificate")
+	serverName := flag.String("server-name", "", "name to verify the server certificate against, if it differs from the address")
+	oidcIssuer := flag.String("oidc-issuer", "", "log in with single sign-on at this OpenID Connect provider instead of a password")
+	oidcClientID := flag.String("oidc-client-id", "chat-cli", "client ID of the CLI at the OpenID Connect provider")
+	flag.Parse()
+
+	creds := insecure.NewCredentials()
+	if *useTLS || *caFile != "" || *certFile != "" {
+		tlsConfig, err := clientTLS(*caFile, *certFile, *keyFile, *serverName)
+		if err != nil {
+			log.Fatalf("Failed to load TLS configuration: %v", err)
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(creds))
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
@@ -25,21 +53,30 @@ func main() {
 	client := pb.NewChatServiceClient(conn)
 
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("Enter username: ")
-	username, _ := reader.ReadString('\n')
-	username = strings.TrimSpace(username)
+	var ctx context.Context
+	var username string
+	if *oidcIssuer != "" {
+		ctx, username, err = loginOIDC(client, *oidcIssuer, *oidcClientID)
+		if err != nil {
+			log.Fatalf("Failed to authenticate: %v", err)
+		}
+	} else {
+		fmt.Print("Enter username: ")
+		username, _ = reader.ReadString('\n')
+		username = strings.TrimSpace(username)
 
-	fmt.Print("Enter password: ")
-	password, _ := reader.ReadString('\n')
-	password = strings.TrimSpace(password)
+		fmt.Print("Enter password: ")
+		password, _ := reader.ReadString('\n')
+		password = strings.TrimSpace(password)
 
-	// try to log in first
-	ctx, err := login(client, username, password)
-	if err != nil {
-		// if login fails, try to register:
-		ctx, err = register(client, username, password)
+		// try to log in first
+		ctx, err = login(client, reader, username, password)
 		if err != nil {
-			log.Fatalf("Failed to authenticate: %v", err)
+			// if login fails, try to register:
+			ctx, err = register(client, username, password)
+			if err != nil {
+				log.Fatalf("Failed to authenticate: %v", err)
+			}
 		}
 	}
 
@@ -49,10 +86,11 @@ func main() {
 
 	// start goroutine to recieve messages
 	go recieveMessages(client, ctx, room)
+	go recieveNotifications(client, ctx)
 
 	// send messages from user input
 	for {
-		fmt.Print("Enter message (or 'quit' to exit): ")
+		fmt.Print("Enter message (or 'help', 'quit'): ")
 		message, _ := reader.ReadString('\n')
 		message = strings.TrimSpace(message)
 
@@ -60,11 +98,77 @@ func main() {
 			return
 		}
 
+		if message == "help" {
+			printHelp()
+			continue
+		}
+
+		if message == "who" {
+			listOnline(client, ctx, room)
+			continue
+		}
+
+		if message == "rooms" {
+			listRooms(client, ctx)
+			continue
+		}
+
+		if strings.HasPrefix(message, "edit ") {
+			args := strings.SplitN(strings.TrimPrefix(message, "edit "), " ", 2)
+			seq, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || len(args) != 2 {
+				fmt.Println("Usage: edit <seq> <new text>")
+				continue
+			}
+			editMessage(client, ctx, room, seq, args[1])
+			continue
+		}
+
+		if strings.HasPrefix(message, "delete ") {
+			seq, err := strconv.ParseInt(strings.TrimPrefix(message, "delete "), 10, 64)
+			if err != nil {
+				fmt.Println("Usage: delete <seq>")
+				continue
+			}
+			deleteMessage(client, ctx, room, seq)
+			continue
+		}
+
+		if message == "notifications" {
+			listNotifications(client, ctx)
+			continue
+		}
+
+		if strings.HasPrefix(message, "ack ") {
+			ackNotification(client, ctx, strings.TrimPrefix(message, "ack "))
+			continue
+		}
+
+		if strings.HasPrefix(message, "upload ") {
+			uploadAttachment(client, ctx, username, room, strings.TrimPrefix(message, "upload "))
+			continue
+		}
+
+		if strings.HasPrefix(message, "download ") {
+			args := strings.Fields(strings.TrimPrefix(message, "download "))
+			if len(args) != 2 {
+				fmt.Println("Usage: download <attachment id> <path>")
+				continue
+			}
+			downloadAttachment(client, ctx, args[0], args[1])
+			continue
+		}
+
+		if strings.HasPrefix(message, "search ") {
+			searchMessages(client, ctx, strings.TrimPrefix(message, "search "))
+			continue
+		}
+
 		sendMessage(client, ctx, username, message, room)
 	}
 }
 
-func login(client pb.ChatServiceClient, username, password string) (context.Context, error) {
+func login(client pb.ChatServiceClient, reader *bufio.Reader, username, password string) (context.Context, error) {
 	authResp, err := client.Login(context.Background(), &pb.LoginRequest{
 		Username: username,
 		Password: password,
@@ -72,10 +176,66 @@ func login(client pb.ChatServiceClient, username, password string) (context.Cont
 	if err != nil {
 		return nil, fmt.Errorf("failed to login: %v", err)
 	}
+	if authResp.TwoFactorRequired {
+		fmt.Print("Enter two-factor code or recovery code: ")
+		code, _ := reader.ReadString('\n')
+		authResp, err = client.VerifyTwoFactor(context.Background(), &pb.VerifyTwoFactorRequest{
+			Challenge: authResp.Challenge,
+			Code:      strings.TrimSpace(code),
+		})
+		if err != nil {
+			// the password was right, so registering instead would not help
+			log.Fatalf("Failed to verify two-factor code: %v", err)
+		}
+	}
 	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", authResp.Token)
 	return ctx, nil
 }
 
+// loginOIDC gets an ID token with the device flow, where the user logs in
+// with a browser on any device, and trades it for a session. The username
+// is whatever the server named the account.
+func loginOIDC(client pb.ChatServiceClient, issuer, clientID string) (context.Context, string, error) {
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to discover %s: %v", issuer, err)
+	}
+	oauthConfig := oauth2.Config{
+		ClientID: clientID,
+		Endpoint: provider.Endpoint(),
+		Scopes:   []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+
+	deviceAuth, err := oauthConfig.DeviceAuth(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to start device login: %v", err)
+	}
+	if deviceAuth.VerificationURIComplete != "" {
+		fmt.Printf("To log in, open %s\n", deviceAuth.VerificationURIComplete)
+	} else {
+		fmt.Printf("To log in, open %s and enter the code %s\n", deviceAuth.VerificationURI, deviceAuth.UserCode)
+	}
+
+	// polls until the user logged in, declined, or the code expired
+	token, err := oauthConfig.DeviceAccessToken(ctx, deviceAuth)
+	if err != nil {
+		return nil, "", fmt.Errorf("device login failed: %v", err)
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, "", fmt.Errorf("provider returned no ID token")
+	}
+
+	authResp, err := client.LoginOIDC(ctx, &pb.LoginOIDCRequest{IdToken: idToken})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to login: %v", err)
+	}
+	fmt.Printf("Logged in as %s\n", authResp.Username)
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", authResp.Token)
+	return ctx, authResp.Username, nil
+}
+
 func register(client pb.ChatServiceClient, username, password string) (context.Context, error) {
 	authResp, err := client.Register(context.Background(), &pb.RegisterRequest{
 		Username: username,
@@ -121,7 +281,8 @@ func recieveMessages(client pb.ChatServiceClient, ctx context.Context, room stri
 			log.Printf("Error recieving messages: %v", err)
 			return
 		}
-		log.Printf("[%s] %s: %s", msg.Room, msg.User, msg.Message)
+		printMessage(msg)
+		markRead(client, ctx, msg)
 	}
 	fmt.Println("--- End of last Messages ---")
 
@@ -131,6 +292,304 @@ func recieveMessages(client pb.ChatServiceClient, ctx context.Context, room stri
 			log.Printf("Error recieving messages: %v", err)
 			return
 		}
-		log.Printf("[%s] %s: %s", msg.Room, msg.Message, msg.User)
+		printMessage(msg)
+		markRead(client, ctx, msg)
+	}
+}
+
+func markRead(client pb.ChatServiceClient, ctx context.Context, msg *pb.ChatMessage) {
+	if msg.Type != pb.EventType_EVENT_MESSAGE || msg.Seq == 0 {
+		return
+	}
+
+	_, err := client.MarkRead(ctx, &pb.MarkReadRequest{Room: msg.Room, Seq: msg.Seq})
+	if err != nil {
+		log.Printf("Error marking message as read: %v", err)
+	}
+}
+
+func listRooms(client pb.ChatServiceClient, ctx context.Context) {
+	resp, err := client.ListRooms(ctx, &pb.Empty{})
+	if err != nil {
+		log.Printf("Error listing rooms: %v", err)
+		return
+	}
+
+	fmt.Println("--- Rooms ---")
+	for _, room := range resp.Rooms {
+		if room.Topic != "" {
+			fmt.Printf("%s (%d unread) - %s\n", room.Name, room.UnreadCount, room.Topic)
+		} else {
+			fmt.Printf("%s (%d unread)\n", room.Name, room.UnreadCount)
+		}
+	}
+}
+
+func printMessage(msg *pb.ChatMessage) {
+	switch msg.Type {
+	case pb.EventType_EVENT_JOIN:
+		log.Printf("[%s] * %s joined", msg.Room, msg.User)
+	case pb.EventType_EVENT_LEAVE:
+		log.Printf("[%s] * %s left", msg.Room, msg.User)
+	case pb.EventType_EVENT_TYPING_START:
+		log.Printf("[%s] * %s is typing...", msg.Room, msg.User)
+	case pb.EventType_EVENT_TYPING_STOP, pb.EventType_EVENT_READ_RECEIPT:
+		// nothing to show
+	case pb.EventType_EVENT_EDIT:
+		log.Printf("[%s #%d] %s edited: %s", msg.Room, msg.Seq, msg.User, msg.Message)
+	case pb.EventType_EVENT_DELETE:
+		log.Printf("[%s #%d] message deleted by %s", msg.Room, msg.Seq, msg.User)
+	case pb.EventType_EVENT_ACTION:
+		log.Printf("[%s #%d] * %s %s", msg.Room, msg.Seq, displayName(msg), msg.Message)
+	case pb.EventType_EVENT_TOPIC:
+		log.Printf("[%s] * %s changed the topic to: %s", msg.Room, msg.User, msg.Message)
+	case pb.EventType_EVENT_NICK:
+		if msg.Message == "" {
+			log.Printf("[%s] * %s cleared their nick", msg.Room, msg.User)
+		} else {
+			log.Printf("[%s] * %s is now known as %s", msg.Room, msg.User, msg.Message)
+		}
+	case pb.EventType_EVENT_SYSTEM, pb.EventType_EVENT_GOING_AWAY:
+		log.Printf("[%s] * %s", msg.Room, msg.Message)
+	default:
+		log.Printf("[%s #%d] %s: %s", msg.Room, msg.Seq, displayName(msg), msg.Message)
+		for _, attachment := range msg.Attachments {
+			log.Printf("[%s]   attachment %s: %s (%s, %d bytes)", msg.Room, attachment.Id, attachment.Filename, attachment.ContentType, attachment.Size)
+		}
+	}
+}
+
+func displayName(msg *pb.ChatMessage) string {
+	if msg.Nick != "" {
+		return fmt.Sprintf("%s (%s)", msg.Nick, msg.User)
+	}
+	return msg.User
+}
+
+func listOnline(client pb.ChatServiceClient, ctx context.Context, room string) {
+	resp, err := client.ListRoomMembersOnline(ctx, &pb.ListRoomMembersOnlineRequest{Room: room})
+	if err != nil {
+		log.Printf("Error listing online users: %v", err)
+		return
+	}
+
+	fmt.Printf("--- Online in %s ---\n", room)
+	for _, member := range resp.Members {
+		if member.Typing {
+			fmt.Printf("%s (typing)\n", member.Username)
+		} else {
+			fmt.Println(member.Username)
+		}
+	}
+}
+
+func searchMessages(client pb.ChatServiceClient, ctx context.Context, query string) {
+	resp, err := client.SearchMessages(ctx, &pb.SearchMessagesRequest{Query: query})
+	if err != nil {
+		log.Printf("Error searching messages: %v", err)
+		return
+	}
+
+	fmt.Printf("--- %d results ---\n", len(resp.Messages))
+	for _, msg := range resp.Messages {
+		fmt.Printf("%s [%s] %s: %s\n", time.Unix(msg.Timestamp, 0).Format(time.DateTime), msg.Room, msg.User, msg.Message)
+	}
+}
+
+func uploadAttachment(client pb.ChatServiceClient, ctx context.Context, username, room, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Error opening file: %v", err)
+		return
+	}
+	defer file.Close()
+
+	stream, err := client.UploadAttachment(ctx)
+	if err != nil {
+		log.Printf("Error starting upload: %v", err)
+		return
+	}
+
+	err = stream.Send(&pb.UploadAttachmentRequest{
+		Data: &pb.UploadAttachmentRequest_Info{Info: &pb.UploadAttachmentInfo{
+			Room:     room,
+			Filename: filepath.Base(path),
+		}},
+	})
+	if err != nil {
+		log.Printf("Error uploading attachment: %v", err)
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			sendErr := stream.Send(&pb.UploadAttachmentRequest{
+				Data: &pb.UploadAttachmentRequest_Chunk{Chunk: buf[:n]},
+			})
+			if sendErr != nil {
+				break // the real error is returned by CloseAndRecv
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading file: %v", err)
+			return
+		}
+	}
+
+	attachment, err := stream.CloseAndRecv()
+	if err != nil {
+		log.Printf("Error uploading attachment: %v", err)
+		return
+	}
+
+	msg := &pb.ChatMessage{
+		User:        username,
+		Timestamp:   time.Now().Unix(),
+		Room:        room,
+		Attachments: []*pb.Attachment{{Id: attachment.Id}},
+	}
+	if _, err := client.SendMessage(ctx, msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+		return
+	}
+	log.Printf("Attachment sent: %s", attachment.Id)
+}
+
+func downloadAttachment(client pb.ChatServiceClient, ctx context.Context, id, path string) {
+	stream, err := client.DownloadAttachment(ctx, &pb.DownloadAttachmentRequest{Id: id})
+	if err != nil {
+		log.Printf("Error starting download: %v", err)
+		return
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		log.Printf("Error creating file: %v", err)
+		return
+	}
+	defer file.Close()
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error downloading attachment: %v", err)
+			return
+		}
+
+		if _, err := file.Write(resp.GetChunk()); err != nil {
+			log.Printf("Error writing file: %v", err)
+			return
+		}
+	}
+	log.Printf("Attachment saved to %s", path)
+}
+
+func recieveNotifications(client pb.ChatServiceClient, ctx context.Context) {
+	stream, err := client.StreamNotifications(ctx, &pb.Empty{})
+	if err != nil {
+		log.Printf("Error opening notification stream: %v", err)
+		return
+	}
+
+	for {
+		notification, err := stream.Recv()
+		if err != nil {
+			log.Printf("Error recieving notifications: %v", err)
+			return
+		}
+		printNotification(notification)
+	}
+}
+
+func listNotifications(client pb.ChatServiceClient, ctx context.Context) {
+	resp, err := client.ListNotifications(ctx, &pb.ListNotificationsRequest{})
+	if err != nil {
+		log.Printf("Error listing notifications: %v", err)
+		return
+	}
+
+	fmt.Printf("--- %d unread notifications ---\n", len(resp.Notifications))
+	for _, notification := range resp.Notifications {
+		printNotification(notification)
+	}
+}
+
+func ackNotification(client pb.ChatServiceClient, ctx context.Context, id string) {
+	if id == "all" {
+		id = ""
+	}
+
+	if _, err := client.AckNotification(ctx, &pb.AckNotificationRequest{Id: id}); err != nil {
+		log.Printf("Error acknowledging notification: %v", err)
+	}
+}
+
+func printNotification(notification *pb.Notification) {
+	msg := notification.Message
+	if notification.Type == pb.NotificationType_NOTIFICATION_INVITE {
+		log.Printf("(%s) %s", notification.Id, msg.Message)
+		return
 	}
+	log.Printf("(%s) %s mentioned you in %s: %s", notification.Id, msg.User, msg.Room, msg.Message)
+}
+
+func printHelp() {
+	fmt.Println("who                    list users online in this room")
+	fmt.Println("rooms                  list your rooms with unread counts")
+	fmt.Println("search <text>          search messages in your rooms")
+	fmt.Println("upload <path>          send a file to this room")
+	fmt.Println("download <id> <path>   save an attachment")
+	fmt.Println("edit <seq> <text>      change one of your messages")
+	fmt.Println("delete <seq>           delete one of your messages")
+	fmt.Println("notifications          list unread mentions and invites")
+	fmt.Println("ack <id>|all           mark mentions as read")
+	fmt.Println("quit                   exit")
+	fmt.Println("/help                  list the server's slash commands")
+}
+
+func editMessage(client pb.ChatServiceClient, ctx context.Context, room string, seq int64, message string) {
+	_, err := client.EditMessage(ctx, &pb.EditMessageRequest{Room: room, Seq: seq, Message: message})
+	if err != nil {
+		log.Printf("Error editing message: %v", err)
+	}
+}
+
+func deleteMessage(client pb.ChatServiceClient, ctx context.Context, room string, seq int64) {
+	_, err := client.DeleteMessage(ctx, &pb.DeleteMessageRequest{Room: room, Seq: seq})
+	if err != nil {
+		log.Printf("Error deleting message: %v", err)
+	}
+}
+
+func clientTLS(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
@@ -0,0 +1,24 @@
+// Command mockidp runs an OpenID Connect provider to try single sign-on with,
+// where anyone logs in as whichever user they type. Never expose it.
+package main
+
+import (
+	"chat_app/internal/mockidp"
+	"flag"
+	"log"
+	"net/http"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9000", "URL the provider is reached at, which must match the server's oidc.issuer")
+	flag.Parse()
+
+	server, err := mockidp.New(*issuer)
+	if err != nil {
+		log.Fatalf("Failed to create provider: %v", err)
+	}
+
+	log.Println("Mock identity provider for", *issuer, "listening on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"chat_app/config"
+	"chat_app/internal/chat"
+	pb "chat_app/pb"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// postMessageRequest is the body of POST /api/rooms/{room}/messages
+type postMessageRequest struct {
+	Message     string   `json:"message"`
+	Attachments []string `json:"attachments"`
+}
+
+// handlePostMessage lets bots and scripts post to a room over plain HTTP
+func handlePostMessage(w http.ResponseWriter, r *http.Request, chatServer *chat.ChatServer) {
+	ctx, ok := authenticateRequest(w, r, chatServer)
+	if !ok {
+		return
+	}
+
+	var req postMessageRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+
+	msg := &pb.ChatMessage{
+		Message:   req.Message,
+		Timestamp: time.Now().Unix(),
+		Room:      mux.Vars(r)["room"],
+	}
+	for _, id := range req.Attachments {
+		msg.Attachments = append(msg.Attachments, &pb.Attachment{Id: id})
+	}
+
+	if err := chatServer.PostMessage(ctx, msg); err != nil {
+		writeStatusError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, msg)
+}
+
+func handleUploadAttachment(w http.ResponseWriter, r *http.Request, chatServer *chat.ChatServer) {
+	ctx, ok := authenticateRequest(w, r, chatServer)
+	if !ok {
+		return
+	}
+	username, _ := chat.UsernameFromContext(ctx)
+
+	// leave some room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, config.AppConfig.Attachments.MaxSize+1<<20)
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Missing file field")
+		return
+	}
+	defer file.Close()
+
+	attachment, err := chatServer.StoreAttachment(ctx, username, mux.Vars(r)["room"], header.Filename, file)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, attachment)
+}
+
+func handleDownloadAttachment(w http.ResponseWriter, r *http.Request, chatServer *chat.ChatServer) {
+	ctx, ok := authenticateRequest(w, r, chatServer)
+	if !ok {
+		return
+	}
+	username, _ := chat.UsernameFromContext(ctx)
+
+	attachment, body, err := chatServer.OpenAttachment(ctx, username, mux.Vars(r)["id"])
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprint(attachment.Size))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, body)
+}
+
+// authenticateRequest checks the bearer token, which may be a user session or
+// a bot API token, and writes a 401 if it is missing or invalid
+func authenticateRequest(w http.ResponseWriter, r *http.Request, chatServer *chat.ChatServer) (context.Context, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		writeError(w, http.StatusUnauthorized, "No token provided")
+		return nil, false
+	}
+
+	ctx, err := chatServer.Authenticate(r.Context(), token)
+	if err != nil {
+		writeStatusError(w, err)
+		return nil, false
+	}
+
+	return ctx, true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// writeStatusError translates a gRPC status error from the chat package into an HTTP response
+func writeStatusError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	writeError(w, httpStatusFromCode(st.Code()), st.Message())
+}
+
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
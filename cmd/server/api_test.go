@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"chat_app/config"
+	"chat_app/internal/audit"
+	"chat_app/internal/blob"
+	"chat_app/internal/chat"
+	"chat_app/internal/logger"
+	"chat_app/internal/notifier"
+	"chat_app/internal/ratelimit"
+	"chat_app/internal/search"
+	"chat_app/internal/storage"
+	"chat_app/internal/webhook"
+	pb "chat_app/pb"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+func newTestServer(t *testing.T) (*chat.ChatServer, *redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+	if config.AppConfig == nil {
+		if err := config.LoadConfig(""); err != nil {
+			t.Fatal(err)
+		}
+		config.AppConfig.Logger.Level = "error"
+		if err := logger.InitLogger(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	blobStore, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks := webhook.NewDispatcher(rdb, webhook.Options{MaxAttempts: 1, Timeout: time.Second, MaxConcurrent: 1})
+	chatServer := chat.NewChatServer(ratelimit.NewRateLimiter(rate.Inf, 100), rdb, search.NewRedisIndex(rdb), blobStore, webhooks, audit.NewLog(audit.NewRedisSink(rdb, 0)), notifier.NewLogNotifier(), nil)
+	return chatServer, rdb, mr
+}
+
+func registerUser(t *testing.T, chatServer *chat.ChatServer, username string) (context.Context, string) {
+	t.Helper()
+	resp, err := chatServer.Register(context.Background(), &pb.RegisterRequest{Username: username, Password: "Password123!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := chatServer.Authenticate(context.Background(), resp.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx, resp.Token
+}
+
+func uploadRequest(t *testing.T, room, token string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "build.log")
+	part.Write([]byte("ok"))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/rooms/"+room+"/attachments", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return mux.SetURLVars(r, map[string]string{"room": room})
+}
+
+func TestAttachmentsRespectTokenRooms(t *testing.T) {
+	chatServer, rdb, _ := newTestServer(t)
+	alice, aliceToken := registerUser(t, chatServer, "alice")
+	if _, err := chatServer.CreateBot(alice, &pb.CreateBotRequest{Name: "ci"}); err != nil {
+		t.Fatal(err)
+	}
+	apiToken, err := chatServer.CreateAPIToken(alice, &pb.CreateAPITokenRequest{
+		Bot:    "ci",
+		Scopes: []string{chat.ScopeMessagesRead, chat.ScopeMessagesWrite},
+		Rooms:  []string{"builds"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bot is in both rooms, only its token is restricted
+	for _, room := range []string{"builds", "secret"} {
+		for _, user := range []string{"alice", "ci"} {
+			if err := storage.AddUserRoom(rdb, user, room); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		room  string
+		token string
+		want  int
+	}{
+		{"builds", apiToken.Token, http.StatusCreated},
+		{"secret", apiToken.Token, http.StatusForbidden},
+		{"secret", aliceToken, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handleUploadAttachment(w, uploadRequest(t, tt.room, tt.token), chatServer)
+		if w.Code != tt.want {
+			t.Errorf("upload to %s: got %d %s, want %d", tt.room, w.Code, w.Body, tt.want)
+		}
+	}
+
+	secret, err := chatServer.StoreAttachment(alice, "alice", "secret", "plans.txt", strings.NewReader("plans"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/attachments/"+secret.Id, nil)
+	r.Header.Set("Authorization", "Bearer "+apiToken.Token)
+	w := httptest.NewRecorder()
+	handleDownloadAttachment(w, mux.SetURLVars(r, map[string]string{"id": secret.Id}), chatServer)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("download from secret: got %d %s, want %d", w.Code, w.Body, http.StatusForbidden)
+	}
+}
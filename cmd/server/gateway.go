@@ -0,0 +1,291 @@
+package main
+
+//go:generate go run . -openapi ../../api/openapi.json
+
+import (
+	"chat_app/internal/chat"
+	"chat_app/internal/logger"
+	"chat_app/internal/metrics"
+	pb "chat_app/pb"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// route maps an HTTP endpoint of the JSON gateway to a ChatService RPC.
+// Path variables and, for requests without a body, query parameters are
+// copied into the request fields of the same name.
+type route struct {
+	method  string
+	path    string
+	rpc     string
+	summary string
+	// body is true when the request message is read from the JSON body
+	body bool
+}
+
+// gatewayRoutes lists the endpoints under /api/v1. Server streaming RPCs are
+// served as server-sent events.
+var gatewayRoutes = []route{
+	{http.MethodPost, "/register", "Register", "Create an account", true},
+	{http.MethodPost, "/login", "Login", "Log in and get a session token", true},
+	{http.MethodPost, "/login/verify", "VerifyTwoFactor", "Finish a login with a two-factor code", true},
+	{http.MethodPost, "/login/oidc", "LoginOIDC", "Log in with an ID token from the single sign-on provider", true},
+	{http.MethodGet, "/rooms", "ListRooms", "List your rooms with unread counts", false},
+	{http.MethodPost, "/rooms/{room}/messages", "SendMessage", "Send a message or slash command", true},
+	{http.MethodGet, "/rooms/{room}/events", "StreamMessages", "Stream room messages and events (SSE)", false},
+	{http.MethodPatch, "/rooms/{room}/messages/{seq}", "EditMessage", "Edit one of your messages", true},
+	{http.MethodDelete, "/rooms/{room}/messages/{seq}", "DeleteMessage", "Delete one of your messages", false},
+	{http.MethodPost, "/rooms/{room}/typing", "SetTyping", "Start or stop typing", true},
+	{http.MethodPost, "/rooms/{room}/read", "MarkRead", "Mark the room as read up to seq", true},
+	{http.MethodGet, "/rooms/{room}/members/online", "ListRoomMembersOnline", "List users online in the room", false},
+	{http.MethodGet, "/search", "SearchMessages", "Search messages in your rooms", false},
+	{http.MethodGet, "/notifications", "ListNotifications", "List your notifications", false},
+	{http.MethodPost, "/notifications/ack", "AckNotification", "Acknowledge one or all notifications", true},
+	{http.MethodGet, "/notifications/events", "StreamNotifications", "Stream new notifications (SSE)", false},
+	{http.MethodPost, "/rooms/{room}/webhooks", "CreateWebhook", "Register an outgoing webhook", true},
+	{http.MethodGet, "/rooms/{room}/webhooks", "ListWebhooks", "List the room's webhooks and dead letters", false},
+	{http.MethodDelete, "/rooms/{room}/webhooks/{id}", "DeleteWebhook", "Delete a webhook", false},
+	{http.MethodPost, "/bots", "CreateBot", "Create a bot account", true},
+	{http.MethodPost, "/bots/{bot}/tokens", "CreateAPIToken", "Issue an API token for a bot", true},
+	{http.MethodGet, "/bots/{bot}/tokens", "ListAPITokens", "List a bot's API tokens", false},
+	{http.MethodDelete, "/bots/{bot}/tokens/{id}", "RevokeAPIToken", "Revoke an API token", false},
+	{http.MethodGet, "/rooms/{room}/commands", "ListCommands", "List the slash commands in a room", false},
+	{http.MethodPost, "/rooms/{room}/bots/{bot}/commands", "RegisterCommand", "Register a bot slash command in a room", true},
+	{http.MethodDelete, "/rooms/{room}/bots/{bot}/commands/{name}", "DeleteCommand", "Delete a bot slash command", false},
+	{http.MethodGet, "/audit", "QueryAuditLog", "Query the audit log (admins only)", false},
+	{http.MethodPost, "/password", "ChangePassword", "Change your password and get a new session token", true},
+	{http.MethodPost, "/password/reset", "RequestPasswordReset", "Send a password reset token to a user", true},
+	{http.MethodPost, "/password/reset/confirm", "ResetPassword", "Set a new password with a reset token", true},
+	{http.MethodPost, "/two-factor/enroll", "EnrollTwoFactor", "Generate a TOTP secret", false},
+	{http.MethodPost, "/two-factor/confirm", "ConfirmTwoFactor", "Enable two-factor authentication and get recovery codes", true},
+	{http.MethodPost, "/two-factor/disable", "DisableTwoFactor", "Disable two-factor authentication", true},
+}
+
+// unaryHandler is the signature of the handlers in the generated grpc.ServiceDesc
+type unaryHandler func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error)
+
+var (
+	gatewayMarshal   = protojson.MarshalOptions{}
+	gatewayUnmarshal = protojson.UnmarshalOptions{DiscardUnknown: true}
+)
+
+// registerGateway serves the ChatService as JSON. Requests go through the same
+// auth interceptors as gRPC calls, so both APIs behave identically.
+func registerGateway(r *mux.Router, chatServer *chat.ChatServer) {
+	for _, rt := range gatewayRoutes {
+		rt := rt
+		method := serviceMethod(rt.rpc)
+
+		var handler http.HandlerFunc
+		if unary := methodHandler(rt.rpc); unary != nil {
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				serveUnary(w, r, chatServer, rt, method, unary)
+			}
+		} else {
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				serveEvents(w, r, chatServer, rt, method)
+			}
+		}
+		r.HandleFunc(rt.path, handler).Methods(rt.method)
+	}
+
+	// attachments are binary, so they keep their multipart and raw endpoints
+	r.HandleFunc("/rooms/{room}/attachments", func(w http.ResponseWriter, r *http.Request) {
+		handleUploadAttachment(w, r, chatServer)
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/attachments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleDownloadAttachment(w, r, chatServer)
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, openAPISpec())
+	}).Methods(http.MethodGet)
+}
+
+func serveUnary(w http.ResponseWriter, r *http.Request, chatServer *chat.ChatServer, rt route, method protoreflect.MethodDescriptor, handler unaryHandler) {
+	req, err := decodeRequest(w, r, rt, method.Input())
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+
+	dec := func(v interface{}) error {
+		proto.Merge(v.(proto.Message), req)
+		return nil
+	}
+	resp, err := handler(chatServer, incomingContext(r), dec, func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		// the same interceptors as the gRPC server
+		return metrics.UnaryServerInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return logger.UnaryServerInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return chatServer.AuthInterceptor(ctx, req, info, handler)
+			})
+		})
+	})
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+
+	writeProto(w, http.StatusOK, resp.(proto.Message))
+}
+
+// decodeRequest builds the RPC's request message from the body, path and query
+func decodeRequest(w http.ResponseWriter, r *http.Request, rt route, input protoreflect.MessageDescriptor) (proto.Message, error) {
+	msgType, err := protoregistry.GlobalTypes.FindMessageByName(input.FullName())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Unknown message %s", input.FullName())
+	}
+	req := msgType.New().Interface()
+
+	if rt.body {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Request body too large")
+		}
+		if len(strings.TrimSpace(string(body))) > 0 {
+			if err := gatewayUnmarshal.Unmarshal(body, req); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "Invalid JSON body: %v", err)
+			}
+		}
+	} else {
+		for name, values := range r.URL.Query() {
+			if err := setField(req.ProtoReflect(), name, values); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for name, value := range mux.Vars(r) {
+		if err := setField(req.ProtoReflect(), name, []string{value}); err != nil {
+			return nil, err
+		}
+	}
+
+	// like the older POST /api/rooms/{room}/messages, the server dates messages sent over HTTP
+	if msg, ok := req.(*pb.ChatMessage); ok && msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+	}
+
+	return req, nil
+}
+
+// setField parses values into the scalar field called name, by its proto or JSON name.
+// Unknown names are ignored like unknown JSON fields.
+func setField(msg protoreflect.Message, name string, values []string) error {
+	fields := msg.Descriptor().Fields()
+	field := fields.ByName(protoreflect.Name(name))
+	if field == nil {
+		field = fields.ByJSONName(name)
+	}
+	if field == nil {
+		return nil
+	}
+
+	for _, raw := range values {
+		value, err := parseScalar(field, raw)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid value for %s: %q", name, raw)
+		}
+		if field.IsList() {
+			msg.Mutable(field).List().Append(value)
+		} else {
+			msg.Set(field, value)
+		}
+	}
+	return nil
+}
+
+func parseScalar(field protoreflect.FieldDescriptor, raw string) (protoreflect.Value, error) {
+	switch field.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(raw), nil
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(raw)
+		return protoreflect.ValueOfBool(b), err
+	case protoreflect.Int32Kind:
+		n, err := strconv.ParseInt(raw, 10, 32)
+		return protoreflect.ValueOfInt32(int32(n)), err
+	case protoreflect.Int64Kind:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		return protoreflect.ValueOfInt64(n), err
+	case protoreflect.EnumKind:
+		value := field.Enum().Values().ByName(protoreflect.Name(raw))
+		if value == nil {
+			return protoreflect.Value{}, fmt.Errorf("unknown enum value")
+		}
+		return protoreflect.ValueOfEnum(value.Number()), nil
+	default:
+		return protoreflect.Value{}, fmt.Errorf("unsupported field kind %s", field.Kind())
+	}
+}
+
+// incomingContext passes the bearer token on as gRPC metadata, where the
+// interceptors expect it. Event streams may also use the access_token query
+// parameter since browsers cannot set headers on an EventSource.
+func incomingContext(r *http.Request) context.Context {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = ""
+	}
+	if token == "" && r.Header.Get("Accept") == "text/event-stream" {
+		token = r.URL.Query().Get("access_token")
+	}
+
+	md := metadata.MD{}
+	if token != "" {
+		md.Set("authorization", token)
+	}
+	return metadata.NewIncomingContext(r.Context(), md)
+}
+
+func writeProto(w http.ResponseWriter, code int, msg proto.Message) {
+	body, err := gatewayMarshal.Marshal(msg)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func serviceMethod(name string) protoreflect.MethodDescriptor {
+	method := pb.File_chat_proto.Services().ByName("ChatService").Methods().ByName(protoreflect.Name(name))
+	if method == nil {
+		panic("gateway: unknown ChatService method " + name)
+	}
+	return method
+}
+
+func methodHandler(name string) unaryHandler {
+	for _, m := range pb.ChatService_ServiceDesc.Methods {
+		if m.MethodName == name {
+			return unaryHandler(m.Handler)
+		}
+	}
+	return nil
+}
+
+func streamHandler(name string) grpc.StreamHandler {
+	for _, s := range pb.ChatService_ServiceDesc.Streams {
+		if s.StreamName == name && s.ServerStreams && !s.ClientStreams {
+			return s.Handler
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+
+	"connectrpc.com/vanguard"
+	"connectrpc.com/vanguard/vanguardgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func init() {
+	// lets Connect and gRPC-Web clients send JSON straight through to the grpc server
+	encoding.RegisterCodec(vanguardgrpc.NewCodec(&vanguard.JSONCodec{
+		UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+	}))
+}
+
+// newBrowserRPCHandler serves the services registered on grpcServer over the
+// gRPC-Web and Connect protocols, which work over HTTP/1.1 and from browsers.
+// Calls are handed to grpcServer in process, so they go through the same
+// interceptors as native gRPC.
+func newBrowserRPCHandler(grpcServer *grpc.Server) (http.Handler, error) {
+	return vanguardgrpc.NewTranscoder(grpcServer)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	pb "chat_app/pb"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// connectClient calls ChatService with the Connect protocol and JSON, like the room page
+type connectClient struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+func (c *connectClient) request(ctx context.Context, method, contentType string, body []byte) *http.Request {
+	c.t.Helper()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/chat.ChatService/"+method, bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Connect-Protocol-Version", "1")
+	if c.token != "" {
+		r.Header.Set("Authorization", c.token)
+	}
+	return r
+}
+
+func (c *connectClient) call(method string, req, resp proto.Message) {
+	c.t.Helper()
+	body, err := protojson.Marshal(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r, err := http.DefaultClient.Do(c.request(context.Background(), method, "application/json", body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer r.Body.Close()
+	data, _ := io.ReadAll(r.Body)
+	if r.StatusCode != http.StatusOK {
+		c.t.Fatalf("%s: %d %s", method, r.StatusCode, data)
+	}
+	if err := protojson.Unmarshal(data, resp); err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+}
+
+// streamMessages opens a message stream and returns its first message
+func (c *connectClient) streamMessages(ctx context.Context, room string) (*pb.ChatMessage, io.ReadCloser) {
+	c.t.Helper()
+	req, err := protojson.Marshal(&pb.StreamMessagesRequest{Room: room})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	// streaming messages are enveloped in a flags byte and a length
+	body := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(req)))
+	r, err := http.DefaultClient.Do(c.request(ctx, "StreamMessages", "application/connect+json", append(body, req...)))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if r.StatusCode != http.StatusOK {
+		c.t.Fatalf("StreamMessages: %d", r.StatusCode)
+	}
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r.Body, header); err != nil {
+		c.t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r.Body, data); err != nil {
+		c.t.Fatal(err)
+	}
+	var msg pb.ChatMessage
+	if header[0] != 0 || protojson.Unmarshal(data, &msg) != nil {
+		c.t.Fatalf("StreamMessages sent %x %s", header, data)
+	}
+	return &msg, r.Body
+}
+
+// waitForStreams waits until the user has count streams open in the room
+func waitForStreams(t *testing.T, rdb *redis.Client, room, username string, count int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		n, err := rdb.HGet(context.Background(), "connections:"+room, username).Int()
+		if err == redis.Nil {
+			n, err = 0, nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d streams open in %s, want %d", username, n, room, count)
+		}
+	}
+}
+
+func TestConnectPresenceAndTyping(t *testing.T) {
+	chatServer, rdb, mr := newTestServer(t)
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(chatServer.AuthInterceptor),
+		grpc.ChainStreamInterceptor(chatServer.StreamAuthInterceptor),
+	)
+	pb.RegisterChatServiceServer(grpcServer, chatServer)
+	handler, err := newBrowserRPCHandler(grpcServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	client := &connectClient{t: t, url: srv.URL}
+	registerUser(t, chatServer, "alice")
+	var auth pb.AuthResponse
+	client.call("Login", &pb.LoginRequest{Username: "alice", Password: "Password123!"}, &auth)
+	client.token = auth.Token
+	client.call("SendMessage", &pb.ChatMessage{User: "alice", Room: "general", Message: "hello", Timestamp: time.Now().Unix()}, &pb.Empty{})
+
+	members := func() []*pb.RoomMember {
+		t.Helper()
+		var resp pb.ListRoomMembersOnlineResponse
+		client.call("ListRoomMembersOnline", &pb.ListRoomMembersOnlineRequest{Room: "general"}, &resp)
+		return resp.Members
+	}
+
+	// two tabs open the room, each replaying the history
+	first, cancelFirst := context.WithCancel(context.Background())
+	defer cancelFirst()
+	msg, firstBody := client.streamMessages(first, "general")
+	defer firstBody.Close()
+	if msg.Message != "hello" {
+		t.Errorf("replayed %v", msg)
+	}
+	waitForStreams(t, rdb, "general", "alice", 1)
+	second, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	_, secondBody := client.streamMessages(second, "general")
+	defer secondBody.Close()
+	waitForStreams(t, rdb, "general", "alice", 2)
+
+	// closing one keeps alice online
+	cancelFirst()
+	waitForStreams(t, rdb, "general", "alice", 1)
+	if online := members(); len(online) != 1 || online[0].Username != "alice" {
+		t.Fatalf("online with one stream left: %v", online)
+	}
+
+	client.call("SetTyping", &pb.TypingRequest{Room: "general", Typing: true}, &pb.Empty{})
+	if online := members(); len(online) != 1 || !online[0].Typing {
+		t.Errorf("not typing: %v", online)
+	}
+	// typing stops on its own when the client stops saying so
+	mr.FastForward(6 * time.Second)
+	if online := members(); len(online) != 1 || online[0].Typing {
+		t.Errorf("still typing after the typing TTL: %v", online)
+	}
+
+	cancelSecond()
+	waitForStreams(t, rdb, "general", "alice", 0)
+	if online := members(); len(online) != 0 {
+		t.Errorf("online after closing both streams: %v", online)
+	}
+}
@@ -1,26 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	// "net"
 	"chat_app/config"
+	"chat_app/internal/audit"
+	"chat_app/internal/blob"
+	"chat_app/internal/certs"
 	"chat_app/internal/chat"
+	"chat_app/internal/health"
+	"chat_app/internal/irc"
 	"chat_app/internal/logger"
+	"chat_app/internal/metrics"
+	"chat_app/internal/notifier"
 	"chat_app/internal/ratelimit"
+	"chat_app/internal/search"
+	"chat_app/internal/sso"
 	"chat_app/internal/storage"
+	"chat_app/internal/tracing"
+	"chat_app/internal/webhook"
 	pb "chat_app/pb"
 	"net"
-	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-
-	"golang.org/x/time/rate"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
-	if err := config.LoadConfig(); err != nil {
+	configPath := flag.String("config", "", "config file (.yaml, .toml or .json); defaults to config.* in the working directory or /etc/chat")
+	openAPIPath := flag.String("openapi", "", "write the OpenAPI spec of the JSON API to this file and exit")
+	flag.Parse()
+
+	if *openAPIPath != "" {
+		if err := writeOpenAPISpec(*openAPIPath); err != nil {
+			log.Fatalf("Failed to write OpenAPI spec: %v", err)
+		}
+		return
+	}
+
+	if err := config.LoadConfig(*configPath); err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
@@ -32,41 +62,206 @@ func main() {
 
 	logger.Log.Info("Application started")
 
-	rateLimiter := ratelimit.NewRateLimiter(
-		rate.Limit(float64(time.Second)/float64(config.AppConfig.RateLimit.Rate)),
-		config.AppConfig.RateLimit.Burst,
-	)
+	flushTraces, err := tracing.Init(context.Background(), tracing.Options{
+		Exporter:    config.AppConfig.Tracing.Exporter,
+		Endpoint:    config.AppConfig.Tracing.Endpoint,
+		Insecure:    config.AppConfig.Tracing.Insecure,
+		SampleRatio: config.AppConfig.Tracing.SampleRatio,
+		ServiceName: config.AppConfig.Tracing.ServiceName,
+	})
+	if err != nil {
+		logger.Log.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+
+	rateLimiter := ratelimit.NewRateLimiter(rateLimit(config.AppConfig.RateLimit), config.AppConfig.RateLimit.Burst)
 
 	// init chatserver
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
-	}
-	redisClient, err := storage.NewRedisClient(redisAddr)
+	redisClient, err := storage.NewRedisClient(config.AppConfig.Redis.Addr, config.AppConfig.Redis.Password, config.AppConfig.Redis.DB)
 	if err != nil {
 		logger.Log.Fatal("Failed to connect to Redis", zap.Error(err))
 	}
 	logger.Log.Info("Successfully connected to Redis")
-	chatServer := chat.NewChatServer(rateLimiter, redisClient)
 
-	go startWebServer(redisClient)
+	searchIndex, err := search.NewIndex(config.AppConfig.Search.Backend, redisClient)
+	if err != nil {
+		logger.Log.Fatal("Failed to create search index", zap.Error(err))
+	}
 
-	// initialize grpc server
-	lis, err := net.Listen("tcp", ":50051")
+	blobStore, err := newBlobStore()
 	if err != nil {
-		logger.Log.Fatal("Failed to listen", zap.Error(err))
+		logger.Log.Fatal("Failed to create attachment store", zap.Error(err))
+	}
+
+	webhooks := webhook.NewDispatcher(redisClient, webhook.Options{
+		MaxAttempts:          config.AppConfig.Webhooks.MaxAttempts,
+		InitialBackoff:       config.AppConfig.Webhooks.InitialBackoff,
+		Timeout:              config.AppConfig.Webhooks.Timeout,
+		MaxConcurrent:        config.AppConfig.Webhooks.MaxConcurrent,
+		QueueSize:            config.AppConfig.Webhooks.QueueSize,
+		AllowPrivateNetworks: config.AppConfig.Webhooks.AllowPrivateNetworks,
+	})
+
+	auditSink, err := audit.NewSink(audit.Options{
+		Sink:             config.AppConfig.Audit.Sink,
+		File:             config.AppConfig.Audit.File,
+		FileSyncInterval: config.AppConfig.Audit.FileSyncInterval,
+		RedisMaxLen:      config.AppConfig.Audit.MaxLen,
+		SQLDriver:        config.AppConfig.Audit.SQL.Driver,
+		SQLDSN:           config.AppConfig.Audit.SQL.DSN,
+	}, redisClient)
+	if err != nil {
+		logger.Log.Fatal("Failed to open audit log", zap.Error(err))
+	}
+	auditLog := audit.NewLog(auditSink)
+	auditLog.Limit(audit.ActionAuthenticate, rateLimit(config.AppConfig.Audit.RejectedTokens), config.AppConfig.Audit.RejectedTokens.Burst)
+
+	userNotifier, err := notifier.New(notifier.Options{
+		Backend: config.AppConfig.Notifier.Backend,
+		File:    config.AppConfig.Notifier.File,
+	})
+	if err != nil {
+		logger.Log.Fatal("Failed to create notifier", zap.Error(err))
+	}
+
+	var ssoProvider *sso.Provider
+	if cfg := config.AppConfig.OIDC; cfg.Issuer != "" {
+		ssoProvider, err = sso.New(context.Background(), sso.Options{
+			Issuer:         cfg.Issuer,
+			ClientID:       cfg.ClientID,
+			ClientSecret:   cfg.ClientSecret,
+			RedirectURL:    cfg.RedirectURL,
+			DeviceClientID: cfg.DeviceClientID,
+			Scopes:         cfg.Scopes,
+			UsernameClaim:  cfg.UsernameClaim,
+		})
+		if err != nil {
+			logger.Log.Fatal("Failed to set up single sign-on", zap.Error(err))
+		}
+		logger.Log.Info("Single sign-on enabled", zap.String("issuer", cfg.Issuer))
 	}
 
-	grpcServer := grpc.NewServer(
-		grpc.UnaryInterceptor(chatServer.AuthInterceptor),
-	)
+	chatServer := chat.NewChatServer(rateLimiter, redisClient, searchIndex, blobStore, webhooks, auditLog, userNotifier, ssoProvider)
+
+	go reloadOnSignal(rateLimiter, chatServer)
+
+	grpcOpts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler(otelgrpc.WithFilter(filters.Not(filters.HealthCheck())))),
+		grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor, logger.UnaryServerInterceptor, chatServer.AuthInterceptor),
+		grpc.ChainStreamInterceptor(metrics.StreamServerInterceptor, logger.StreamServerInterceptor, chatServer.StreamAuthInterceptor),
+	}
+	grpcTLS, err := listenerTLS(config.AppConfig.TLS.GRPC, "h2")
+	if err != nil {
+		logger.Log.Fatal("Failed to load gRPC TLS certificate", zap.Error(err))
+	}
+	if grpcTLS != nil {
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(grpcTLS)))
+	}
+	grpcServer := grpc.NewServer(grpcOpts...)
 
 	// register chatservice
 	pb.RegisterChatServiceServer(grpcServer, chatServer)
 
+	checker := health.NewChecker(redisClient, pb.ChatService_ServiceDesc.ServiceName)
+	healthpb.RegisterHealthServer(grpcServer, checker.GRPCServer())
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	defer stopHealth()
+	go checker.Run(healthCtx)
+
+	// browsers reach the same grpc server through gRPC-Web and Connect on the web server
+	browserRPC, err := newBrowserRPCHandler(grpcServer)
+	if err != nil {
+		logger.Log.Fatal("Failed to create gRPC-Web handler", zap.Error(err))
+	}
+
+	webTLS, err := listenerTLS(config.AppConfig.TLS.HTTP, "h2", "http/1.1")
+	if err != nil {
+		logger.Log.Fatal("Failed to load HTTP TLS certificate", zap.Error(err))
+	}
+
+	webServer := startWebServer(config.AppConfig.Server.HTTPAddr, redisClient, chatServer, ssoProvider, checker, browserRPC, webTLS)
+
+	var ircServer *irc.Server
+	if addr := config.AppConfig.IRC.Addr; addr != "" {
+		ircServer = irc.NewServer(chatServer, redisClient, config.AppConfig.IRC.ServerName)
+		go func() {
+			if err := ircServer.ListenAndServe(addr); err != nil && err != irc.ErrServerClosed {
+				logger.Log.Fatal("Failed to serve IRC", zap.Error(err))
+			}
+		}()
+	}
+
+	// initialize grpc server
+	lis, err := net.Listen("tcp", config.AppConfig.Server.GRPCAddr)
+	if err != nil {
+		logger.Log.Fatal("Failed to listen", zap.Error(err))
+	}
+
 	// start listening
-	logger.Log.Info("Starting gRPC server", zap.String("Address", lis.Addr().String()))
-	if err := grpcServer.Serve(lis); err != nil {
-		logger.Log.Fatal("Failed to serve", zap.Error(err))
+	logger.Log.Info("Starting gRPC server", zap.String("Address", lis.Addr().String()), zap.Bool("TLS", grpcTLS != nil))
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			logger.Log.Fatal("Failed to serve", zap.Error(err))
+		}
+	}()
+
+	// a second signal while draining kills the process as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	stopHealth()
+	shutdown(config.AppConfig.Server.ShutdownTimeout, checker, chatServer, grpcServer, webServer, ircServer, redisClient)
+
+	if err := auditLog.Close(); err != nil {
+		logger.Log.Error("Failed to close audit log", zap.Error(err))
+	}
+	if err := userNotifier.Close(); err != nil {
+		logger.Log.Error("Failed to close notifier", zap.Error(err))
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := flushTraces(flushCtx); err != nil {
+		logger.Log.Error("Failed to flush traces", zap.Error(err))
+	}
+}
+
+// listenerTLS returns nil when the listener has no certificate configured.
+// Rotated certificates are picked up while the server is running.
+func listenerTLS(cfg config.ListenerTLSConfig, nextProtos ...string) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := certs.NewReloader(certs.Options{
+		CertFile:     cfg.CertFile,
+		KeyFile:      cfg.KeyFile,
+		ClientCAFile: cfg.ClientCAFile,
+		ClientAuth:   cfg.ClientAuth,
+	})
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(config.AppConfig.TLS.ReloadInterval)
+
+	return reloader.ServerConfig(nextProtos...), nil
+}
+
+func newBlobStore() (blob.Store, error) {
+	cfg := config.AppConfig.Attachments
+	switch cfg.Backend {
+	case "local":
+		return blob.NewFileStore(cfg.Dir)
+	case "s3":
+		return blob.NewS3Store(context.Background(), blob.S3Options{
+			Endpoint:  cfg.S3.Endpoint,
+			Region:    cfg.S3.Region,
+			Bucket:    cfg.S3.Bucket,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+			UseSSL:    cfg.S3.UseSSL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown attachment backend %q", cfg.Backend)
 	}
 }
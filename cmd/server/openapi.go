@@ -0,0 +1,232 @@
+package main
+
+import (
+	"chat_app/internal/chat"
+	pb "chat_app/pb"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+type object = map[string]interface{}
+
+// openAPISpec describes the JSON gateway, built from gatewayRoutes and the
+// proto descriptors so it cannot drift from what is actually served
+func openAPISpec() object {
+	paths := object{}
+	for _, rt := range gatewayRoutes {
+		path := "/api/v1" + rt.path
+		item, ok := paths[path].(object)
+		if !ok {
+			item = object{}
+			paths[path] = item
+		}
+		item[strings.ToLower(rt.method)] = operation(rt)
+	}
+
+	paths["/api/v1/rooms/{room}/attachments"] = object{
+		"post": object{
+			"operationId": "UploadAttachment",
+			"summary":     "Upload a file to attach to a message",
+			"parameters":  []object{pathParam("room")},
+			"requestBody": object{
+				"required": true,
+				"content": object{
+					"multipart/form-data": object{
+						"schema": object{
+							"type":       "object",
+							"properties": object{"file": object{"type": "string", "format": "binary"}},
+							"required":   []string{"file"},
+						},
+					},
+				},
+			},
+			"responses": responses(object{"application/json": object{"schema": schemaRef("Attachment")}}),
+		},
+	}
+	paths["/api/v1/attachments/{id}"] = object{
+		"get": object{
+			"operationId": "DownloadAttachment",
+			"summary":     "Download an attachment",
+			"parameters":  []object{pathParam("id")},
+			"responses": responses(object{"application/octet-stream": object{
+				"schema": object{"type": "string", "format": "binary"},
+			}}),
+		},
+	}
+
+	schemas := object{
+		"Error": object{
+			"type":       "object",
+			"properties": object{"error": object{"type": "string"}},
+		},
+	}
+	messages := pb.File_chat_proto.Messages()
+	for i := 0; i < messages.Len(); i++ {
+		schemas[string(messages.Get(i).Name())] = messageSchema(messages.Get(i))
+	}
+	enums := pb.File_chat_proto.Enums()
+	for i := 0; i < enums.Len(); i++ {
+		schemas[string(enums.Get(i).Name())] = enumSchema(enums.Get(i))
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "Chat API",
+			"version":     "1",
+			"description": "JSON gateway for the chat.ChatService gRPC API. Server streaming RPCs are served as server-sent events.",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": schemas,
+			"securitySchemes": object{
+				"bearerAuth": object{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A session token from Login or Register, or a bot API token",
+				},
+			},
+		},
+		"security": []object{{"bearerAuth": []string{}}},
+	}
+}
+
+// writeOpenAPISpec writes the spec to path; go generate keeps api/openapi.json up to date with it
+func writeOpenAPISpec(path string) error {
+	data, err := json.MarshalIndent(openAPISpec(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func operation(rt route) object {
+	method := serviceMethod(rt.rpc)
+	input := method.Input()
+
+	var params []object
+	inPath := map[string]bool{}
+	for _, match := range pathParamPattern.FindAllStringSubmatch(rt.path, -1) {
+		inPath[match[1]] = true
+		params = append(params, pathParam(match[1]))
+	}
+
+	op := object{
+		"operationId": rt.rpc,
+		"summary":     rt.summary,
+	}
+
+	if rt.body {
+		op["requestBody"] = object{
+			"required": true,
+			"content":  object{"application/json": object{"schema": schemaRef(string(input.Name()))}},
+		}
+	} else {
+		fields := input.Fields()
+		for i := 0; i < fields.Len(); i++ {
+			field := fields.Get(i)
+			if inPath[string(field.Name())] || field.Kind() == protoreflect.MessageKind {
+				continue
+			}
+			params = append(params, object{
+				"name":   string(field.Name()),
+				"in":     "query",
+				"schema": fieldSchema(field),
+			})
+		}
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	content := object{"application/json": object{"schema": schemaRef(string(method.Output().Name()))}}
+	if method.IsStreamingServer() {
+		// each event's data line is one JSON encoded message
+		content = object{"text/event-stream": object{"schema": schemaRef(string(method.Output().Name()))}}
+	}
+	op["responses"] = responses(content)
+
+	// the only calls that do not need a token
+	if chat.IsPublicMethod("/chat.ChatService/" + rt.rpc) {
+		op["security"] = []object{}
+	}
+	return op
+}
+
+func responses(content object) object {
+	return object{
+		"200": object{"description": "OK", "content": content},
+		"default": object{
+			"description": "Error",
+			"content":     object{"application/json": object{"schema": schemaRef("Error")}},
+		},
+	}
+}
+
+func pathParam(name string) object {
+	return object{
+		"name":     name,
+		"in":       "path",
+		"required": true,
+		"schema":   object{"type": "string"},
+	}
+}
+
+func schemaRef(name string) object {
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+func messageSchema(message protoreflect.MessageDescriptor) object {
+	properties := object{}
+	fields := message.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		properties[field.JSONName()] = fieldSchema(field)
+	}
+	return object{"type": "object", "properties": properties}
+}
+
+func enumSchema(enum protoreflect.EnumDescriptor) object {
+	var names []string
+	values := enum.Values()
+	for i := 0; i < values.Len(); i++ {
+		names = append(names, string(values.Get(i).Name()))
+	}
+	return object{"type": "string", "enum": names}
+}
+
+// fieldSchema follows the protojson mapping, which encodes 64 bit integers as strings
+func fieldSchema(field protoreflect.FieldDescriptor) object {
+	if field.IsMap() {
+		return object{"type": "object", "additionalProperties": fieldSchema(field.MapValue())}
+	}
+
+	var schema object
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		schema = object{"type": "boolean"}
+	case protoreflect.Int32Kind:
+		schema = object{"type": "integer", "format": "int32"}
+	case protoreflect.Int64Kind:
+		schema = object{"type": "string", "format": "int64"}
+	case protoreflect.BytesKind:
+		schema = object{"type": "string", "format": "byte"}
+	case protoreflect.EnumKind:
+		schema = schemaRef(string(field.Enum().Name()))
+	case protoreflect.MessageKind:
+		schema = schemaRef(string(field.Message().Name()))
+	default:
+		schema = object{"type": "string"}
+	}
+
+	if field.IsList() {
+		return object{"type": "array", "items": schema}
+	}
+	return schema
+}
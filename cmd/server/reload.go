@@ -0,0 +1,71 @@
+package main
+
+import (
+	"chat_app/config"
+	"chat_app/internal/chat"
+	"chat_app/internal/logger"
+	"chat_app/internal/ratelimit"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// reloadOnSignal reloads the configuration whenever the process gets SIGHUP
+func reloadOnSignal(rateLimiter *ratelimit.RateLimiter, chatServer *chat.ChatServer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		reloadConfig(rateLimiter, chatServer)
+	}
+}
+
+// reloadConfig applies the settings that are safe to change while clients are
+// connected: the log level and redaction, rate limits, banned words and message
+// history. An invalid config is ignored and the server keeps running with the
+// current one.
+func reloadConfig(rateLimiter *ratelimit.RateLimiter, chatServer *chat.ChatServer) {
+	cfg, err := config.Reload()
+	if err != nil {
+		logger.Log.Error("Failed to reload configuration, keeping the current one", zap.Error(err))
+		return
+	}
+
+	if err := logger.SetLevel(cfg.Logger.Level); err != nil {
+		logger.Log.Error("Failed to set log level", zap.Error(err))
+	}
+	logger.SetRedaction(cfg.Logger.Redact.Messages, cfg.Logger.Redact.Credentials)
+	rateLimiter.SetLimit(rateLimit(cfg.RateLimit), cfg.RateLimit.Burst)
+	chatServer.SetBannedWords(cfg.Moderation.BannedWords)
+	chatServer.SetHistory(cfg.History)
+
+	logger.Log.Info("Reloaded configuration",
+		zap.String("level", cfg.Logger.Level),
+		zap.Duration("rate", cfg.RateLimit.Rate),
+		zap.Int("burst", cfg.RateLimit.Burst),
+		zap.Int("bannedWords", len(cfg.Moderation.BannedWords)),
+		zap.Int("maxMessages", cfg.History.MaxMessages),
+		zap.Int("replay", cfg.History.Replay),
+	)
+
+	// everything else is read once at startup
+	unapplied := *cfg
+	unapplied.Logger.Level = config.AppConfig.Logger.Level
+	unapplied.Logger.Redact = config.AppConfig.Logger.Redact
+	unapplied.RateLimit = config.AppConfig.RateLimit
+	unapplied.Moderation = config.AppConfig.Moderation
+	unapplied.History = config.AppConfig.History
+	if !reflect.DeepEqual(&unapplied, config.AppConfig) {
+		logger.Log.Warn("Some changed settings only take effect after a restart")
+	}
+}
+
+// rateLimit converts the configured interval between messages to a rate
+func rateLimit(cfg config.RateLimitConfig) rate.Limit {
+	return rate.Limit(float64(time.Second) / float64(cfg.Rate))
+}
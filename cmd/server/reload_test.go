@@ -0,0 +1,116 @@
+package main
+
+import (
+	"chat_app/config"
+	"chat_app/internal/logger"
+	"chat_app/internal/ratelimit"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/time/rate"
+)
+
+func TestReloadOnSignal(t *testing.T) {
+	newTestServer(t) // sets up the logger the first time
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("logger:\n  level: error\n")
+	previous := config.AppConfig
+	t.Cleanup(func() { config.AppConfig = previous })
+	if err := config.LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	previousLog := logger.Log
+	logger.Log = zap.New(core)
+	t.Cleanup(func() { logger.Log = previousLog })
+
+	chatServer, rdb, _ := newTestServer(t)
+	alice, _ := registerUser(t, chatServer, "alice")
+	rateLimiter := ratelimit.NewRateLimiter(rate.Inf, 100)
+
+	// the test catches SIGHUP too, so it never takes the default action of exiting
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGHUP)
+	go reloadOnSignal(rateLimiter, chatServer)
+
+	// hangup signals the process until it logs message
+	hangup := func(message string) {
+		t.Helper()
+		process, err := os.FindProcess(os.Getpid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := logs.FilterMessage(message).Len()
+		for deadline := time.Now().Add(5 * time.Second); logs.FilterMessage(message).Len() == seen; time.Sleep(20 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("no %q after SIGHUP", message)
+			}
+			if err := process.Signal(syscall.SIGHUP); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// post sends messages to room and returns how many the room keeps
+	post := func(room string, n int) int {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if err := chatServer.PostMessage(alice, &pb.ChatMessage{User: "alice", Room: room, Message: "hi", Timestamp: time.Now().Unix()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		messages, err := storage.GetLastNMessages(rdb, room, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(messages)
+	}
+
+	writeConfig(`
+logger:
+  level: error
+ratelimit:
+  rate: 1h
+  burst: 2
+history:
+  maxMessages: 3
+  replay: 2
+`)
+	hangup("Reloaded configuration")
+	if !rateLimiter.Allow() || !rateLimiter.Allow() || rateLimiter.Allow() {
+		t.Error("the new rate limit was not applied")
+	}
+	if kept := post("general", 5); kept != 3 {
+		t.Errorf("%d messages kept, want 3", kept)
+	}
+
+	// an invalid config changes nothing
+	writeConfig(`
+ratelimit:
+  rate: 1ms
+  burst: 100
+history:
+  maxMessages: 50
+  replay: 60
+`)
+	hangup("Failed to reload configuration, keeping the current one")
+	if rateLimiter.Allow() {
+		t.Error("the rate limit of the rejected config was applied")
+	}
+	if kept := post("random", 5); kept != 3 {
+		t.Errorf("%d messages kept after the rejected config, want 3", kept)
+	}
+}
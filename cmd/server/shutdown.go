@@ -0,0 +1,74 @@
+package main
+
+import (
+	"chat_app/internal/chat"
+	"chat_app/internal/health"
+	"chat_app/internal/irc"
+	"chat_app/internal/logger"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// shutdown drains every listener within timeout. Readiness checks fail from
+// the start and streams are told the server is going away, so clients can
+// reconnect to another instance. Then the servers stop accepting connections
+// and wait for in-flight requests. Redis is closed last, once nothing can use
+// it anymore.
+func shutdown(timeout time.Duration, checker *health.Checker, chatServer *chat.ChatServer, grpcServer *grpc.Server, webServer *http.Server, ircServer *irc.Server, redisClient *redis.Client) {
+	logger.Log.Info("Shutting down", zap.Duration("timeout", timeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	checker.Shutdown()
+
+	// streams end on their own, otherwise GracefulStop and Shutdown would wait for them forever
+	chatServer.GoingAway()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+			logger.Log.Info("gRPC server stopped")
+		case <-ctx.Done():
+			logger.Log.Warn("gRPC server did not drain in time, closing remaining connections")
+			// Stop blocks for as long as GracefulStop waits for the handlers
+			// that are still running, so it is not waited for
+			go grpcServer.Stop()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+
+		if err := webServer.Shutdown(ctx); err != nil {
+			logger.Log.Warn("Web server did not drain in time, closing remaining connections", zap.Error(err))
+			webServer.Close()
+			return
+		}
+		logger.Log.Info("Web server stopped")
+	}()
+	if ircServer != nil {
+		ircServer.Shutdown()
+	}
+	wg.Wait()
+
+	if err := redisClient.Close(); err != nil {
+		logger.Log.Error("Failed to close Redis client", zap.Error(err))
+	}
+	logger.Log.Info("Shutdown complete")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"chat_app/internal/chat"
+	"chat_app/internal/health"
+	pb "chat_app/pb"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// drainTest is a chat server on an in-memory listener whose ListRooms calls
+// wait in the server until release is closed
+type drainTest struct {
+	chatServer *chat.ChatServer
+	rdb        *redis.Client
+	checker    *health.Checker
+	grpcServer *grpc.Server
+	client     pb.ChatServiceClient
+	// a context that authenticates calls as alice
+	ctx              context.Context
+	started, release chan struct{}
+}
+
+func newDrainTest(t *testing.T) *drainTest {
+	t.Helper()
+	chatServer, rdb, _ := newTestServer(t)
+	_, token := registerUser(t, chatServer, "alice")
+	d := &drainTest{
+		chatServer: chatServer,
+		rdb:        rdb,
+		checker:    health.NewChecker(rdb, pb.ChatService_ServiceDesc.ServiceName),
+		ctx:        metadata.AppendToOutgoingContext(context.Background(), "authorization", token),
+		started:    make(chan struct{}, 1),
+		release:    make(chan struct{}),
+	}
+
+	hold := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == pb.ChatService_ListRooms_FullMethodName {
+			d.started <- struct{}{}
+			<-d.release
+		}
+		return handler(ctx, req)
+	}
+	d.grpcServer = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(chatServer.AuthInterceptor, hold),
+		grpc.ChainStreamInterceptor(chatServer.StreamAuthInterceptor),
+	)
+	pb.RegisterChatServiceServer(d.grpcServer, chatServer)
+	healthpb.RegisterHealthServer(d.grpcServer, d.checker.GRPCServer())
+
+	lis := bufconn.Listen(1 << 20)
+	go d.grpcServer.Serve(lis)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	d.client = pb.NewChatServiceClient(conn)
+
+	// the checker starts out not ready, wait for its first probe
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	t.Cleanup(stopHealth)
+	go d.checker.Run(healthCtx)
+	for deadline := time.Now().Add(5 * time.Second); d.checker.Ready() != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("not ready: %v", d.checker.Ready())
+		}
+	}
+	return d
+}
+
+// openStream opens a message stream and waits until the server is running it
+func (d *drainTest) openStream(t *testing.T, room string) pb.ChatService_StreamMessagesClient {
+	t.Helper()
+	if _, err := d.client.SendMessage(d.ctx, &pb.ChatMessage{User: "alice", Room: room, Message: "hi", Timestamp: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := d.client.StreamMessages(d.ctx, &pb.StreamMessagesRequest{Room: room})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the replayed history comes from the handler
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+// listRooms starts a ListRooms call and waits until it is held in the server
+func (d *drainTest) listRooms(t *testing.T) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.client.ListRooms(d.ctx, &pb.Empty{})
+		done <- err
+	}()
+	select {
+	case <-d.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListRooms did not reach the server")
+	}
+	return done
+}
+
+// shutdown runs shutdown in the background and returns when it has finished
+func (d *drainTest) shutdown(timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		shutdown(timeout, d.checker, d.chatServer, d.grpcServer, &http.Server{}, nil, d.rdb)
+		close(done)
+	}()
+	return done
+}
+
+func TestShutdownDrains(t *testing.T) {
+	d := newDrainTest(t)
+	stream := d.openStream(t, "general")
+	inFlight := d.listRooms(t)
+
+	done := d.shutdown(5 * time.Second)
+
+	// skipping events such as alice's own join
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("stream ended without EVENT_GOING_AWAY: %v", err)
+		}
+		if msg.Type == pb.EventType_EVENT_GOING_AWAY {
+			break
+		}
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("stream ended with %v", err)
+	}
+
+	// readiness is off as soon as streams are told, while requests still drain
+	if d.checker.Ready() == nil {
+		t.Error("still ready while shutting down")
+	}
+	resp, err := d.checker.GRPCServer().Check(context.Background(), &healthpb.HealthCheckRequest{Service: pb.ChatService_ServiceDesc.ServiceName})
+	if err != nil || resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("gRPC health reports %v, %v while shutting down", resp, err)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown did not wait for the in-flight call")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := d.rdb.Ping(context.Background()).Err(); err != nil {
+		t.Errorf("redis closed before the in-flight call finished: %v", err)
+	}
+
+	close(d.release)
+	if err := <-inFlight; err != nil {
+		t.Errorf("in-flight call failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+	if err := d.rdb.Ping(context.Background()).Err(); err != redis.ErrClosed {
+		t.Errorf("redis not closed after shutdown: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	d := newDrainTest(t)
+	defer close(d.release)
+	inFlight := d.listRooms(t)
+
+	start := time.Now()
+	select {
+	case <-d.shutdown(200 * time.Millisecond):
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not give up on the in-flight call")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("shutdown gave up after %s", elapsed)
+	}
+	if err := <-inFlight; status.Code(err) != codes.Unavailable {
+		t.Errorf("call cut off by shutdown ended with %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"chat_app/internal/chat"
+	"chat_app/internal/logger"
+	"chat_app/internal/metrics"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// proxies drop idle connections, so idle event streams get a comment this often
+const sseKeepAlive = 15 * time.Second
+
+// serveEvents runs a server streaming RPC and sends every message as a
+// server-sent event with a JSON data line
+func serveEvents(w http.ResponseWriter, r *http.Request, chatServer *chat.ChatServer, rt route, method protoreflect.MethodDescriptor) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	req, err := decodeRequest(w, r, rt, method.Input())
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+
+	stream := &sseStream{ctx: incomingContext(r), w: w, flusher: flusher, req: req}
+	info := &grpc.StreamServerInfo{
+		FullMethod:     fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name()),
+		IsServerStream: true,
+	}
+	handler := streamHandler(rt.rpc)
+
+	err = metrics.StreamServerInterceptor(chatServer, stream, info, func(srv interface{}, ss grpc.ServerStream) error {
+		return logger.StreamServerInterceptor(srv, ss, info, func(srv interface{}, ss grpc.ServerStream) error {
+			return chatServer.StreamAuthInterceptor(srv, ss, info, func(srv interface{}, ss grpc.ServerStream) error {
+				// authenticated, so the event stream can start
+				stream.start()
+				return handler(srv, ss)
+			})
+		})
+	})
+	stream.stop()
+
+	if err != nil && !stream.started {
+		writeStatusError(w, err)
+	} else if err != nil {
+		stream.event("error", []byte(fmt.Sprintf("%q", status.Convert(err).Message())))
+	}
+}
+
+// sseStream adapts an http response to the grpc.ServerStream a streaming RPC writes to
+type sseStream struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	flusher http.Flusher
+	req     proto.Message
+
+	mu       sync.Mutex
+	started  bool
+	received bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func (s *sseStream) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	s.w.WriteHeader(http.StatusOK)
+	s.flusher.Flush()
+	s.started = true
+
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go s.keepAlive()
+}
+
+// stop ends the keep-alives, nothing may write to the response once the handler returns
+func (s *sseStream) stop() {
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+	}
+}
+
+func (s *sseStream) keepAlive() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			io.WriteString(s.w, ": keep-alive\n\n")
+			s.flusher.Flush()
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *sseStream) event(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name != "" {
+		fmt.Fprintf(s.w, "event: %s\n", name)
+	}
+	// protojson output has no raw newlines, so a single data line is enough
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseStream) SendMsg(m interface{}) error {
+	data, err := gatewayMarshal.Marshal(m.(proto.Message))
+	if err != nil {
+		return err
+	}
+	return s.event("", data)
+}
+
+// RecvMsg hands the request decoded from the URL to the RPC handler, once
+func (s *sseStream) RecvMsg(m interface{}) error {
+	if s.received {
+		return io.EOF
+	}
+	s.received = true
+	proto.Merge(m.(proto.Message), s.req)
+	return nil
+}
+
+func (s *sseStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *sseStream) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *sseStream) SendHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *sseStream) SetTrailer(metadata.MD) {}
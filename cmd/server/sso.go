@@ -0,0 +1,146 @@
+package main
+
+import (
+	"chat_app/internal/chat"
+	"chat_app/internal/logger"
+	"chat_app/internal/sso"
+	"chat_app/internal/storage"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ssoStateCookie = "oidc_state"
+	// how long the user may take at the provider's login page
+	ssoStateTTL = 10 * time.Minute
+)
+
+// ssoState is what the callback needs from the request that started the login
+type ssoState struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+}
+
+// registerSSO serves the browser side of single sign-on. /auth/oidc/login
+// sends the browser to the provider, which sends it back to the callback,
+// and from there it goes on to the page it came from with the session token
+// in the URL fragment, which browsers do not send to servers.
+func registerSSO(r *mux.Router, provider *sso.Provider, chatServer *chat.ChatServer, redisClient *redis.Client) {
+	r.HandleFunc("/auth/oidc/login", func(w http.ResponseWriter, r *http.Request) {
+		handleSSOLogin(w, r, provider, redisClient)
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/auth/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+		handleSSOCallback(w, r, provider, chatServer, redisClient)
+	}).Methods(http.MethodGet)
+}
+
+func handleSSOLogin(w http.ResponseWriter, r *http.Request, provider *sso.Provider, redisClient *redis.Client) {
+	ctx := r.Context()
+	// GenerateVerifier is 32 random bytes, as good a state and nonce as any
+	state := oauth2.GenerateVerifier()
+	s := ssoState{
+		Nonce:    oauth2.GenerateVerifier(),
+		Verifier: oauth2.GenerateVerifier(),
+		Return:   localPath(r.URL.Query().Get("return")),
+	}
+	data, _ := json.Marshal(s)
+	if err := storage.SaveSSOState(redisClient.WithContext(ctx), state, string(data), ssoStateTTL); err != nil {
+		logger.FromContext(ctx).Error("Failed to save single sign-on state", zap.Error(err))
+		http.Error(w, "Failed to start single sign-on", http.StatusInternalServerError)
+		return
+	}
+
+	// the state must come back to the browser that started the login, not to
+	// one a link with someone else's state was sent to
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc/",
+		MaxAge:   int(ssoStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, provider.AuthCodeURL(state, s.Nonce, s.Verifier), http.StatusFound)
+}
+
+func handleSSOCallback(w http.ResponseWriter, r *http.Request, provider *sso.Provider, chatServer *chat.ChatServer, redisClient *redis.Client) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(ssoStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		http.Error(w, "Single sign-on was started in another browser, or too long ago", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: ssoStateCookie, Path: "/auth/oidc/", MaxAge: -1})
+
+	data, err := storage.TakeSSOState(redisClient.WithContext(ctx), state)
+	if err == redis.Nil {
+		http.Error(w, "Single sign-on was started too long ago, try again", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to get single sign-on state", zap.Error(err))
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	var s ssoState
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		logger.FromContext(ctx).Error("Failed to decode single sign-on state", zap.Error(err))
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	// the user declined, or the provider refused them
+	if reason := query.Get("error"); reason != "" {
+		if description := query.Get("error_description"); description != "" {
+			reason += ": " + description
+		}
+		http.Error(w, "Single sign-on failed: "+reason, http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := provider.Exchange(ctx, query.Get("code"), s.Nonce, s.Verifier)
+	if err != nil {
+		logger.FromContext(ctx).Info("Single sign-on failed", zap.Error(err))
+		http.Error(w, "Single sign-on failed", http.StatusUnauthorized)
+		return
+	}
+
+	resp, err := chatServer.LoginSSO(ctx, identity)
+	if err != nil {
+		st := status.Convert(err)
+		http.Error(w, st.Message(), httpStatusFromCode(st.Code()))
+		return
+	}
+
+	fragment := url.Values{"token": {resp.Token}, "username": {resp.Username}}
+	http.Redirect(w, r, s.Return+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// localPath keeps the redirect after logging in on this server. Browsers
+// drop tabs and newlines from URLs and read backslashes as slashes, so a path
+// containing any of them could still lead to another host.
+func localPath(path string) string {
+	if strings.Contains(path, `\`) || strings.IndexFunc(path, unicode.IsControl) >= 0 {
+		return "/"
+	}
+	u, err := url.Parse(path)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(path, "//") {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/room/?roomName=general", "/room/?roomName=general"},
+		{"/", "/"},
+		{"", "/"},
+		{"room", "/"},
+		{"https://evil.example.com/", "/"},
+		{"//evil.example.com/", "/"},
+		{"/\\evil.example.com/", "/"},
+		{"/\t/evil.example.com", "/"},
+		{"/\n/evil.example.com", "/"},
+		{"/\r\n/evil.example.com", "/"},
+		{"\t//evil.example.com", "/"},
+		{"/room\\..\\evil", "/"},
+		{"http:/evil.example.com", "/"},
+		{"/room/?return=//evil.example.com", "/room/?return=//evil.example.com"},
+		{"javascript:alert(1)", "/"},
+	}
+	for _, tt := range tests {
+		if got := localPath(tt.path); got != tt.want {
+			t.Errorf("localPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
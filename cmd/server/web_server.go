@@ -1,16 +1,31 @@
 package main
 
 import (
+	"chat_app/internal/chat"
+	"chat_app/internal/health"
+	"chat_app/internal/logger"
+	"chat_app/internal/metrics"
+	"chat_app/internal/sso"
 	"chat_app/internal/storage"
 	pb "chat_app/pb"
+	"crypto/tls"
 	"encoding/json"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"time"
 
+	"github.com/felixge/httpsnoop"
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
 )
 
 var upgrader = websocket.Upgrader{
@@ -21,19 +36,127 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func startWebServer(redisClient *redis.Client) {
+// startWebServer serves the web ui and HTTP APIs in the background. Stop it
+// with Shutdown on the returned server.
+func startWebServer(addr string, redisClient *redis.Client, chatServer *chat.ChatServer, ssoProvider *sso.Provider, checker *health.Checker, browserRPC http.Handler, tlsConfig *tls.Config) *http.Server {
 	r := mux.NewRouter()
+	r.Use(nameSpanAfterRoute)
+	server := &http.Server{Addr: addr, Handler: traceHTTP(logRequests(r)), TLSConfig: tlsConfig}
+
+	// Shutdown does not wait for hijacked connections, so websockets are told separately
+	shuttingDown := make(chan struct{})
+	server.RegisterOnShutdown(func() { close(shuttingDown) })
+
+	// gRPC-Web and Connect calls are posted to /chat.ChatService/<Method>
+	r.PathPrefix("/" + pb.ChatService_ServiceDesc.ServiceName + "/").Handler(browserRPC)
+
+	// probes for orchestrators; /readyz also fails while shutting down
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, checker.Check())
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, checker.Ready())
+	}).Methods(http.MethodGet)
+
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
 
 	r.HandleFunc("/", handleHome)
-	r.HandleFunc("/room/", handleRoom)
+	r.HandleFunc("/room/", func(w http.ResponseWriter, r *http.Request) {
+		handleRoom(w, r, redisClient, ssoProvider != nil)
+	})
+	if ssoProvider != nil {
+		registerSSO(r, ssoProvider, chatServer, redisClient)
+	}
+	// read-only JSON feed from before the room page used Connect, kept for existing consumers
 	r.HandleFunc("/ws/{roomName}", func(w http.ResponseWriter, r *http.Request) {
-		handleWebSocket(w, r, redisClient)
+		handleWebSocket(w, r, redisClient, shuttingDown)
+	})
+
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/rooms/{room}/messages", func(w http.ResponseWriter, r *http.Request) {
+		handlePostMessage(w, r, chatServer)
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/rooms/{room}/attachments", func(w http.ResponseWriter, r *http.Request) {
+		handleUploadAttachment(w, r, chatServer)
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/attachments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleDownloadAttachment(w, r, chatServer)
+	}).Methods(http.MethodGet)
+	registerGateway(api.PathPrefix("/v1").Subrouter(), chatServer)
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			log.Println("Starting web server on", addr, "with TLS")
+			// the certificate comes from tlsConfig, which reloads it when it changes
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Println("Starting web server on", addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe: ", err)
+		}
+	}()
+
+	return server
+}
+
+// traceHTTP starts a server span for every request except probes and scrapes,
+// continuing the caller's trace when it sends a traceparent header
+func traceHTTP(handler http.Handler) http.Handler {
+	return otelhttp.NewHandler(handler, "HTTP",
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			switch r.URL.Path {
+			case "/healthz", "/readyz", "/metrics":
+				return false
+			}
+			return true
+		}),
+	)
+}
+
+// logRequests gives each request an ID, taken from the X-Request-ID header
+// if the client sent one, and a logger carrying it. The ID is sent back in the
+// response and reaches gRPC-Web and Connect calls as metadata.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := logger.RequestID(r.Header.Get(logger.RequestIDHeader))
+		r.Header.Set(logger.RequestIDHeader, id)
+		w.Header().Set(logger.RequestIDHeader, id)
+
+		ctx := logger.NewRequestContext(r.Context(), id, zap.String("httpMethod", r.Method), zap.String("path", r.URL.Path))
+		// the client's address, as gRPC would give it, for the audit log
+		if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			ctx = peer.NewContext(ctx, &peer.Peer{Addr: net.TCPAddrFromAddrPort(addr)})
+		}
+		m := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			return
+		}
+		logger.FromContext(ctx).Info("Finished HTTP request", zap.Int("status", m.Code), zap.Duration("duration", m.Duration))
+	})
+}
+
+// nameSpanAfterRoute names the request span after the matched route template,
+// such as "POST /api/rooms/{room}/messages", rather than the raw path
+func nameSpanAfterRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tmpl, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+			trace.SpanFromContext(r.Context()).SetName(r.Method + " " + tmpl)
+		}
+		next.ServeHTTP(w, r)
 	})
+}
 
-	log.Println("Starting web server on :8080")
-	if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+func writeHealth(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+		return
 	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
 func handleHome(w http.ResponseWriter, r *http.Request) {
@@ -41,17 +164,22 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 	tmpl.Execute(w, nil)
 }
 
-func handleRoom(w http.ResponseWriter, r *http.Request) {
+func handleRoom(w http.ResponseWriter, r *http.Request, redisClient *redis.Client, ssoEnabled bool) {
 	roomName := r.URL.Query().Get("roomName")
 	if roomName == "" {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	topic, err := storage.GetRoomTopic(redisClient, roomName)
+	if err != nil {
+		log.Println("Error getting topic:", err)
+	}
+
 	tmpl := template.Must(template.ParseFiles("templates/room.html"))
-	tmpl.Execute(w, map[string]string{"RoomName": roomName})
+	tmpl.Execute(w, map[string]interface{}{"RoomName": roomName, "Topic": topic, "SSO": ssoEnabled})
 }
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request, redisClient *redis.Client) {
+func handleWebSocket(w http.ResponseWriter, r *http.Request, redisClient *redis.Client, shuttingDown <-chan struct{}) {
 	vars := mux.Vars(r)
 	roomName := vars["roomName"]
 
@@ -62,26 +190,77 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, redisClient *redis.
 	}
 	defer conn.Close()
 
+	metrics.ActiveWebSockets.Inc()
+	defer metrics.ActiveWebSockets.Dec()
+
 	// Subscribe to Redis channel for the specific room
 	pubsub := storage.SubscribeToMessages(redisClient, "chat_messages:"+roomName)
 	defer pubsub.Close()
 
 	channel := pubsub.Channel()
 
-	for msg := range channel {
+	for {
+		var msg *redis.Message
+		select {
+		case <-shuttingDown:
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server is shutting down")
+			conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+			return
+		case m, ok := <-channel:
+			if !ok {
+				return
+			}
+			msg = m
+		}
+
 		var chatMessage pb.ChatMessage
 		if err := json.Unmarshal([]byte(msg.Payload), &chatMessage); err != nil {
 			log.Println("Error unmarshalling message:", err)
 			continue
 		}
 
+		// read receipts are only for gRPC clients that opt in
+		if chatMessage.Type == pb.EventType_EVENT_READ_RECEIPT {
+			continue
+		}
+		// the page is not logged in, so it never gets private command output
+		if chatMessage.Recipient != "" {
+			continue
+		}
+
 		// Create a map of the message data to avoid copying the mutex
 		messageData := map[string]interface{}{
+			"id":        chatMessage.Id,
+			"seq":       chatMessage.Seq,
 			"user":      chatMessage.User,
+			"nick":      chatMessage.Nick,
 			"message":   chatMessage.Message,
 			"timestamp": chatMessage.Timestamp,
 			"room":      chatMessage.Room,
+			"type":      chatMessage.Type.String(),
+		}
+
+		var attachments []map[string]interface{}
+		for _, attachment := range chatMessage.Attachments {
+			attachments = append(attachments, map[string]interface{}{
+				"id":          attachment.Id,
+				"filename":    attachment.Filename,
+				"contentType": attachment.ContentType,
+				"size":        attachment.Size,
+			})
+		}
+		messageData["attachments"] = attachments
+
+		var segments []map[string]interface{}
+		for _, segment := range chatMessage.Segments {
+			segments = append(segments, map[string]interface{}{
+				"type":     segment.Type.String(),
+				"text":     segment.Text,
+				"url":      segment.Url,
+				"language": segment.Language,
+			})
 		}
+		messageData["segments"] = segments
 
 		if err := conn.WriteJSON(messageData); err != nil {
 			log.Println("Error writing to WebSocket:", err)
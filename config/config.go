@@ -1,20 +1,134 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Logger    LoggerConfig
-	RateLimit RateLimitConfig
+	Server      ServerConfig
+	Redis       RedisConfig
+	Auth        AuthConfig
+	History     HistoryConfig
+	Logger      LoggerConfig
+	RateLimit   RateLimitConfig
+	Search      SearchConfig
+	Attachments AttachmentConfig
+	Webhooks    WebhookConfig
+	IRC         IRCConfig
+	TLS         TLSConfig
+	Moderation  ModerationConfig
+	Tracing     TracingConfig
+	Audit       AuditConfig
+	Notifier    NotifierConfig
+	OIDC        OIDCConfig
+}
+
+type ServerConfig struct {
+	GRPCAddr string
+	HTTPAddr string
+	// ShutdownTimeout is how long connections may take to drain on SIGTERM
+	ShutdownTimeout time.Duration
+}
+
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+}
+
+type AuthConfig struct {
+	TokenTTL  time.Duration
+	JWTSecret string
+	// Admins are the usernames allowed to read the audit log
+	Admins        []string
+	Lockout       LockoutConfig
+	Username      UsernameConfig
+	Password      PasswordConfig
+	PasswordReset PasswordResetConfig
+	TwoFactor     TwoFactorConfig
+}
+
+// UsernameConfig applies to new accounts. Usernames may only contain
+// letters, digits, '_' and '-', like bot names.
+type UsernameConfig struct {
+	MinLength int
+	MaxLength int
+}
+
+// PasswordConfig is checked when a password is set, at registration, change
+// or reset. Lengths are in bytes.
+type PasswordConfig struct {
+	MinLength int
+	// bcrypt ignores everything after 72 bytes, so longer passwords are refused
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// RejectUsername refuses passwords that contain the username
+	RejectUsername bool
+}
+
+type TwoFactorConfig struct {
+	// Issuer names the server in authenticator apps
+	Issuer string
+	// RequireForAdmins refuses the sessions of admins without two-factor
+	// authentication for anything but enabling it
+	RequireForAdmins bool
+	// ChallengeTTL is how long a login may take to send its code
+	ChallengeTTL  time.Duration
+	RecoveryCodes int
+}
+
+type PasswordResetConfig struct {
+	// TokenTTL is how long a reset token can be used
+	TokenTTL time.Duration
+	// Cooldown is how long to wait before sending a user another token
+	Cooldown time.Duration
+}
+
+// LockoutConfig slows down password guessing. Failed logins are counted per
+// account and per client address; after FreeAttempts failures each further
+// one blocks logins for a delay starting at BaseDelay and doubling up to
+// MaxDelay, and after MaxAttempts they are blocked for Duration.
+type LockoutConfig struct {
+	// Window is how long failures are remembered after the last one
+	Window       time.Duration
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	MaxAttempts  int
+	Duration     time.Duration
+	// a client address may be shared by many users, so it gets more attempts
+	IPFreeAttempts int
+	IPMaxAttempts  int
+}
+
+type HistoryConfig struct {
+	// MaxMessages is how many messages are kept per room
+	MaxMessages int
+	// Replay is how many recent messages are sent when a client joins a room
+	Replay int
 }
 
 type LoggerConfig struct {
 	OutputPaths      []string
 	ErrorOutputPaths []string
 	Level            string
+	Redact           RedactConfig
+}
+
+// RedactConfig chooses what is left out of log lines
+type RedactConfig struct {
+	// Messages hides what users write in messages
+	Messages bool
+	// Credentials hides passwords, tokens and secrets
+	Credentials bool
 }
 
 type RateLimitConfig struct {
@@ -22,31 +136,293 @@ type RateLimitConfig struct {
 	Burst int
 }
 
+type SearchConfig struct {
+	Backend string // "redis" or "memory"
+}
+
+type AttachmentConfig struct {
+	Backend      string // "local" or "s3"
+	Dir          string
+	MaxSize      int64
+	AllowedTypes []string
+	S3           S3Config
+}
+
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+type WebhookConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	Timeout        time.Duration
+	MaxConcurrent  int
+	QueueSize      int
+	// AllowPrivateNetworks lets webhooks and bot commands reach loopback,
+	// private and link-local addresses
+	AllowPrivateNetworks bool
+}
+
+type IRCConfig struct {
+	Addr       string // empty disables the IRC gateway
+	ServerName string
+}
+
+type ModerationConfig struct {
+	// BannedWords are rejected in messages, case insensitively
+	BannedWords []string
+}
+
+type TracingConfig struct {
+	Exporter string // "none", "otlp" or "stdout"
+	// Endpoint is the OTLP gRPC collector, host:port
+	Endpoint    string
+	Insecure    bool
+	SampleRatio float64
+	ServiceName string
+}
+
+// TLSConfig has the certificates of the gRPC and HTTP listeners. A listener
+// without a certificate serves plaintext.
+type TLSConfig struct {
+	GRPC ListenerTLSConfig
+	HTTP ListenerTLSConfig
+	// ReloadInterval is how often certificate files are checked for changes
+	ReloadInterval time.Duration
+}
+
+type ListenerTLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   string // "none", "request", "verify" or "require"
+}
+
+type AuditConfig struct {
+	Sink string // "redis", "file" or "sql"
+	// File is appended to by the file sink
+	File string
+	// FileSyncInterval is how often the file sink syncs to disk, 0 syncs
+	// every event before the request carries on
+	FileSyncInterval time.Duration
+	// MaxLen is roughly how many events the redis sink keeps
+	MaxLen int64
+	// RejectedTokens limits how many rejected tokens are recorded, so a
+	// client sending bad tokens cannot flood the log
+	RejectedTokens RateLimitConfig
+	SQL            AuditSQLConfig
+}
+
+type AuditSQLConfig struct {
+	Driver string // a database/sql driver, "pgx" for PostgreSQL is built in
+	DSN    string
+}
+
+// OIDCConfig enables single sign-on with an OpenID Connect provider. It is
+// off while Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is this server's /auth/oidc/callback as the browser reaches it
+	RedirectURL string
+	// DeviceClientID is the public client cmd/client logs in with through the
+	// device flow, if it is not ClientID. ID tokens issued to either are accepted.
+	DeviceClientID string
+	Scopes         []string
+	// UsernameClaim is the ID token claim new users are named after
+	UsernameClaim string
+	// LinkExistingUsers lets the first single sign-on take over an existing
+	// account of the same name that has no password, two-factor
+	// authentication or link to another subject
+	LinkExistingUsers bool
+	// MaxTokenAge is how old an ID token passed to LoginOIDC may be. Each
+	// one logs in only once.
+	MaxTokenAge time.Duration
+}
+
+// NotifierConfig chooses how users are sent password reset tokens. There is
+// no mail backend yet: "log" writes them to the server log and "file" appends
+// them to File, for an operator or a mail relay to pick up.
+type NotifierConfig struct {
+	Backend string // "log" or "file"
+	File    string
+}
+
 var AppConfig *Config
 
-func LoadConfig() error {
+// loaded is the viper instance AppConfig was read with, kept for Reload
+var loaded *viper.Viper
+
+// LoadConfig reads the config file at path, or config.yaml, config.toml or
+// config.json from the working directory or /etc/chat when path is empty.
+// Every key can be overridden by an environment variable named after it,
+// for example REDIS_ADDR for redis.addr or TLS_GRPC_CERTFILE for
+// tls.grpc.certFile.
+func LoadConfig(path string) error {
 	v := viper.New()
 
+	// every key needs a default, viper only looks up environment variables for keys it knows
+	v.SetDefault("server.grpcAddr", ":50051")
+	v.SetDefault("server.httpAddr", ":8080")
+	v.SetDefault("server.shutdownTimeout", "30s")
+
+	v.SetDefault("redis.addr", "localhost:6379")
+	v.SetDefault("redis.password", "")
+	v.SetDefault("redis.db", 0)
+
+	v.SetDefault("auth.tokenTTL", "24h")
+	v.SetDefault("auth.jwtSecret", "dogdogdog") // set your own outside development
+	v.SetDefault("auth.admins", []string{})
+	v.SetDefault("auth.lockout.window", "15m")
+	v.SetDefault("auth.lockout.freeAttempts", 3)
+	v.SetDefault("auth.lockout.baseDelay", "1s")
+	v.SetDefault("auth.lockout.maxDelay", "30s")
+	v.SetDefault("auth.lockout.maxAttempts", 10)
+	v.SetDefault("auth.lockout.duration", "15m")
+	v.SetDefault("auth.lockout.ipFreeAttempts", 20)
+	v.SetDefault("auth.lockout.ipMaxAttempts", 100)
+	v.SetDefault("auth.username.minLength", 3)
+	v.SetDefault("auth.username.maxLength", 32)
+	v.SetDefault("auth.password.minLength", 8)
+	v.SetDefault("auth.password.maxLength", 72)
+	v.SetDefault("auth.password.requireUpper", true)
+	v.SetDefault("auth.password.requireLower", true)
+	v.SetDefault("auth.password.requireDigit", true)
+	v.SetDefault("auth.password.requireSymbol", false)
+	v.SetDefault("auth.password.rejectUsername", true)
+	v.SetDefault("auth.passwordReset.tokenTTL", "1h")
+	v.SetDefault("auth.passwordReset.cooldown", "1m")
+	v.SetDefault("auth.twoFactor.issuer", "chat")
+	v.SetDefault("auth.twoFactor.requireForAdmins", false)
+	v.SetDefault("auth.twoFactor.challengeTTL", "5m")
+	v.SetDefault("auth.twoFactor.recoveryCodes", 10)
+
+	v.SetDefault("history.maxMessages", 100)
+	v.SetDefault("history.replay", 15)
+
 	v.SetDefault("logger.outputPaths", []string{"stdout"})
 	v.SetDefault("logger.errorOutputPaths", []string{"stderr"})
 	v.SetDefault("logger.level", "info")
+	v.SetDefault("logger.redact.messages", true)
+	v.SetDefault("logger.redact.credentials", true)
 
 	v.SetDefault("ratelimit.rate", "1s")
 	v.SetDefault("ratelimit.burst", 100)
 
+	v.SetDefault("search.backend", "redis")
+
+	v.SetDefault("attachments.backend", "local")
+	v.SetDefault("attachments.dir", "data/attachments")
+	v.SetDefault("attachments.maxSize", 10<<20)
+	v.SetDefault("attachments.allowedTypes", []string{
+		"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain",
+	})
+	v.SetDefault("attachments.s3.endpoint", "")
+	v.SetDefault("attachments.s3.region", "us-east-1")
+	v.SetDefault("attachments.s3.bucket", "chat-attachments")
+	v.SetDefault("attachments.s3.accessKey", "")
+	v.SetDefault("attachments.s3.secretKey", "")
+	v.SetDefault("attachments.s3.useSSL", true)
+
+	v.SetDefault("webhooks.maxAttempts", 5)
+	v.SetDefault("webhooks.initialBackoff", "1s")
+	v.SetDefault("webhooks.timeout", "10s")
+	v.SetDefault("webhooks.maxConcurrent", 16)
+	v.SetDefault("webhooks.queueSize", 1000)
+	v.SetDefault("webhooks.allowPrivateNetworks", false)
+
+	v.SetDefault("irc.addr", "")
+	v.SetDefault("irc.serverName", "chat")
+
+	for _, listener := range []string{"grpc", "http"} {
+		v.SetDefault("tls."+listener+".certFile", "")
+		v.SetDefault("tls."+listener+".keyFile", "")
+		v.SetDefault("tls."+listener+".clientCAFile", "")
+		v.SetDefault("tls."+listener+".clientAuth", "")
+	}
+	v.SetDefault("tls.reloadInterval", "1m")
+
+	v.SetDefault("moderation.bannedWords", []string{})
+
+	v.SetDefault("tracing.exporter", "none")
+	v.SetDefault("tracing.endpoint", "localhost:4317")
+	v.SetDefault("tracing.insecure", false)
+	v.SetDefault("tracing.sampleRatio", 1.0)
+	v.SetDefault("tracing.serviceName", "chat")
+
+	v.SetDefault("audit.sink", "redis")
+	v.SetDefault("audit.file", "data/audit.log")
+	v.SetDefault("audit.fileSyncInterval", "0s")
+	v.SetDefault("audit.maxLen", 1000000)
+	v.SetDefault("audit.rejectedTokens.rate", "1s")
+	v.SetDefault("audit.rejectedTokens.burst", 60)
+	v.SetDefault("audit.sql.driver", "pgx")
+	v.SetDefault("audit.sql.dsn", "")
+
+	v.SetDefault("notifier.backend", "log")
+	v.SetDefault("notifier.file", "data/notifier.log")
+
+	v.SetDefault("oidc.issuer", "")
+	v.SetDefault("oidc.clientId", "")
+	v.SetDefault("oidc.clientSecret", "")
+	v.SetDefault("oidc.redirectUrl", "http://localhost:8080/auth/oidc/callback")
+	v.SetDefault("oidc.deviceClientId", "")
+	v.SetDefault("oidc.scopes", []string{"openid", "profile", "email"})
+	v.SetDefault("oidc.usernameClaim", "preferred_username")
+	v.SetDefault("oidc.linkExistingUsers", false)
+	v.SetDefault("oidc.maxTokenAge", 5*time.Minute)
+
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
 
-	AppConfig = &Config{}
-	if err := v.Unmarshal(AppConfig); err != nil {
-		return err
+	if path != "" {
+		// the format follows the extension: .yaml, .yml, .toml or .json
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("config")
+		v.AddConfigPath(".")
+		v.AddConfigPath("/etc/chat")
 	}
 
-	// Parse the rate string to time.Duration
-	rate, err := time.ParseDuration(v.GetString("ratelimit.rate"))
+	cfg, err := read(v)
 	if err != nil {
 		return err
 	}
-	AppConfig.RateLimit.Rate = rate
 
+	loaded = v
+	AppConfig = cfg
 	return nil
 }
+
+// Reload reads the config file again and returns the validated result. It
+// does not replace AppConfig: the caller applies the settings that can change
+// while the server is running, the rest only take effect after a restart.
+func Reload() (*Config, error) {
+	return read(loaded)
+}
+
+func read(v *viper.Viper) (*Config, error) {
+	if err := v.ReadInConfig(); err != nil {
+		// without -config the file is optional
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("reading config file %s: %w", v.ConfigFileUsed(), err)
+		}
+	}
+
+	cfg := &Config{}
+	// UnmarshalExact rejects misspelled keys in the config file instead of ignoring them
+	if err := v.UnmarshalExact(cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
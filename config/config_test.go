@@ -0,0 +1,206 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// load writes content to a config file and loads it
+func load(t *testing.T, name, content string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfig(path); err != nil {
+		return nil, err
+	}
+	return AppConfig, nil
+}
+
+func defaults(t *testing.T) *Config {
+	t.Helper()
+	cfg, err := load(t, "config.yaml", "")
+	if err != nil {
+		t.Fatalf("the defaults do not load: %v", err)
+	}
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	base := defaults(t)
+
+	tests := []struct {
+		// the one error expected, "key: start of the message"
+		want   string
+		change func(c *Config)
+	}{
+		{"server.grpcAddr: \"localhost\" is not", func(c *Config) { c.Server.GRPCAddr = "localhost" }},
+		{"server.httpAddr: \"nope\" is not", func(c *Config) { c.Server.HTTPAddr = "nope" }},
+		{"server.httpAddr: must differ", func(c *Config) { c.Server.HTTPAddr = c.Server.GRPCAddr }},
+		{"irc.addr: \"6667\" is not", func(c *Config) { c.IRC.Addr = "6667" }},
+		{"server.shutdownTimeout: must be positive", func(c *Config) { c.Server.ShutdownTimeout = 0 }},
+		{"redis.addr: \"\" is not", func(c *Config) { c.Redis.Addr = "" }},
+		{"redis.db: must not be negative", func(c *Config) { c.Redis.DB = -1 }},
+		{"auth.tokenTTL: must be positive", func(c *Config) { c.Auth.TokenTTL = 0 }},
+		{"auth.jwtSecret: must not be empty", func(c *Config) { c.Auth.JWTSecret = "" }},
+		{"auth.lockout.window: must be positive", func(c *Config) { c.Auth.Lockout.Window = 0 }},
+		{"auth.lockout.freeAttempts: must not be negative", func(c *Config) { c.Auth.Lockout.FreeAttempts = -1 }},
+		{"auth.lockout.baseDelay: must be positive", func(c *Config) { c.Auth.Lockout.BaseDelay = 0 }},
+		{"auth.lockout.maxDelay: must be at least", func(c *Config) { c.Auth.Lockout.MaxDelay = c.Auth.Lockout.BaseDelay / 2 }},
+		{"auth.lockout.maxAttempts: must be more than", func(c *Config) { c.Auth.Lockout.MaxAttempts = c.Auth.Lockout.FreeAttempts }},
+		{"auth.lockout.duration: must be positive", func(c *Config) { c.Auth.Lockout.Duration = 0 }},
+		{"auth.lockout.ipFreeAttempts: must not be negative", func(c *Config) { c.Auth.Lockout.IPFreeAttempts = -1 }},
+		{"auth.lockout.ipMaxAttempts: must be more than", func(c *Config) { c.Auth.Lockout.IPMaxAttempts = c.Auth.Lockout.IPFreeAttempts }},
+		{"auth.username.minLength: must be positive", func(c *Config) { c.Auth.Username.MinLength = 0 }},
+		{"auth.username.maxLength: must be at least", func(c *Config) { c.Auth.Username.MaxLength = c.Auth.Username.MinLength - 1 }},
+		{"auth.password.minLength: must be positive", func(c *Config) { c.Auth.Password.MinLength = 0 }},
+		{"auth.password.maxLength: must be between", func(c *Config) { c.Auth.Password.MaxLength = 73 }},
+		{"auth.password.maxLength: must be between", func(c *Config) { c.Auth.Password.MaxLength = c.Auth.Password.MinLength - 1 }},
+		{"auth.passwordReset.tokenTTL: must be positive", func(c *Config) { c.Auth.PasswordReset.TokenTTL = 0 }},
+		{"auth.passwordReset.cooldown: must not be negative", func(c *Config) { c.Auth.PasswordReset.Cooldown = -time.Second }},
+		{"auth.twoFactor.issuer: must not be empty", func(c *Config) { c.Auth.TwoFactor.Issuer = "" }},
+		{"auth.twoFactor.challengeTTL: must be positive", func(c *Config) { c.Auth.TwoFactor.ChallengeTTL = 0 }},
+		{"auth.twoFactor.recoveryCodes: must be positive", func(c *Config) { c.Auth.TwoFactor.RecoveryCodes = 0 }},
+		{"history.maxMessages: must be positive", func(c *Config) { c.History.MaxMessages, c.History.Replay = 0, 0 }},
+		{"history.replay: must be between 0 and history.maxMessages", func(c *Config) { c.History.Replay = -1 }},
+		{"history.replay: must be between 0 and history.maxMessages", func(c *Config) { c.History.Replay = c.History.MaxMessages + 1 }},
+		{"logger.level: \"loud\" is not", func(c *Config) { c.Logger.Level = "loud" }},
+		{"logger.outputPaths: must not be empty", func(c *Config) { c.Logger.OutputPaths = nil }},
+		{"ratelimit.rate: must be positive", func(c *Config) { c.RateLimit.Rate = 0 }},
+		{"ratelimit.burst: must be positive", func(c *Config) { c.RateLimit.Burst = 0 }},
+		{"search.backend: \"elastic\" must be one of", func(c *Config) { c.Search.Backend = "elastic" }},
+		{"attachments.backend: \"ftp\" must be one of", func(c *Config) { c.Attachments.Backend = "ftp" }},
+		{"attachments.maxSize: must be positive", func(c *Config) { c.Attachments.MaxSize = 0 }},
+		{"attachments.dir: must be set", func(c *Config) { c.Attachments.Dir = "" }},
+		{"attachments.s3.endpoint: must be set", func(c *Config) { c.Attachments.Backend = "s3" }},
+		{"attachments.s3.bucket: must be set", func(c *Config) {
+			c.Attachments.Backend, c.Attachments.S3.Endpoint, c.Attachments.S3.Bucket = "s3", "s3.example.com", ""
+		}},
+		{"webhooks.maxAttempts: must be positive", func(c *Config) { c.Webhooks.MaxAttempts = 0 }},
+		{"webhooks.initialBackoff: must be positive", func(c *Config) { c.Webhooks.InitialBackoff = 0 }},
+		{"webhooks.timeout: must be positive", func(c *Config) { c.Webhooks.Timeout = 0 }},
+		{"webhooks.maxConcurrent: must be positive", func(c *Config) { c.Webhooks.MaxConcurrent = 0 }},
+		{"webhooks.queueSize: must be positive", func(c *Config) { c.Webhooks.QueueSize = 0 }},
+		{"tls.grpc: certFile and keyFile must be set together", func(c *Config) { c.TLS.GRPC.CertFile = "cert.pem" }},
+		{"tls.http: certFile and keyFile must be set together", func(c *Config) { c.TLS.HTTP.KeyFile = "key.pem" }},
+		{"tls.grpc.clientCAFile: needs certFile and keyFile", func(c *Config) { c.TLS.GRPC.ClientCAFile = "ca.pem" }},
+		{"tls.http.clientAuth: \"maybe\" must be one of", func(c *Config) { c.TLS.HTTP.ClientAuth = "maybe" }},
+		{"tls.reloadInterval: must be positive", func(c *Config) { c.TLS.ReloadInterval = 0 }},
+		{"tracing.exporter: \"zipkin\" must be one of", func(c *Config) { c.Tracing.Exporter = "zipkin" }},
+		{"tracing.endpoint: \"collector\" is not", func(c *Config) { c.Tracing.Exporter, c.Tracing.Endpoint = "otlp", "collector" }},
+		{"tracing.sampleRatio: must be between 0 and 1", func(c *Config) { c.Tracing.SampleRatio = 1.5 }},
+		{"tracing.serviceName: must not be empty", func(c *Config) { c.Tracing.ServiceName = "" }},
+		{"audit.sink: \"kafka\" must be one of", func(c *Config) { c.Audit.Sink = "kafka" }},
+		{"audit.rejectedTokens.rate: must be positive", func(c *Config) { c.Audit.RejectedTokens.Rate = 0 }},
+		{"audit.rejectedTokens.burst: must be positive", func(c *Config) { c.Audit.RejectedTokens.Burst = 0 }},
+		{"audit.maxLen: must be positive", func(c *Config) { c.Audit.MaxLen = 0 }},
+		{"audit.file: must be set", func(c *Config) { c.Audit.Sink, c.Audit.File = "file", "" }},
+		{"audit.fileSyncInterval: must not be negative", func(c *Config) { c.Audit.Sink, c.Audit.FileSyncInterval = "file", -time.Second }},
+		{"audit.sql.driver: must be set", func(c *Config) { c.Audit.Sink, c.Audit.SQL.Driver, c.Audit.SQL.DSN = "sql", "", "postgres://audit" }},
+		{"audit.sql.dsn: must be set", func(c *Config) { c.Audit.Sink = "sql" }},
+		{"notifier.backend: \"smtp\" must be one of", func(c *Config) { c.Notifier.Backend = "smtp" }},
+		{"notifier.file: must be set", func(c *Config) { c.Notifier.Backend, c.Notifier.File = "file", "" }},
+		{"oidc.clientId: must be set", func(c *Config) { c.OIDC.Issuer = "https://idp.example.com" }},
+		{"oidc.redirectUrl: must be set", func(c *Config) {
+			c.OIDC.Issuer, c.OIDC.ClientID, c.OIDC.RedirectURL = "https://idp.example.com", "chat", ""
+		}},
+		{"oidc.usernameClaim: must not be empty", func(c *Config) {
+			c.OIDC.Issuer, c.OIDC.ClientID, c.OIDC.UsernameClaim = "https://idp.example.com", "chat", ""
+		}},
+		{"oidc.scopes: must include openid", func(c *Config) {
+			c.OIDC.Issuer, c.OIDC.ClientID, c.OIDC.Scopes = "https://idp.example.com", "chat", []string{"profile"}
+		}},
+		{"oidc.maxTokenAge: must be positive", func(c *Config) {
+			c.OIDC.Issuer, c.OIDC.ClientID, c.OIDC.MaxTokenAge = "https://idp.example.com", "chat", 0
+		}},
+	}
+	for _, tt := range tests {
+		c := *base
+		tt.change(&c)
+		err := c.validate()
+		if err == nil {
+			t.Errorf("%s: no error", tt.want)
+			continue
+		}
+		// the first line says the config is invalid, then one line per error
+		lines := strings.Split(err.Error(), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], tt.want) {
+			t.Errorf("got %q, want only %q", err, tt.want)
+		}
+	}
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	c := *defaults(t)
+	c.Server.GRPCAddr = "nope"
+	c.Redis.DB = -1
+	c.History.Replay = -1
+	c.Logger.Level = "loud"
+
+	err := c.validate()
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, key := range []string{"server.grpcAddr", "redis.db", "history.replay", "logger.level"} {
+		if !strings.Contains(err.Error(), "\n"+key+": ") {
+			t.Errorf("%s is missing from %q", key, err)
+		}
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("HISTORY_REPLAY", "5")
+	t.Setenv("AUTH_LOCKOUT_WINDOW", "2m")
+	t.Setenv("ATTACHMENTS_S3_BUCKET", "files")
+
+	cfg, err := load(t, "config.yaml", `
+history:
+  maxMessages: 50
+  replay: 10
+auth:
+  lockout:
+    window: 10m
+    duration: 30m
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// environment variables win over the file, and the file over the defaults
+	if cfg.History.Replay != 5 || cfg.Auth.Lockout.Window != 2*time.Minute || cfg.Attachments.S3.Bucket != "files" {
+		t.Errorf("environment not applied: replay %d, lockout window %s, bucket %q",
+			cfg.History.Replay, cfg.Auth.Lockout.Window, cfg.Attachments.S3.Bucket)
+	}
+	if cfg.History.MaxMessages != 50 || cfg.Auth.Lockout.Duration != 30*time.Minute {
+		t.Errorf("file not applied: max messages %d, lockout duration %s", cfg.History.MaxMessages, cfg.Auth.Lockout.Duration)
+	}
+	if cfg.Redis.Addr != "localhost:6379" {
+		t.Errorf("default not applied: redis addr %q", cfg.Redis.Addr)
+	}
+
+	// the environment is validated like the file
+	t.Setenv("HISTORY_REPLAY", "500")
+	if _, err := load(t, "config.yaml", ""); err == nil || !strings.Contains(err.Error(), "history.replay") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLoadConfigUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"config.yaml", "histroy:\n  maxMessages: 50\n"},
+		{"config.yaml", "redis:\n  adress: localhost:6379\n"},
+		{"config.toml", "[auth.lockout]\nwindows = \"5m\"\n"},
+		{"config.json", `{"tls": {"grpc": {"certfile": "a.pem", "keyfile": "a.key", "clientCA": "ca.pem"}}}`},
+	}
+	for _, tt := range tests {
+		_, err := load(t, tt.name, tt.content)
+		if err == nil || !strings.Contains(err.Error(), "invalid keys") {
+			t.Errorf("%s %q: got %v", tt.name, tt.content, err)
+		}
+	}
+}
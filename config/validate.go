@@ -0,0 +1,145 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// validate reports every invalid setting at once, each prefixed with its key
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+	checkAddr := func(key, addr string, optional bool) {
+		if addr == "" && optional {
+			return
+		}
+		_, _, err := net.SplitHostPort(addr)
+		check(err == nil, key, "%q is not a host:port address", addr)
+	}
+	oneOf := func(key, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		check(false, key, "%q must be one of %q", value, allowed)
+	}
+
+	checkAddr("server.grpcAddr", c.Server.GRPCAddr, false)
+	checkAddr("server.httpAddr", c.Server.HTTPAddr, false)
+	checkAddr("irc.addr", c.IRC.Addr, true)
+	check(c.Server.GRPCAddr != c.Server.HTTPAddr, "server.httpAddr", "must differ from server.grpcAddr")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdownTimeout", "must be positive")
+
+	checkAddr("redis.addr", c.Redis.Addr, false)
+	check(c.Redis.DB >= 0, "redis.db", "must not be negative")
+
+	check(c.Auth.TokenTTL > 0, "auth.tokenTTL", "must be positive")
+	check(c.Auth.JWTSecret != "", "auth.jwtSecret", "must not be empty")
+	lockout := c.Auth.Lockout
+	check(lockout.Window > 0, "auth.lockout.window", "must be positive")
+	check(lockout.FreeAttempts >= 0, "auth.lockout.freeAttempts", "must not be negative")
+	check(lockout.BaseDelay > 0, "auth.lockout.baseDelay", "must be positive")
+	check(lockout.MaxDelay >= lockout.BaseDelay, "auth.lockout.maxDelay", "must be at least auth.lockout.baseDelay")
+	check(lockout.MaxAttempts > lockout.FreeAttempts, "auth.lockout.maxAttempts", "must be more than auth.lockout.freeAttempts")
+	check(lockout.Duration > 0, "auth.lockout.duration", "must be positive")
+	check(lockout.IPFreeAttempts >= 0, "auth.lockout.ipFreeAttempts", "must not be negative")
+	check(lockout.IPMaxAttempts > lockout.IPFreeAttempts, "auth.lockout.ipMaxAttempts", "must be more than auth.lockout.ipFreeAttempts")
+	check(c.Auth.Username.MinLength > 0, "auth.username.minLength", "must be positive")
+	check(c.Auth.Username.MaxLength >= c.Auth.Username.MinLength, "auth.username.maxLength", "must be at least auth.username.minLength")
+	check(c.Auth.Password.MinLength > 0, "auth.password.minLength", "must be positive")
+	check(c.Auth.Password.MaxLength >= c.Auth.Password.MinLength && c.Auth.Password.MaxLength <= 72, "auth.password.maxLength", "must be between auth.password.minLength and 72")
+	check(c.Auth.PasswordReset.TokenTTL > 0, "auth.passwordReset.tokenTTL", "must be positive")
+	check(c.Auth.PasswordReset.Cooldown >= 0, "auth.passwordReset.cooldown", "must not be negative")
+	check(c.Auth.TwoFactor.Issuer != "", "auth.twoFactor.issuer", "must not be empty")
+	check(c.Auth.TwoFactor.ChallengeTTL > 0, "auth.twoFactor.challengeTTL", "must be positive")
+	check(c.Auth.TwoFactor.RecoveryCodes > 0, "auth.twoFactor.recoveryCodes", "must be positive")
+
+	check(c.History.MaxMessages > 0, "history.maxMessages", "must be positive")
+	check(c.History.Replay >= 0 && c.History.Replay <= c.History.MaxMessages,
+		"history.replay", "must be between 0 and history.maxMessages (%d)", c.History.MaxMessages)
+
+	_, err := zapcore.ParseLevel(c.Logger.Level)
+	check(err == nil, "logger.level", "%q is not a log level", c.Logger.Level)
+	check(len(c.Logger.OutputPaths) > 0, "logger.outputPaths", "must not be empty")
+
+	check(c.RateLimit.Rate > 0, "ratelimit.rate", "must be positive")
+	check(c.RateLimit.Burst > 0, "ratelimit.burst", "must be positive")
+
+	oneOf("search.backend", c.Search.Backend, "redis", "memory")
+
+	oneOf("attachments.backend", c.Attachments.Backend, "local", "s3")
+	check(c.Attachments.MaxSize > 0, "attachments.maxSize", "must be positive")
+	if c.Attachments.Backend == "local" {
+		check(c.Attachments.Dir != "", "attachments.dir", "must be set for the local backend")
+	}
+	if c.Attachments.Backend == "s3" {
+		check(c.Attachments.S3.Endpoint != "", "attachments.s3.endpoint", "must be set for the s3 backend")
+		check(c.Attachments.S3.Bucket != "", "attachments.s3.bucket", "must be set for the s3 backend")
+	}
+
+	check(c.Webhooks.MaxAttempts > 0, "webhooks.maxAttempts", "must be positive")
+	check(c.Webhooks.InitialBackoff > 0, "webhooks.initialBackoff", "must be positive")
+	check(c.Webhooks.Timeout > 0, "webhooks.timeout", "must be positive")
+	check(c.Webhooks.MaxConcurrent > 0, "webhooks.maxConcurrent", "must be positive")
+	check(c.Webhooks.QueueSize > 0, "webhooks.queueSize", "must be positive")
+
+	for _, listener := range []struct {
+		name string
+		l    ListenerTLSConfig
+	}{{"tls.grpc", c.TLS.GRPC}, {"tls.http", c.TLS.HTTP}} {
+		name, l := listener.name, listener.l
+		check((l.CertFile == "") == (l.KeyFile == ""), name, "certFile and keyFile must be set together")
+		check(l.ClientCAFile == "" || l.CertFile != "", name+".clientCAFile", "needs certFile and keyFile")
+		if l.ClientAuth != "" {
+			oneOf(name+".clientAuth", l.ClientAuth, "none", "request", "verify", "require")
+		}
+	}
+	check(c.TLS.ReloadInterval > 0, "tls.reloadInterval", "must be positive")
+
+	oneOf("tracing.exporter", c.Tracing.Exporter, "none", "otlp", "stdout")
+	if c.Tracing.Exporter == "otlp" {
+		checkAddr("tracing.endpoint", c.Tracing.Endpoint, false)
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sampleRatio", "must be between 0 and 1")
+	check(c.Tracing.ServiceName != "", "tracing.serviceName", "must not be empty")
+
+	oneOf("audit.sink", c.Audit.Sink, "redis", "file", "sql")
+	check(c.Audit.RejectedTokens.Rate > 0, "audit.rejectedTokens.rate", "must be positive")
+	check(c.Audit.RejectedTokens.Burst > 0, "audit.rejectedTokens.burst", "must be positive")
+	oneOf("notifier.backend", c.Notifier.Backend, "log", "file")
+	if c.OIDC.Issuer != "" {
+		check(c.OIDC.ClientID != "", "oidc.clientId", "must be set when oidc.issuer is")
+		check(c.OIDC.RedirectURL != "", "oidc.redirectUrl", "must be set when oidc.issuer is")
+		check(c.OIDC.UsernameClaim != "", "oidc.usernameClaim", "must not be empty")
+		check(slices.Contains(c.OIDC.Scopes, "openid"), "oidc.scopes", "must include openid")
+		check(c.OIDC.MaxTokenAge > 0, "oidc.maxTokenAge", "must be positive")
+	}
+	if c.Notifier.Backend == "file" {
+		check(c.Notifier.File != "", "notifier.file", "must be set for the file backend")
+	}
+	if c.Audit.Sink == "redis" {
+		check(c.Audit.MaxLen > 0, "audit.maxLen", "must be positive")
+	}
+	if c.Audit.Sink == "file" {
+		check(c.Audit.File != "", "audit.file", "must be set for the file sink")
+		check(c.Audit.FileSyncInterval >= 0, "audit.fileSyncInterval", "must not be negative")
+	}
+	if c.Audit.Sink == "sql" {
+		check(c.Audit.SQL.Driver != "", "audit.sql.driver", "must be set for the sql sink")
+		check(c.Audit.SQL.DSN != "", "audit.sql.dsn", "must be set for the sql sink")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Package audit keeps an append-only record of security relevant events:
+// registrations, logins, rejected credentials, token and webhook changes,
+// room invitations and message deletions.
+package audit
+
+import (
+	"chat_app/internal/logger"
+	pb "chat_app/pb"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	ActionRegister       = "user.register"
+	ActionLogin          = "auth.login"
+	ActionSSOLogin       = "auth.sso_login"
+	ActionAuthenticate   = "auth.authenticate"
+	ActionCreateBot      = "bot.create"
+	ActionCreateAPIToken = "apitoken.create"
+	ActionRevokeAPIToken = "apitoken.revoke"
+	ActionInvite         = "room.invite"
+	ActionCreateWebhook  = "webhook.create"
+	ActionDeleteWebhook  = "webhook.delete"
+	ActionDeleteMessage  = "message.delete"
+	ActionQuery          = "audit.query"
+
+	ActionChangePassword       = "password.change"
+	ActionRequestPasswordReset = "password.reset_request"
+	ActionResetPassword        = "password.reset"
+	ActionEnrollTwoFactor      = "two_factor.enroll"
+	ActionEnableTwoFactor      = "two_factor.enable"
+	ActionDisableTwoFactor     = "two_factor.disable"
+)
+
+// Query filters events. Zero fields match everything.
+type Query struct {
+	Actor  string
+	Action string
+	Room   string
+	Since  int64
+	Until  int64
+	Limit  int
+}
+
+// Sink is implemented by the places events are stored. Sinks only append:
+// there is no way to change or remove an event once it is written.
+type Sink interface {
+	Append(event *pb.AuditEvent) error
+	// Query returns matching events, newest first
+	Query(q Query) ([]*pb.AuditEvent, error)
+	Close() error
+}
+
+const defaultLimit = 100
+
+type Options struct {
+	Sink string // "redis", "file" or "sql"
+	File string
+	// FileSyncInterval is how often the file sink syncs to disk. At 0 every
+	// event is synced before Append returns.
+	FileSyncInterval time.Duration
+	// RedisMaxLen is roughly how many events the redis sink keeps
+	RedisMaxLen int64
+	SQLDriver   string
+	SQLDSN      string
+}
+
+// NewSink returns the sink for the configured backend
+func NewSink(opts Options, client *redis.Client) (Sink, error) {
+	switch opts.Sink {
+	case "redis":
+		return NewRedisSink(client, opts.RedisMaxLen), nil
+	case "file":
+		return NewFileSink(opts.File, opts.FileSyncInterval)
+	case "sql":
+		return NewSQLSink(opts.SQLDriver, opts.SQLDSN)
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", opts.Sink)
+	}
+}
+
+// Log records events to a sink
+type Log struct {
+	sink Sink
+
+	mu     sync.Mutex
+	limits map[string]*actionLimit
+}
+
+type actionLimit struct {
+	limiter *rate.Limiter
+	dropped int
+}
+
+func NewLog(sink Sink) *Log {
+	return &Log{sink: sink, limits: make(map[string]*actionLimit)}
+}
+
+// Limit caps how many events of an action are recorded, for actions anyone
+// can cause at will such as presenting a bad token. Events over the limit are
+// dropped, and the next one recorded says how many were.
+func (l *Log) Limit(action string, r rate.Limit, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits[action] = &actionLimit{limiter: rate.NewLimiter(r, burst)}
+}
+
+// allow applies the action's limit to the event
+func (l *Log) allow(event *pb.AuditEvent) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.limits[event.Action]
+	if limit == nil {
+		return true
+	}
+	if !limit.limiter.Allow() {
+		limit.dropped++
+		return false
+	}
+	if limit.dropped > 0 {
+		event.Reason = fmt.Sprintf("%s (%d more not recorded)", event.Reason, limit.dropped)
+		limit.dropped = 0
+	}
+	return true
+}
+
+// Record fills in the event's id, time, request ID and the caller's address,
+// and appends it. A request is never failed because its event could not be
+// recorded; the error is logged instead.
+func (l *Log) Record(ctx context.Context, event *pb.AuditEvent) {
+	if !l.allow(event) {
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	event.Id = hex.EncodeToString(id)
+	event.Timestamp = time.Now().Unix()
+	event.RequestId = logger.RequestIDFromContext(ctx)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		event.RemoteAddr = p.Addr.String()
+	}
+
+	if err := l.sink.Append(event); err != nil {
+		logger.FromContext(ctx).Error("Failed to record audit event", zap.Error(err), zap.String("action", event.Action), zap.String("actor", event.Actor))
+	}
+}
+
+func (l *Log) Query(q Query) ([]*pb.AuditEvent, error) {
+	return l.sink.Query(q)
+}
+
+func (l *Log) Close() error {
+	return l.sink.Close()
+}
+
+func (q Query) matches(event *pb.AuditEvent) bool {
+	if q.Actor != "" && event.Actor != q.Actor {
+		return false
+	}
+	if q.Action != "" && event.Action != q.Action {
+		return false
+	}
+	if q.Room != "" && event.Room != q.Room {
+		return false
+	}
+	if q.Since != 0 && event.Timestamp < q.Since {
+		return false
+	}
+	if q.Until != 0 && event.Timestamp > q.Until {
+		return false
+	}
+	return true
+}
+
+func (q Query) limit() int {
+	if q.Limit <= 0 || q.Limit > defaultLimit {
+		return defaultLimit
+	}
+	return q.Limit
+}
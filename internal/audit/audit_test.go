@@ -0,0 +1,124 @@
+package audit
+
+import (
+	pb "chat_app/pb"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/time/rate"
+)
+
+// memorySink keeps events in a slice
+type memorySink struct {
+	mu     sync.Mutex
+	events []*pb.AuditEvent
+}
+
+func (s *memorySink) Append(event *pb.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memorySink) Query(q Query) ([]*pb.AuditEvent, error) { return nil, nil }
+func (s *memorySink) Close() error                            { return nil }
+
+func TestLimitDropsAndCountsEvents(t *testing.T) {
+	sink := &memorySink{}
+	l := NewLog(sink)
+	l.Limit(ActionAuthenticate, rate.Every(time.Hour), 2)
+
+	for i := 0; i < 5; i++ {
+		l.Record(context.Background(), &pb.AuditEvent{Action: ActionAuthenticate, Reason: "Invalid token"})
+	}
+	l.Record(context.Background(), &pb.AuditEvent{Action: ActionLogin, Reason: "wrong password"})
+	if len(sink.events) != 3 {
+		t.Fatalf("got %d events, want 2 rejected tokens and the login", len(sink.events))
+	}
+
+	// once the limit allows it again, the next event says what was dropped
+	l.limits[ActionAuthenticate].limiter.SetLimit(rate.Inf)
+	l.Record(context.Background(), &pb.AuditEvent{Action: ActionAuthenticate, Reason: "Invalid token"})
+	l.Record(context.Background(), &pb.AuditEvent{Action: ActionAuthenticate, Reason: "Invalid token"})
+	if got := sink.events[3].Reason; got != "Invalid token (3 more not recorded)" {
+		t.Errorf("got reason %q", got)
+	}
+	if got := sink.events[4].Reason; got != "Invalid token" {
+		t.Errorf("the dropped count was repeated: %q", got)
+	}
+}
+
+func TestRedisSinkTrimsStream(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	sink := NewRedisSink(client, 10)
+
+	for i := 0; i < 50; i++ {
+		if err := sink.Append(&pb.AuditEvent{Id: fmt.Sprint(i), Action: ActionLogin}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := client.XLen(context.Background(), streamKey).Result(); err != nil || n > 10 {
+		t.Errorf("stream has %d events, %v", n, err)
+	}
+	events, err := sink.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || events[0].Id != "49" {
+		t.Errorf("the newest events were not kept: %v", events)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	for _, syncInterval := range []time.Duration{0, 10 * time.Millisecond} {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		sink, err := NewFileSink(path, syncInterval)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := sink.Append(&pb.AuditEvent{Id: fmt.Sprint(i), Action: ActionLogin, Timestamp: int64(i)}); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if err := sink.Append(&pb.AuditEvent{Id: "last", Action: ActionQuery, Actor: "alice", Timestamp: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// read back through a new sink, as after a restart
+		sink, err = NewFileSink(path, syncInterval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err := sink.Query(Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 21 || events[0].Id != "last" {
+			t.Errorf("sync interval %s: got %d events, newest %v", syncInterval, len(events), events[0])
+		}
+		if events, _ := sink.Query(Query{Actor: "alice"}); len(events) != 1 || !strings.HasPrefix(events[0].Action, "audit.") {
+			t.Errorf("sync interval %s: query by actor got %v", syncInterval, events)
+		}
+		sink.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package audit
+
+import (
+	pb "chat_app/pb"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// streamKey is the Redis stream of audit events
+const streamKey = "audit_log"
+
+// events read from the stream per round trip while querying
+const queryBatch = 500
+
+// RedisSink appends events to a Redis stream, so every server instance
+// shares one log. The stream is trimmed to about maxLen events, oldest first.
+type RedisSink struct {
+	client *redis.Client
+	maxLen int64
+}
+
+func NewRedisSink(client *redis.Client, maxLen int64) *RedisSink {
+	return &RedisSink{client: client, maxLen: maxLen}
+}
+
+func (s *RedisSink) Append(event *pb.AuditEvent) error {
+	jsonEvent, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: streamKey,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{"event": jsonEvent},
+	}).Err()
+}
+
+// Query walks the stream backwards from Until, using the millisecond time in
+// stream entry ids to skip what is out of range
+func (s *RedisSink) Query(q Query) ([]*pb.AuditEvent, error) {
+	ctx := context.Background()
+
+	end, start := "+", "-"
+	if q.Until != 0 {
+		end = strconv.FormatInt((q.Until+1)*1000-1, 10)
+	}
+	if q.Since != 0 {
+		start = strconv.FormatInt(q.Since*1000, 10)
+	}
+
+	var events []*pb.AuditEvent
+	for len(events) < q.limit() {
+		entries, err := s.client.XRevRangeN(ctx, streamKey, end, start, queryBatch).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			data, _ := entry.Values["event"].(string)
+			var event pb.AuditEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return nil, err
+			}
+			if q.matches(&event) {
+				events = append(events, &event)
+			}
+		}
+
+		if len(entries) < queryBatch {
+			break
+		}
+		end = previousID(entries[len(entries)-1].ID)
+	}
+
+	if len(events) > q.limit() {
+		events = events[:q.limit()]
+	}
+	return events, nil
+}
+
+func (s *RedisSink) Close() error {
+	return nil
+}
+
+// previousID returns the stream id right before id, to continue a reverse range
+func previousID(id string) string {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(msPart, 10, 64)
+	seq, _ := strconv.ParseUint(seqPart, 10, 64)
+	if seq > 0 {
+		return msPart + "-" + strconv.FormatUint(seq-1, 10)
+	}
+	return strconv.FormatUint(ms-1, 10) + "-18446744073709551615"
+}
@@ -0,0 +1,105 @@
+package audit
+
+import (
+	pb "chat_app/pb"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	// registers the "pgx" driver for PostgreSQL
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+const createTable = `CREATE TABLE IF NOT EXISTS audit_log (
+	id TEXT PRIMARY KEY,
+	timestamp BIGINT NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	target TEXT NOT NULL,
+	room TEXT NOT NULL,
+	success BOOLEAN NOT NULL,
+	reason TEXT NOT NULL,
+	request_id TEXT NOT NULL,
+	remote_addr TEXT NOT NULL
+)`
+
+// SQLSink inserts events into the audit_log table, which is created if it
+// does not exist. The server only ever inserts and selects, so the database
+// user can be granted just that.
+type SQLSink struct {
+	db *sql.DB
+}
+
+func NewSQLSink(driver, dsn string) (*SQLSink, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(createTable); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLSink{db: db}, nil
+}
+
+func (s *SQLSink) Append(event *pb.AuditEvent) error {
+	_, err := s.db.Exec(`INSERT INTO audit_log
+		(id, timestamp, action, actor, target, room, success, reason, request_id, remote_addr)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		event.Id, event.Timestamp, event.Action, event.Actor, event.Target, event.Room,
+		event.Success, event.Reason, event.RequestId, event.RemoteAddr,
+	)
+	return err
+}
+
+func (s *SQLSink) Query(q Query) ([]*pb.AuditEvent, error) {
+	var where []string
+	var args []interface{}
+	filter := func(condition string, value interface{}) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(condition, len(args)))
+	}
+	if q.Actor != "" {
+		filter("actor = $%d", q.Actor)
+	}
+	if q.Action != "" {
+		filter("action = $%d", q.Action)
+	}
+	if q.Room != "" {
+		filter("room = $%d", q.Room)
+	}
+	if q.Since != 0 {
+		filter("timestamp >= $%d", q.Since)
+	}
+	if q.Until != 0 {
+		filter("timestamp <= $%d", q.Until)
+	}
+
+	query := `SELECT id, timestamp, action, actor, target, room, success, reason, request_id, remote_addr FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY timestamp DESC LIMIT %d", q.limit())
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*pb.AuditEvent
+	for rows.Next() {
+		var event pb.AuditEvent
+		err := rows.Scan(&event.Id, &event.Timestamp, &event.Action, &event.Actor, &event.Target, &event.Room,
+			&event.Success, &event.Reason, &event.RequestId, &event.RemoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLSink) Close() error {
+	return s.db.Close()
+}
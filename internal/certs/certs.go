@@ -0,0 +1,187 @@
+// Package certs serves TLS certificates that are reloaded from disk when they
+// change, so rotated certificates are picked up without a restart.
+package certs
+
+import (
+	"chat_app/internal/logger"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type Options struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables client certificate authentication when set
+	ClientCAFile string
+	// ClientAuth is "none", "request", "verify" or "require". It defaults to
+	// "require" when ClientCAFile is set.
+	ClientAuth string
+}
+
+// Reloader holds the current certificate and client CA pool of a listener
+type Reloader struct {
+	opts       Options
+	clientAuth tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+func NewReloader(opts Options) (*Reloader, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, fmt.Errorf("both a certificate and a key file are required")
+	}
+
+	clientAuth, err := parseClientAuth(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reloader{opts: opts, clientAuth: clientAuth}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func parseClientAuth(opts Options) (tls.ClientAuthType, error) {
+	mode := opts.ClientAuth
+	if mode == "" {
+		mode = "none"
+		if opts.ClientCAFile != "" {
+			mode = "require"
+		}
+	}
+
+	switch mode {
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "verify":
+		if opts.ClientCAFile == "" {
+			return 0, fmt.Errorf("client auth %q needs a client CA file", mode)
+		}
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		if opts.ClientCAFile == "" {
+			return 0, fmt.Errorf("client auth %q needs a client CA file", mode)
+		}
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return 0, fmt.Errorf("unknown client auth %q", mode)
+	}
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.opts.CertFile, r.opts.KeyFile}
+	if r.opts.ClientCAFile != "" {
+		files = append(files, r.opts.ClientCAFile)
+	}
+	return files
+}
+
+// load reads every file again. On error the previous certificate stays in use.
+func (r *Reloader) load() error {
+	modTimes := map[string]time.Time{}
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.opts.CertFile, r.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.opts.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	return nil
+}
+
+// changed reports whether any file was modified since it was last loaded
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// the file is probably being replaced, try again next time
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch checks the files every interval and reloads them when they change
+func (r *Reloader) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !r.changed() {
+			continue
+		}
+		if err := r.load(); err != nil {
+			logger.Log.Error("Failed to reload TLS certificate", zap.String("cert", r.opts.CertFile), zap.Error(err))
+			continue
+		}
+		logger.Log.Info("Reloaded TLS certificate", zap.String("cert", r.opts.CertFile))
+	}
+}
+
+// ServerConfig returns a TLS config that uses the current certificate for
+// every new connection. nextProtos are the ALPN protocols of the listener.
+func (r *Reloader) ServerConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   r.clientAuth,
+				ClientCAs:    r.clientCAs,
+			}, nil
+		},
+	}
+}
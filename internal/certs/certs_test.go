@@ -0,0 +1,246 @@
+package certs
+
+import (
+	"chat_app/internal/logger"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM encoded certificate and key of a server or client named name
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data to path and moves its modification time forward, so
+// the change is seen even within the file system's timestamp granularity
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName returns the common name of the certificate r serves
+func servedName(t *testing.T, r *Reloader) string {
+	t.Helper()
+	cert, err := r.ServerConfig().GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReloaderWatch(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	previousLog := logger.Log
+	logger.Log = zap.New(core)
+	t.Cleanup(func() { logger.Log = previousLog })
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Hour)
+	certPEM, keyPEM := ca.issue(t, "first", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM, modTime)
+	writeFile(t, keyFile, keyPEM, modTime)
+
+	r, err := NewReloader(Options{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.Watch(10 * time.Millisecond)
+
+	// waitFor waits until Watch has logged message more than seen times
+	waitFor := func(message string, seen int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); logs.FilterMessage(message).Len() <= seen; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("no %q", message)
+			}
+		}
+	}
+
+	certPEM, keyPEM = ca.issue(t, "rotated", x509.ExtKeyUsageServerAuth)
+	modTime = modTime.Add(time.Minute)
+	writeFile(t, keyFile, keyPEM, modTime)
+	writeFile(t, certFile, certPEM, modTime)
+	waitFor("Reloaded TLS certificate", 0)
+	if name := servedName(t, r); name != "rotated" {
+		t.Errorf("serving %q after the rotation", name)
+	}
+
+	// a certificate that does not match the key is not loaded
+	failures := logs.FilterMessage("Failed to reload TLS certificate").Len()
+	certPEM, _ = ca.issue(t, "mismatched", x509.ExtKeyUsageServerAuth)
+	modTime = modTime.Add(time.Minute)
+	writeFile(t, certFile, certPEM, modTime)
+	waitFor("Failed to reload TLS certificate", failures)
+	if name := servedName(t, r); name != "rotated" {
+		t.Errorf("serving %q after a bad rotation", name)
+	}
+	if _, err := NewReloader(Options{CertFile: certFile, KeyFile: keyFile}); err == nil {
+		t.Error("NewReloader accepted a certificate that does not match the key")
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	certPEM, keyPEM := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM, time.Now())
+	writeFile(t, keyFile, keyPEM, time.Now())
+	writeFile(t, caFile, ca.pem, time.Now())
+
+	clientCert := func(ca *testCA) []tls.Certificate {
+		cert, err := tls.X509KeyPair(ca.issue(t, "client", x509.ExtKeyUsageClientAuth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []tls.Certificate{cert}
+	}
+	trusted, untrusted := clientCert(ca), clientCert(otherCA)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// handshake connects with the client certificates and returns the server's error
+	handshake := func(r *Reloader, certs []tls.Certificate) error {
+		t.Helper()
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lis.Close()
+		go func() {
+			conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+			if err == nil {
+				// with TLS 1.3 the client finishes first, wait for the server's verdict
+				conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+		}()
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return tls.Server(conn, r.ServerConfig()).Handshake()
+	}
+
+	tests := []struct {
+		mode string
+		// whether a client without a certificate, with a trusted one and with
+		// one from another CA gets through
+		none, trusted, untrusted bool
+	}{
+		{"none", true, true, true},
+		{"request", true, true, true},
+		{"verify", true, true, false},
+		{"require", false, true, false},
+		// the default with a client CA file
+		{"", false, true, false},
+	}
+	for _, tt := range tests {
+		r, err := NewReloader(Options{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: tt.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			name  string
+			certs []tls.Certificate
+			ok    bool
+		}{{"no certificate", nil, tt.none}, {"trusted certificate", trusted, tt.trusted}, {"untrusted certificate", untrusted, tt.untrusted}} {
+			if err := handshake(r, c.certs); (err == nil) != c.ok {
+				t.Errorf("client auth %q with %s: got %v", tt.mode, c.name, err)
+			}
+		}
+	}
+
+	for _, mode := range []string{"verify", "require", "sometimes"} {
+		if _, err := NewReloader(Options{CertFile: certFile, KeyFile: keyFile, ClientAuth: mode}); err == nil {
+			t.Errorf("client auth %q without a client CA file was accepted", mode)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package chat
+
+import (
+	"bufio"
+	"chat_app/config"
+	"chat_app/internal/blob"
+	"chat_app/internal/logger"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const attachmentChunkSize = 32 * 1024
+
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+func (s *ChatServer) UploadAttachment(stream pb.ChatService_UploadAttachmentServer) error {
+	username, ok := UsernameFromContext(stream.Context())
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	info := first.GetInfo()
+	if info == nil {
+		return status.Errorf(codes.InvalidArgument, "First message must carry attachment info")
+	}
+
+	attachment, err := s.StoreAttachment(stream.Context(), username, info.Room, info.Filename, &uploadReader{stream: stream})
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(attachment)
+}
+
+func (s *ChatServer) DownloadAttachment(req *pb.DownloadAttachmentRequest, stream pb.ChatService_DownloadAttachmentServer) error {
+	username, ok := UsernameFromContext(stream.Context())
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	attachment, body, err := s.OpenAttachment(stream.Context(), username, req.Id)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	err = stream.Send(&pb.DownloadAttachmentResponse{
+		Data: &pb.DownloadAttachmentResponse_Info{Info: attachment},
+	})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, attachmentChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			sendErr := stream.Send(&pb.DownloadAttachmentResponse{
+				Data: &pb.DownloadAttachmentResponse_Chunk{Chunk: buf[:n]},
+			})
+			if sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			logger.FromContext(stream.Context()).Error("Failed to read attachment", zap.Error(err), zap.String("id", req.Id))
+			return status.Errorf(codes.Internal, "Failed to read attachment")
+		}
+	}
+}
+
+// StoreAttachment checks the size and type limits and saves an uploaded file
+// to the blob store. It is shared by the gRPC and HTTP upload paths.
+func (s *ChatServer) StoreAttachment(ctx context.Context, username, room, filename string, r io.Reader) (*pb.Attachment, error) {
+	if room == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Room must not be empty")
+	}
+	if err := checkTokenScope(ctx, ScopeMessagesWrite, room); err != nil {
+		return nil, err
+	}
+	if err := s.checkRoomAccess(ctx, username, room); err != nil {
+		return nil, err
+	}
+
+	filename = filepath.Base(filename)
+	if filename == "." || filename == string(filepath.Separator) {
+		return nil, status.Errorf(codes.InvalidArgument, "Filename must not be empty")
+	}
+
+	// trust the content rather than whatever type the client claims
+	br := bufio.NewReaderSize(r, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, status.Errorf(codes.InvalidArgument, "Failed to read attachment: %v", err)
+	}
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil || !containsString(config.AppConfig.Attachments.AllowedTypes, contentType) {
+		return nil, status.Errorf(codes.InvalidArgument, "Attachment type %s is not allowed", contentType)
+	}
+
+	id, err := newID()
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to generate attachment id", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to store attachment")
+	}
+
+	body := &sizeLimitedReader{r: br, remaining: config.AppConfig.Attachments.MaxSize}
+	if err := s.blobStore.Put(ctx, id, body, -1, contentType); err != nil {
+		if errors.Is(err, errAttachmentTooLarge) {
+			return nil, status.Errorf(codes.InvalidArgument, "Attachment exceeds the maximum size of %d bytes", config.AppConfig.Attachments.MaxSize)
+		}
+		logger.FromContext(ctx).Error("Failed to store attachment", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to store attachment")
+	}
+
+	attachment := &pb.Attachment{
+		Id:          id,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        body.read,
+		Uploader:    username,
+		Room:        room,
+		CreatedAt:   time.Now().Unix(),
+	}
+	if err := storage.SaveAttachment(s.redisFor(ctx), attachment); err != nil {
+		logger.FromContext(ctx).Error("Failed to save attachment metadata", zap.Error(err))
+		if err := s.blobStore.Delete(ctx, id); err != nil {
+			logger.FromContext(ctx).Error("Failed to clean up attachment", zap.Error(err))
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to store attachment")
+	}
+
+	logger.FromContext(ctx).Info("Attachment uploaded",
+		zap.String("id", id),
+		zap.String("user", username),
+		zap.String("room", room),
+		zap.Int64("size", attachment.Size))
+	return attachment, nil
+}
+
+// OpenAttachment returns the attachment metadata and contents if the user can read its room
+func (s *ChatServer) OpenAttachment(ctx context.Context, username, id string) (*pb.Attachment, io.ReadCloser, error) {
+	attachment, err := s.getAttachment(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkTokenScope(ctx, ScopeMessagesRead, attachment.Room); err != nil {
+		return nil, nil, err
+	}
+	if err := s.checkRoomAccess(ctx, username, attachment.Room); err != nil {
+		return nil, nil, err
+	}
+
+	body, err := s.blobStore.Get(ctx, id)
+	if err == blob.ErrNotFound {
+		return nil, nil, status.Errorf(codes.NotFound, "Attachment not found")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to open attachment", zap.Error(err), zap.String("id", id))
+		return nil, nil, status.Errorf(codes.Internal, "Failed to open attachment")
+	}
+
+	return attachment, body, nil
+}
+
+// resolveAttachments replaces the client supplied attachment references with
+// the stored metadata, rejecting files from other rooms or other users
+func (s *ChatServer) resolveAttachments(ctx context.Context, username string, msg *pb.ChatMessage) error {
+	for i, ref := range msg.Attachments {
+		attachment, err := s.getAttachment(ctx, ref.Id)
+		if err != nil {
+			return err
+		}
+		if attachment.Room != msg.Room || attachment.Uploader != username {
+			return status.Errorf(codes.PermissionDenied, "Attachment %s cannot be used here", ref.Id)
+		}
+		msg.Attachments[i] = attachment
+	}
+	return nil
+}
+
+func (s *ChatServer) getAttachment(ctx context.Context, id string) (*pb.Attachment, error) {
+	if id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Attachment id must not be empty")
+	}
+
+	attachment, err := storage.GetAttachment(s.redisFor(ctx), id)
+	if err == redis.Nil {
+		return nil, status.Errorf(codes.NotFound, "Attachment not found")
+	} else if err != nil {
+		logger.Log.Error("Failed to get attachment", zap.Error(err), zap.String("id", id))
+		return nil, status.Errorf(codes.Internal, "Failed to get attachment")
+	}
+
+	return attachment, nil
+}
+
+func (s *ChatServer) checkRoomAccess(ctx context.Context, username, room string) error {
+	rooms, err := storage.GetUserRooms(s.redisFor(ctx), username)
+	if err != nil {
+		logger.Log.Error("Failed to list rooms", zap.Error(err))
+		return status.Errorf(codes.Internal, "Failed to check room access")
+	}
+	if !containsString(rooms, room) {
+		return status.Errorf(codes.PermissionDenied, "Not a member of room %s", room)
+	}
+	return nil
+}
+
+// newID returns a random id for attachments, notifications and session tokens
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// uploadReader turns the chunks of an upload stream into an io.Reader
+type uploadReader struct {
+	stream pb.ChatService_UploadAttachmentServer
+	buf    []byte
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if req.GetInfo() != nil {
+			return 0, status.Errorf(codes.InvalidArgument, "Attachment info may only be sent once")
+		}
+		r.buf = req.GetChunk()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// sizeLimitedReader fails with errAttachmentTooLarge instead of silently truncating
+type sizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
+	read      int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// read one more byte to tell a file of exactly the limit from a larger one
+		var probe [1]byte
+		for {
+			n, err := l.r.Read(probe[:])
+			if n > 0 {
+				return 0, errAttachmentTooLarge
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	l.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"chat_app/config"
+	pb "chat_app/pb"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// uploadStream is the server side of an upload, receiving the given requests
+type uploadStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	requests []*pb.UploadAttachmentRequest
+	resp     *pb.Attachment
+}
+
+func (s *uploadStream) Context() context.Context { return s.ctx }
+
+func (s *uploadStream) Recv() (*pb.UploadAttachmentRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	return req, nil
+}
+
+func (s *uploadStream) SendAndClose(resp *pb.Attachment) error {
+	s.resp = resp
+	return nil
+}
+
+func TestAttachmentLimits(t *testing.T) {
+	s, _ := newTestServer(t)
+	setConfig(t, &config.AppConfig.Attachments.MaxSize, 10)
+	alice := registerUser(t, s, "alice")
+	joinRoom(t, s, "alice", "general")
+
+	store := func(body string) error {
+		_, err := s.StoreAttachment(alice, "alice", "general", "notes.txt", strings.NewReader(body))
+		return err
+	}
+	if err := store("0123456789"); err != nil {
+		t.Errorf("a file of exactly the limit: %v", err)
+	}
+	wantCode(t, "a file past the limit", store("0123456789a"), codes.InvalidArgument)
+	// the type comes from the content, not the name
+	wantCode(t, "a binary file", store("\x00\x01\x02\x03"), codes.InvalidArgument)
+
+	// uploads in chunks are limited the same way
+	upload := func(chunks ...string) error {
+		stream := &uploadStream{ctx: alice, requests: []*pb.UploadAttachmentRequest{{
+			Data: &pb.UploadAttachmentRequest_Info{Info: &pb.UploadAttachmentInfo{Room: "general", Filename: "notes.txt"}},
+		}}}
+		for _, chunk := range chunks {
+			stream.requests = append(stream.requests, &pb.UploadAttachmentRequest{
+				Data: &pb.UploadAttachmentRequest_Chunk{Chunk: []byte(chunk)},
+			})
+		}
+		err := s.UploadAttachment(stream)
+		if err == nil && stream.resp.Size != 10 {
+			t.Errorf("uploaded %v", stream.resp)
+		}
+		return err
+	}
+	if err := upload("01234", "56789"); err != nil {
+		t.Errorf("an upload of exactly the limit: %v", err)
+	}
+	wantCode(t, "an upload past the limit", upload("01234", "56789", "a"), codes.InvalidArgument)
+}
+
+func TestAttachmentRoomAccess(t *testing.T) {
+	s, _ := newTestServer(t)
+	alice := registerUser(t, s, "alice")
+	bob := registerUser(t, s, "bob")
+	joinRoom(t, s, "alice", "general")
+	joinRoom(t, s, "alice", "secret")
+	joinRoom(t, s, "bob", "general")
+
+	attachment, err := s.StoreAttachment(alice, "alice", "secret", "plan.txt", strings.NewReader("the plan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.StoreAttachment(bob, "bob", "secret", "plan.txt", strings.NewReader("my plan"))
+	wantCode(t, "upload to a room bob is not in", err, codes.PermissionDenied)
+
+	_, body, err := s.OpenAttachment(alice, "alice", attachment.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != "the plan" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	_, _, err = s.OpenAttachment(bob, "bob", attachment.Id)
+	wantCode(t, "download from a room bob is not in", err, codes.PermissionDenied)
+	_, _, err = s.OpenAttachment(alice, "alice", "missing")
+	wantCode(t, "download a missing attachment", err, codes.NotFound)
+
+	// an attachment cannot be shared into another room
+	err = s.PostMessage(alice, &pb.ChatMessage{Room: "general", Message: "look", Timestamp: 1, Attachments: []*pb.Attachment{{Id: attachment.Id}}})
+	wantCode(t, "post to another room", err, codes.PermissionDenied)
+	if err := s.PostMessage(alice, &pb.ChatMessage{Room: "secret", Message: "look", Timestamp: 1, Attachments: []*pb.Attachment{{Id: attachment.Id}}}); err != nil {
+		t.Errorf("post to its room: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package chat
+
+import (
+	"chat_app/internal/audit"
+	"chat_app/internal/logger"
+	pb "chat_app/pb"
+	"context"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// QueryAuditLog returns audit events, newest first. Only admins may call it,
+// and every query is audited itself.
+func (s *ChatServer) QueryAuditLog(ctx context.Context, req *pb.QueryAuditLogRequest) (*pb.QueryAuditLogResponse, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+	if err := s.checkAdmin(ctx, username); err != nil {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionQuery, Actor: username, Reason: status.Convert(err).Message()})
+		return nil, err
+	}
+
+	events, err := s.auditLog.Query(audit.Query{
+		Actor:  req.Actor,
+		Action: req.Action,
+		Room:   req.Room,
+		Since:  req.Since,
+		Until:  req.Until,
+		Limit:  int(req.Limit),
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to query audit log", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to query audit log")
+	}
+
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionQuery, Actor: username, Success: true})
+	return &pb.QueryAuditLogResponse{Events: events}, nil
+}
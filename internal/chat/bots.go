@@ -0,0 +1,220 @@
+package chat
+
+import (
+	"chat_app/internal/audit"
+	"chat_app/internal/logger"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ScopeMessagesWrite = "messages:write"
+	ScopeMessagesRead  = "messages:read"
+
+	// API tokens look like bot_<id>_<secret>, which also tells them apart from session JWTs
+	apiTokenPrefix = "bot_"
+)
+
+var apiTokenScopes = []string{ScopeMessagesWrite, ScopeMessagesRead}
+
+// botMethodScopes lists the only RPCs bots may call and the scope each one needs
+var botMethodScopes = map[string]string{
+	"/chat.ChatService/SendMessage":    ScopeMessagesWrite,
+	"/chat.ChatService/StreamMessages": ScopeMessagesRead,
+}
+
+var botNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func (s *ChatServer) CreateBot(ctx context.Context, req *pb.CreateBotRequest) (*pb.Bot, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	if !botNamePattern.MatchString(req.Name) {
+		return nil, status.Errorf(codes.InvalidArgument, "Bot names may only contain letters, digits, '_' and '-'")
+	}
+
+	// bots and users share the namespace of message authors
+	_, err := storage.GetUser(s.redisFor(ctx), req.Name)
+	if err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "Name already taken")
+	} else if err != redis.Nil {
+		logger.FromContext(ctx).Error("Error checking user existence:", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to create bot")
+	}
+
+	bot := &pb.Bot{
+		Name:      req.Name,
+		Owner:     username,
+		CreatedAt: time.Now().Unix(),
+	}
+	created, err := storage.SaveBot(s.redisFor(ctx), bot)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to save bot", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to create bot")
+	}
+	if !created {
+		return nil, status.Errorf(codes.AlreadyExists, "Name already taken")
+	}
+
+	logger.FromContext(ctx).Info("Bot created", zap.String("bot", bot.Name), zap.String("owner", username))
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionCreateBot, Actor: username, Target: bot.Name, Success: true})
+	return bot, nil
+}
+
+func (s *ChatServer) CreateAPIToken(ctx context.Context, req *pb.CreateAPITokenRequest) (*pb.APIToken, error) {
+	if _, err := s.ownBot(ctx, req.Bot); err != nil {
+		return nil, err
+	}
+
+	if len(req.Scopes) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "At least one scope is required")
+	}
+	for _, scope := range req.Scopes {
+		if !containsString(apiTokenScopes, scope) {
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown scope %q", scope)
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to generate token id", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to create token")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logger.FromContext(ctx).Error("Failed to generate token secret", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to create token")
+	}
+	secretHex := hex.EncodeToString(secret)
+
+	token := &pb.APIToken{
+		Id:        id,
+		Bot:       req.Bot,
+		Scopes:    req.Scopes,
+		Rooms:     req.Rooms,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := storage.SaveAPIToken(s.redisFor(ctx), token, hashSecret(secretHex)); err != nil {
+		logger.FromContext(ctx).Error("Failed to save token", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to create token")
+	}
+
+	logger.FromContext(ctx).Info("API token created", zap.String("bot", req.Bot), zap.String("id", id), zap.Strings("scopes", req.Scopes))
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionCreateAPIToken, Actor: req.Bot, Target: id, Success: true})
+	token.Token = apiTokenPrefix + id + "_" + secretHex
+	return token, nil
+}
+
+func (s *ChatServer) ListAPITokens(ctx context.Context, req *pb.ListAPITokensRequest) (*pb.ListAPITokensResponse, error) {
+	if _, err := s.ownBot(ctx, req.Bot); err != nil {
+		return nil, err
+	}
+
+	tokens, err := storage.GetBotAPITokens(s.redisFor(ctx), req.Bot)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to list tokens", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to list tokens")
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt < tokens[j].CreatedAt })
+
+	return &pb.ListAPITokensResponse{Tokens: tokens}, nil
+}
+
+func (s *ChatServer) RevokeAPIToken(ctx context.Context, req *pb.RevokeAPITokenRequest) (*pb.Empty, error) {
+	if _, err := s.ownBot(ctx, req.Bot); err != nil {
+		return nil, err
+	}
+
+	err := storage.DeleteAPIToken(s.redisFor(ctx), req.Bot, req.Id)
+	if err == redis.Nil {
+		return nil, status.Errorf(codes.NotFound, "Token not found")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to revoke token", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to revoke token")
+	}
+
+	logger.FromContext(ctx).Info("API token revoked", zap.String("bot", req.Bot), zap.String("id", req.Id))
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionRevokeAPIToken, Actor: req.Bot, Target: req.Id, Success: true})
+	return &pb.Empty{}, nil
+}
+
+// ownBot returns the bot if the authenticated user owns it
+func (s *ChatServer) ownBot(ctx context.Context, name string) (*pb.Bot, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	bot, err := storage.GetBot(s.redisFor(ctx), name)
+	if err == redis.Nil {
+		return nil, status.Errorf(codes.NotFound, "Bot not found")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to get bot", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to get bot")
+	}
+
+	if bot.Owner != username {
+		return nil, status.Errorf(codes.PermissionDenied, "Only the owner can manage this bot")
+	}
+	return bot, nil
+}
+
+// authenticateAPIToken checks a bot token and returns its metadata
+func (s *ChatServer) authenticateAPIToken(ctx context.Context, raw string) (*pb.APIToken, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(raw, apiTokenPrefix), "_")
+	if !ok || id == "" || secret == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid token")
+	}
+
+	token, secretHash, err := storage.GetAPIToken(s.redisFor(ctx), id)
+	if err == redis.Nil {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid token")
+	} else if err != nil {
+		logger.Log.Error("Error retrieving api token from redis: ", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Error verifying token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(secretHash)) != 1 {
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid token")
+	}
+
+	return token, nil
+}
+
+// checkTokenScope restricts bots to the scopes and rooms of their token.
+// Users are not restricted by it.
+func checkTokenScope(ctx context.Context, scope, room string) error {
+	token, ok := ctx.Value("apiToken").(*pb.APIToken)
+	if !ok {
+		return nil
+	}
+
+	if !containsString(token.Scopes, scope) {
+		return status.Errorf(codes.PermissionDenied, "Token lacks the %s scope", scope)
+	}
+	if len(token.Rooms) > 0 && !containsString(token.Rooms, room) {
+		return status.Errorf(codes.PermissionDenied, "Token may not be used in room %s", room)
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,448 @@
+package chat
+
+import (
+	"chat_app/internal/audit"
+	"chat_app/internal/logger"
+	"chat_app/internal/markdown"
+	"chat_app/internal/storage"
+	"chat_app/internal/webhook"
+	pb "chat_app/pb"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	shrug          = `¯\_(ツ)_/¯`
+	maxTopicLength = 256
+)
+
+var commandNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// Command is a slash command parsed out of a message
+type Command struct {
+	Name string
+	Args string
+	// Message is the message the command was typed in. Handlers may rewrite
+	// it and return send=true to post it.
+	Message *pb.ChatMessage
+}
+
+// CommandHandler runs a command for the sender of cmd.Message. When send is
+// true the message is saved and published like any other, otherwise it is dropped.
+type CommandHandler func(ctx context.Context, cmd *Command) (send bool, err error)
+
+type registeredCommand struct {
+	description string
+	handler     CommandHandler
+}
+
+// CommandRegistry holds the commands that run inside the server. Bot
+// commands registered over gRPC are kept in redis per room instead.
+type CommandRegistry struct {
+	mu       sync.RWMutex
+	commands map[string]registeredCommand
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{commands: make(map[string]registeredCommand)}
+}
+
+// Register adds or replaces a command. name is given without the leading slash.
+func (r *CommandRegistry) Register(name, description string, handler CommandHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands[name] = registeredCommand{description: description, handler: handler}
+}
+
+func (r *CommandRegistry) lookup(name string) (registeredCommand, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	command, ok := r.commands[name]
+	return command, ok
+}
+
+func (r *CommandRegistry) list() []*pb.Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	commands := make([]*pb.Command, 0, len(r.commands))
+	for name, command := range r.commands {
+		commands = append(commands, &pb.Command{Name: name, Description: command.description})
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands
+}
+
+// Commands returns the server's registry so other packages can add commands
+func (s *ChatServer) Commands() *CommandRegistry {
+	return s.commands
+}
+
+// parseCommand splits "/name args" out of a message. A leading "//" escapes
+// the slash and is turned into a single one.
+func parseCommand(msg *pb.ChatMessage) (*Command, bool) {
+	text := msg.Message
+	if strings.HasPrefix(text, "//") {
+		msg.Message = text[1:]
+		return nil, false
+	}
+	if !strings.HasPrefix(text, "/") {
+		return nil, false
+	}
+
+	name, args := text[1:], ""
+	if i := strings.IndexAny(name, " \n"); i >= 0 {
+		name, args = name[:i], name[i+1:]
+	}
+	// "/usr/bin" or "/ " are not commands
+	name = strings.ToLower(name)
+	if !commandNamePattern.MatchString(name) {
+		return nil, false
+	}
+
+	return &Command{Name: name, Args: strings.TrimSpace(args), Message: msg}, true
+}
+
+// runCommand runs a built-in or bot command and reports whether the message should still be sent
+func (s *ChatServer) runCommand(ctx context.Context, cmd *Command) (bool, error) {
+	if command, ok := s.commands.lookup(cmd.Name); ok {
+		return command.handler(ctx, cmd)
+	}
+
+	botCommand, err := storage.GetCommand(s.redisFor(ctx), cmd.Message.Room, cmd.Name)
+	if err == redis.Nil {
+		return false, status.Errorf(codes.InvalidArgument, "Unknown command /%s, start the message with // to send it as text", cmd.Name)
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to get command", zap.Error(err))
+		return false, status.Errorf(codes.Internal, "Failed to run command")
+	}
+
+	return false, s.invokeBotCommand(ctx, botCommand, cmd)
+}
+
+// invokeBotCommand posts the command to the bot and sends its reply
+func (s *ChatServer) invokeBotCommand(ctx context.Context, command *pb.Command, cmd *Command) error {
+	msg := cmd.Message
+	reply, err := s.webhooks.Invoke(command.Url, command.Secret, webhook.Invocation{
+		Command: cmd.Name,
+		Args:    cmd.Args,
+		Room:    msg.Room,
+		User:    msg.User,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Warn("Bot command failed", zap.Error(err), zap.String("command", cmd.Name), zap.String("bot", command.Bot))
+		return status.Errorf(codes.Unavailable, "Command /%s failed", cmd.Name)
+	}
+
+	if reply.Text == "" {
+		return nil
+	}
+	if reply.Private {
+		return s.replyPrivately(ctx, msg.Room, msg.User, reply.Text)
+	}
+
+	return s.saveAndPublish(ctx, command.Bot, &pb.ChatMessage{
+		User:      command.Bot,
+		Message:   reply.Text,
+		Timestamp: time.Now().Unix(),
+		Room:      msg.Room,
+	})
+}
+
+// replyPrivately sends command output to a single user's streams in the room
+func (s *ChatServer) replyPrivately(ctx context.Context, room, recipient, text string) error {
+	return s.publishText(ctx, room, "", recipient, pb.EventType_EVENT_SYSTEM, text)
+}
+
+// publishText sends an ephemeral event carrying plain text, only to recipient if it is set
+func (s *ChatServer) publishText(ctx context.Context, room, username, recipient string, eventType pb.EventType, text string) error {
+	channel := fmt.Sprintf("chat_messages:%s", room)
+	err := storage.PublishMessage(s.redisFor(ctx), channel, &pb.ChatMessage{
+		User:      username,
+		Message:   text,
+		Timestamp: time.Now().Unix(),
+		Room:      room,
+		Type:      eventType,
+		Segments:  []*pb.Segment{{Type: pb.SegmentType_SEGMENT_TEXT, Text: text}},
+		Recipient: recipient,
+	})
+	if err != nil {
+		logger.Log.Error("Failed to publish event", zap.Error(err), zap.String("room", room))
+		return status.Errorf(codes.Internal, "Failed to publish event")
+	}
+	return nil
+}
+
+func (s *ChatServer) registerBuiltinCommands() {
+	s.commands.Register("help", "List the available commands", s.helpCommand)
+	s.commands.Register("topic", "Show the room topic, or set it with /topic <text>", s.topicCommand)
+	s.commands.Register("me", "Send an action, like /me waves", s.meCommand)
+	s.commands.Register("invite", "Add a user to the room and notify them, /invite <user>", s.inviteCommand)
+	s.commands.Register("nick", "Set your nick in this room, /nick without a name clears it", s.nickCommand)
+	s.commands.Register("shrug", "Append "+shrug+" to your message", s.shrugCommand)
+}
+
+func (s *ChatServer) helpCommand(ctx context.Context, cmd *Command) (bool, error) {
+	commands, err := s.listCommands(ctx, cmd.Message.Room)
+	if err != nil {
+		return false, err
+	}
+
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, command := range commands {
+		fmt.Fprintf(&b, "\n/%s - %s", command.Name, command.Description)
+	}
+	return false, s.replyPrivately(ctx, cmd.Message.Room, cmd.Message.User, b.String())
+}
+
+func (s *ChatServer) topicCommand(ctx context.Context, cmd *Command) (bool, error) {
+	msg := cmd.Message
+
+	if cmd.Args == "" {
+		topic, err := storage.GetRoomTopic(s.redisFor(ctx), msg.Room)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to get topic", zap.Error(err))
+			return false, status.Errorf(codes.Internal, "Failed to get topic")
+		}
+		if topic == "" {
+			return false, s.replyPrivately(ctx, msg.Room, msg.User, "No topic is set")
+		}
+		return false, s.replyPrivately(ctx, msg.Room, msg.User, "Topic: "+topic)
+	}
+
+	if err := s.checkRoomAccess(ctx, msg.User, msg.Room); err != nil {
+		return false, err
+	}
+	if len(cmd.Args) > maxTopicLength {
+		return false, status.Errorf(codes.InvalidArgument, "Topic must be at most %d bytes", maxTopicLength)
+	}
+
+	if err := storage.SetRoomTopic(s.redisFor(ctx), msg.Room, cmd.Args); err != nil {
+		logger.FromContext(ctx).Error("Failed to set topic", zap.Error(err))
+		return false, status.Errorf(codes.Internal, "Failed to set topic")
+	}
+
+	logger.FromContext(ctx).Info("Topic changed", zap.String("user", msg.User), zap.String("room", msg.Room))
+	return false, s.publishText(ctx, msg.Room, msg.User, "", pb.EventType_EVENT_TOPIC, cmd.Args)
+}
+
+func (s *ChatServer) meCommand(ctx context.Context, cmd *Command) (bool, error) {
+	if cmd.Args == "" {
+		return false, status.Errorf(codes.InvalidArgument, "Usage: /me <action>")
+	}
+
+	cmd.Message.Message = cmd.Args
+	cmd.Message.Type = pb.EventType_EVENT_ACTION
+	return true, nil
+}
+
+func (s *ChatServer) inviteCommand(ctx context.Context, cmd *Command) (bool, error) {
+	msg := cmd.Message
+	invitee := cmd.Args
+	if invitee == "" || strings.ContainsAny(invitee, " \n") {
+		return false, status.Errorf(codes.InvalidArgument, "Usage: /invite <user>")
+	}
+
+	if err := s.checkRoomAccess(ctx, msg.User, msg.Room); err != nil {
+		return false, err
+	}
+
+	_, err := storage.GetUser(s.redisFor(ctx), invitee)
+	if err == redis.Nil {
+		return false, status.Errorf(codes.NotFound, "User %s not found", invitee)
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to look up invited user", zap.Error(err))
+		return false, status.Errorf(codes.Internal, "Failed to invite user")
+	}
+
+	if err := storage.AddUserRoom(s.redisFor(ctx), invitee, msg.Room); err != nil {
+		logger.FromContext(ctx).Error("Failed to record room membership", zap.Error(err))
+		return false, status.Errorf(codes.Internal, "Failed to invite user")
+	}
+
+	s.notify(ctx, invitee, pb.NotificationType_NOTIFICATION_INVITE, &pb.ChatMessage{
+		User:      msg.User,
+		Message:   fmt.Sprintf("%s invited you to %s", msg.User, msg.Room),
+		Timestamp: time.Now().Unix(),
+		Room:      msg.Room,
+	})
+
+	logger.FromContext(ctx).Info("User invited", zap.String("user", msg.User), zap.String("invitee", invitee), zap.String("room", msg.Room))
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionInvite, Actor: msg.User, Target: invitee, Room: msg.Room, Success: true})
+	return false, s.publishText(ctx, msg.Room, msg.User, "", pb.EventType_EVENT_SYSTEM, fmt.Sprintf("%s invited %s", msg.User, invitee))
+}
+
+func (s *ChatServer) nickCommand(ctx context.Context, cmd *Command) (bool, error) {
+	msg := cmd.Message
+	nick := cmd.Args
+
+	if nick != "" {
+		if !botNamePattern.MatchString(nick) {
+			return false, status.Errorf(codes.InvalidArgument, "Nicks may only contain letters, digits, '_' and '-'")
+		}
+		// a nick must not pass for somebody else
+		if nick != msg.User {
+			if taken, err := s.nameTaken(ctx, nick); err != nil {
+				return false, err
+			} else if taken {
+				return false, status.Errorf(codes.AlreadyExists, "Nick %s is someone's username", nick)
+			}
+		}
+	}
+
+	if err := storage.SetNick(s.redisFor(ctx), msg.Room, msg.User, nick); err != nil {
+		logger.FromContext(ctx).Error("Failed to set nick", zap.Error(err))
+		return false, status.Errorf(codes.Internal, "Failed to set nick")
+	}
+
+	return false, s.publishText(ctx, msg.Room, msg.User, "", pb.EventType_EVENT_NICK, nick)
+}
+
+func (s *ChatServer) shrugCommand(ctx context.Context, cmd *Command) (bool, error) {
+	msg := cmd.Message
+
+	// the shrug is added as plain text, markdown would eat its backslash
+	msg.Segments = nil
+	if cmd.Args != "" {
+		msg.Segments = markdown.Parse(cmd.Args + " ")
+	}
+	msg.Segments = append(msg.Segments, &pb.Segment{Type: pb.SegmentType_SEGMENT_TEXT, Text: shrug})
+	msg.Message = strings.TrimSpace(cmd.Args + " " + shrug)
+	return true, nil
+}
+
+// nameTaken reports whether a user or bot already uses the name
+func (s *ChatServer) nameTaken(ctx context.Context, name string) (bool, error) {
+	if _, err := storage.GetUser(s.redisFor(ctx), name); err == nil {
+		return true, nil
+	} else if err != redis.Nil {
+		logger.Log.Error("Error checking user existence:", zap.Error(err))
+		return false, status.Errorf(codes.Internal, "Error checking user existence")
+	}
+
+	if _, err := storage.GetBot(s.redisFor(ctx), name); err == nil {
+		return true, nil
+	} else if err != redis.Nil {
+		logger.Log.Error("Error checking bot existence:", zap.Error(err))
+		return false, status.Errorf(codes.Internal, "Error checking user existence")
+	}
+	return false, nil
+}
+
+// RegisterCommand adds a bot command to a room the bot's owner is in.
+// Registering the name again for the same bot replaces the url and secret.
+func (s *ChatServer) RegisterCommand(ctx context.Context, req *pb.RegisterCommandRequest) (*pb.Command, error) {
+	if _, err := s.ownBot(ctx, req.Bot); err != nil {
+		return nil, err
+	}
+	if _, err := s.roomMember(ctx, req.Room); err != nil {
+		return nil, err
+	}
+
+	if !commandNamePattern.MatchString(req.Name) {
+		return nil, status.Errorf(codes.InvalidArgument, "Command names may only contain lowercase letters, digits, '_' and '-'")
+	}
+	if _, builtin := s.commands.lookup(req.Name); builtin {
+		return nil, status.Errorf(codes.AlreadyExists, "Command /%s already exists", req.Name)
+	}
+
+	if err := s.webhooks.CheckURL(req.Url); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Command url %s", err)
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to generate command secret", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to register command")
+	}
+
+	command := &pb.Command{
+		Name:        req.Name,
+		Description: req.Description,
+		Bot:         req.Bot,
+		Url:         req.Url,
+		Secret:      secret,
+		CreatedAt:   time.Now().Unix(),
+		Room:        req.Room,
+	}
+	taken, err := storage.SaveCommand(s.redisFor(ctx), command)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to save command", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to register command")
+	}
+	if taken != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "Command /%s is already registered by %s in this room", req.Name, taken.Bot)
+	}
+
+	logger.FromContext(ctx).Info("Command registered", zap.String("command", req.Name), zap.String("bot", req.Bot), zap.String("room", req.Room))
+	return command, nil
+}
+
+// ListCommands returns the built-in commands and, when a room is given, the
+// bot commands registered in it
+func (s *ChatServer) ListCommands(ctx context.Context, req *pb.ListCommandsRequest) (*pb.ListCommandsResponse, error) {
+	if req.Room == "" {
+		return &pb.ListCommandsResponse{Commands: s.commands.list()}, nil
+	}
+	if _, err := s.roomMember(ctx, req.Room); err != nil {
+		return nil, err
+	}
+
+	commands, err := s.listCommands(ctx, req.Room)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ListCommandsResponse{Commands: commands}, nil
+}
+
+func (s *ChatServer) DeleteCommand(ctx context.Context, req *pb.DeleteCommandRequest) (*pb.Empty, error) {
+	if _, err := s.ownBot(ctx, req.Bot); err != nil {
+		return nil, err
+	}
+
+	command, err := storage.GetCommand(s.redisFor(ctx), req.Room, req.Name)
+	if err == redis.Nil || (err == nil && command.Bot != req.Bot) {
+		return nil, status.Errorf(codes.NotFound, "Command not found")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to get command", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to delete command")
+	}
+
+	if err := storage.DeleteCommand(s.redisFor(ctx), req.Room, req.Name); err != nil {
+		logger.FromContext(ctx).Error("Failed to delete command", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to delete command")
+	}
+
+	logger.FromContext(ctx).Info("Command deleted", zap.String("command", req.Name), zap.String("bot", req.Bot), zap.String("room", req.Room))
+	return &pb.Empty{}, nil
+}
+
+// listCommands returns the built-in commands followed by the room's bot commands
+func (s *ChatServer) listCommands(ctx context.Context, room string) ([]*pb.Command, error) {
+	botCommands, err := storage.GetCommands(s.redisFor(ctx), room)
+	if err != nil {
+		logger.Log.Error("Failed to list commands", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to list commands")
+	}
+	sort.Slice(botCommands, func(i, j int) bool { return botCommands[i].Name < botCommands[j].Name })
+
+	commands := s.commands.list()
+	for _, command := range botCommands {
+		// the url and secret are only for the bot's owner
+		command.Url = ""
+		command.Secret = ""
+		commands = append(commands, command)
+	}
+	return commands, nil
+}
@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"chat_app/internal/storage"
+	"chat_app/internal/webhook"
+	pb "chat_app/pb"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func createBot(t *testing.T, s *ChatServer, ctx context.Context, name string) {
+	t.Helper()
+	if _, err := s.CreateBot(ctx, &pb.CreateBotRequest{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommandsBelongToTheirRoom(t *testing.T) {
+	s, _ := newTestServer(t)
+	alice := registerUser(t, s, "alice")
+	bob := registerUser(t, s, "bob")
+	createBot(t, s, alice, "deploybot")
+	createBot(t, s, bob, "otherbot")
+	joinRoom(t, s, "alice", "ops")
+	joinRoom(t, s, "bob", "ops")
+	joinRoom(t, s, "bob", "dev")
+
+	register := func(ctx context.Context, bot, room, url string) (*pb.Command, error) {
+		return s.RegisterCommand(ctx, &pb.RegisterCommandRequest{Bot: bot, Name: "deploy", Description: "Deploy", Url: url, Room: room})
+	}
+
+	_, err := register(alice, "deploybot", "ops", "http://10.0.0.5/deploy")
+	wantCode(t, "private url", err, codes.InvalidArgument)
+	_, err = register(alice, "deploybot", "dev", "https://bots.example.com/deploy")
+	wantCode(t, "room the owner is not in", err, codes.PermissionDenied)
+	_, err = register(bob, "deploybot", "ops", "https://bots.example.com/deploy")
+	wantCode(t, "someone else's bot", err, codes.PermissionDenied)
+
+	first, err := register(alice, "deploybot", "ops", "https://bots.example.com/deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = register(bob, "otherbot", "ops", "https://evil.example.com/deploy")
+	wantCode(t, "name taken by another bot", err, codes.AlreadyExists)
+	_, err = register(bob, "otherbot", "dev", "https://other.example.com/deploy")
+	wantCode(t, "same name in another room", err, codes.OK)
+
+	// the owner can move the command to a new url
+	second, err := register(alice, "deploybot", "ops", "https://bots.example.com/v2/deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Secret == first.Secret {
+		t.Error("re-registering kept the old secret")
+	}
+	command, err := storage.GetCommand(s.redisClient, "ops", "deploy")
+	if err != nil || command.Bot != "deploybot" || command.Url != "https://bots.example.com/v2/deploy" {
+		t.Errorf("got command %v, %v", command, err)
+	}
+
+	for _, tt := range []struct {
+		room string
+		bot  string
+	}{{"ops", "deploybot"}, {"dev", "otherbot"}} {
+		resp, err := s.ListCommands(bob, &pb.ListCommandsRequest{Room: tt.room})
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := resp.Commands[len(resp.Commands)-1]
+		if last.Name != "deploy" || last.Bot != tt.bot || last.Url != "" || last.Secret != "" {
+			t.Errorf("%s: got last command %v", tt.room, last)
+		}
+	}
+	_, err = s.ListCommands(alice, &pb.ListCommandsRequest{Room: "dev"})
+	wantCode(t, "list a room the user is not in", err, codes.PermissionDenied)
+
+	_, err = s.DeleteCommand(bob, &pb.DeleteCommandRequest{Bot: "otherbot", Name: "deploy", Room: "ops"})
+	wantCode(t, "delete another bot's command", err, codes.NotFound)
+	_, err = s.DeleteCommand(alice, &pb.DeleteCommandRequest{Bot: "deploybot", Name: "deploy", Room: "ops"})
+	wantCode(t, "delete own command", err, codes.OK)
+	if _, err := storage.GetCommand(s.redisClient, "dev", "deploy"); err != nil {
+		t.Errorf("the command in dev is gone: %v", err)
+	}
+}
+
+func TestBotCommandIsInvokedForItsRoom(t *testing.T) {
+	s, _ := newTestServer(t)
+	invocations := make(chan webhook.Invocation, 1)
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var invocation webhook.Invocation
+		if err := json.NewDecoder(r.Body).Decode(&invocation); err != nil {
+			t.Error(err)
+		}
+		invocations <- invocation
+		json.NewEncoder(w).Encode(webhook.Reply{Text: "deploying", Private: true})
+	}))
+	defer bot.Close()
+	s.webhooks = webhook.NewDispatcher(s.redisClient, webhook.Options{MaxAttempts: 1, Timeout: time.Second, MaxConcurrent: 1, AllowPrivateNetworks: true})
+
+	alice := registerUser(t, s, "alice")
+	createBot(t, s, alice, "deploybot")
+	joinRoom(t, s, "alice", "ops")
+	joinRoom(t, s, "alice", "dev")
+	if _, err := s.RegisterCommand(alice, &pb.RegisterCommandRequest{Bot: "deploybot", Name: "deploy", Url: bot.URL, Room: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(room string) error {
+		_, err := s.runCommand(alice, &Command{Name: "deploy", Args: "v1.2", Message: &pb.ChatMessage{User: "alice", Room: room}})
+		return err
+	}
+
+	wantCode(t, "command from another room", run("dev"), codes.InvalidArgument)
+	if err := run("ops"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case invocation := <-invocations:
+		if invocation.Command != "deploy" || invocation.Args != "v1.2" || invocation.Room != "ops" || invocation.User != "alice" {
+			t.Errorf("got invocation %+v", invocation)
+		}
+	default:
+		t.Error("the bot was not invoked")
+	}
+}
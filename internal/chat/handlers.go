@@ -2,15 +2,19 @@ package chat
 
 import (
 	// "chat_app/internal/storage"
+	"chat_app/config"
+	"chat_app/internal/audit"
 	"chat_app/internal/logger"
+	"chat_app/internal/metrics"
 	"chat_app/internal/storage"
+	"chat_app/internal/tracing"
 	pb "chat_app/pb"
+	"context"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt/v5"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -19,7 +23,7 @@ func ValidateMessage(msg *pb.ChatMessage) error {
 	if msg.User == "" {
 		return status.Error(codes.InvalidArgument, "User must not be empty")
 	}
-	if msg.Message == "" {
+	if msg.Message == "" && len(msg.Attachments) == 0 {
 		return status.Error(codes.InvalidArgument, "Message must not be empty")
 	}
 	if msg.Timestamp == 0 {
@@ -32,41 +36,61 @@ func ValidateMessage(msg *pb.ChatMessage) error {
 	return nil
 }
 
-func LogMessageReceived(msg *pb.ChatMessage) {
-	logger.Log.Info("Received message",
+func LogMessageReceived(ctx context.Context, msg *pb.ChatMessage) {
+	logger.FromContext(ctx).Info("Received message",
 		zap.String("user", msg.User),
 		zap.Int64("timestamp", msg.Timestamp))
 }
 
-func LogStreamEnded(err error) {
+func LogStreamEnded(ctx context.Context, err error) {
 	if err != nil {
-		logger.Log.Error("Client disconnected from message stream with error", zap.Error(err))
+		logger.FromContext(ctx).Error("Client disconnected from message stream with error", zap.Error(err))
 	} else {
-		logger.Log.Info("Client disconnected from message stream")
+		logger.FromContext(ctx).Info("Client disconnected from message stream")
 	}
 }
 
-func HandleRegister(redisClient *redis.Client, req *pb.RegisterRequest) (*pb.AuthResponse, error) {
+func HandleRegister(redisClient *redis.Client, auditLog *audit.Log, req *pb.RegisterRequest) (*pb.AuthResponse, error) {
+	ctx := redisClient.Context()
+
+	if err := validateUsername(req.Username); err != nil {
+		return nil, err
+	}
+	if err := validatePassword(req.Username, req.Password); err != nil {
+		return nil, err
+	}
+
 	// check if username already exists and hash password
 	_, err := storage.GetUser(redisClient, req.Username)
 	if err == nil {
 		// user already exists
+		auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionRegister, Actor: req.Username, Reason: "username taken"})
 		return nil, status.Errorf(codes.AlreadyExists, "Username already exists")
 	} else if err != redis.Nil {
 		// unexpected error
-		logger.Log.Error("Error checking user existence:", zap.Error(err))
+		logger.FromContext(ctx).Error("Error checking user existence:", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Error checking user existence")
+	}
+
+	// bots and users share the namespace of message authors
+	_, err = storage.GetBot(redisClient, req.Username)
+	if err == nil {
+		auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionRegister, Actor: req.Username, Reason: "username taken"})
+		return nil, status.Errorf(codes.AlreadyExists, "Username already exists")
+	} else if err != redis.Nil {
+		logger.FromContext(ctx).Error("Error checking bot existence:", zap.Error(err))
 		return nil, status.Errorf(codes.Internal, "Error checking user existence")
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(ctx, req.Password)
 	if err != nil {
-		logger.Log.Error("Error hashing password: ", zap.Error(err))
+		logger.FromContext(ctx).Error("Error hashing password: ", zap.Error(err))
 		return nil, status.Errorf(codes.Internal, "Failed to hash password")
 	}
 
-	err = storage.SaveUser(redisClient, req.Username, string(hashedPassword))
+	err = storage.SaveUser(redisClient, req.Username, hashedPassword)
 	if err != nil {
-		logger.Log.Error("Error saving user:", zap.Error(err))
+		logger.FromContext(ctx).Error("Error saving user:", zap.Error(err))
 		return nil, status.Errorf(codes.Internal, "Failed to save user: %v", err)
 	}
 
@@ -74,50 +98,119 @@ func HandleRegister(redisClient *redis.Client, req *pb.RegisterRequest) (*pb.Aut
 	// Generate JWT token
 	token, err := generateToken(req.Username)
 	if err != nil {
-		logger.Log.Error("Error generating token:", zap.Error(err))
+		logger.FromContext(ctx).Error("Error generating token:", zap.Error(err))
 		return nil, status.Errorf(codes.Internal, "Failed to generate token")
 	}
 
-	err = storage.SaveToken(redisClient, req.Username, token, 24*time.Hour)
+	err = storage.SaveToken(redisClient, req.Username, token, config.AppConfig.Auth.TokenTTL)
 	if err != nil {
-		logger.Log.Error("Error saving token:", zap.Error(err))
+		logger.FromContext(ctx).Error("Error saving token:", zap.Error(err))
 		return nil, status.Errorf(codes.Internal, "Failed to save token: %v", err)
 	}
-	return &pb.AuthResponse{Token: token}, nil
+	auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionRegister, Actor: req.Username, Success: true})
+	return &pb.AuthResponse{Token: token, Username: req.Username}, nil
 }
 
-func HandleLogin(redisClient *redis.Client, req *pb.LoginRequest) (*pb.AuthResponse, error) {
+func HandleLogin(redisClient *redis.Client, auditLog *audit.Log, req *pb.LoginRequest) (*pb.AuthResponse, error) {
+	ctx := redisClient.Context()
+
+	// refuse without looking at the password while the account or address is locked out
+	limits := loginLimits(ctx, req.Username)
+	locked, err := loginLockRemaining(redisClient, limits)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check login lockout", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to log in")
+	}
+	if locked > 0 {
+		metrics.Logins.WithLabelValues("locked").Inc()
+		auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionLogin, Actor: req.Username, Reason: "locked out"})
+		return nil, lockedOutError(locked)
+	}
+
 	// Retrieve hashed password for username from database
 	hashedPassword, err := storage.GetUser(redisClient, req.Username)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "User not found: %v", err)
+	if err != nil && err != redis.Nil {
+		logger.FromContext(ctx).Error("Failed to get user", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to log in")
+	}
+
+	// Compare passwords, also for unknown users so both fail alike
+	_, span := tracing.Start(ctx, "bcrypt.CompareHashAndPassword")
+	ok := comparePassword(hashedPassword, req.Password)
+	span.End()
+	if !ok {
+		metrics.Logins.WithLabelValues("failure").Inc()
+		reason := "wrong password"
+		if err == redis.Nil {
+			reason = "unknown user"
+		}
+		auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionLogin, Actor: req.Username, Reason: reason})
+		if err := recordLoginFailure(redisClient, limits); err != nil {
+			logger.FromContext(ctx).Error("Failed to record failed login", zap.Error(err))
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid username or password")
 	}
 
-	// Compare passwords
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password))
+	// with two-factor authentication the password only earns a challenge,
+	// and failed logins are kept until the code is right too
+	secret, _, err := storage.GetTwoFactor(redisClient, req.Username)
 	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "Invalid credentials")
+		logger.FromContext(ctx).Error("Failed to get two-factor authentication", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to log in")
+	}
+	if secret != "" {
+		challenge, err := newTwoFactorChallenge(redisClient, req.Username)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to create two-factor challenge", zap.Error(err))
+			return nil, status.Errorf(codes.Internal, "Failed to log in")
+		}
+		auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionLogin, Actor: req.Username, Reason: "second factor required"})
+		return &pb.AuthResponse{TwoFactorRequired: true, Challenge: challenge}, nil
+	}
+
+	// the address keeps its count, or one account could hide guesses at others
+	if err := storage.ClearLoginFailures(redisClient, accountLockoutKey(req.Username)); err != nil {
+		logger.FromContext(ctx).Error("Failed to clear failed logins", zap.Error(err))
 	}
+	metrics.Logins.WithLabelValues("success").Inc()
+	auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionLogin, Actor: req.Username, Success: true})
+
+	return startSession(redisClient, req.Username)
+}
+
+// startSession issues a new session token for the user, replacing their
+// current one
+func startSession(redisClient *redis.Client, username string) (*pb.AuthResponse, error) {
+	ctx := redisClient.Context()
 
 	// Generate JWT token
-	token, err := generateToken(req.Username)
+	token, err := generateToken(username)
 	if err != nil {
+		logger.FromContext(ctx).Error("Error generating token:", zap.Error(err))
 		return nil, status.Errorf(codes.Internal, "Failed to generate token")
 	}
 
 	// save token to redis
-	err = storage.SaveToken(redisClient, req.Username, token, 24*time.Hour)
+	err = storage.SaveToken(redisClient, username, token, config.AppConfig.Auth.TokenTTL)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to save token: %v", err)
+		logger.FromContext(ctx).Error("Error saving token:", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to save token")
 	}
 
-	return &pb.AuthResponse{Token: token}, nil
+	return &pb.AuthResponse{Token: token, Username: username}, nil
 }
 
 func generateToken(username string) (string, error) {
+	// a random id keeps two tokens issued in the same second apart, so a
+	// revoked session's token is never handed out again
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"username": username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
+		"exp":      time.Now().Add(config.AppConfig.Auth.TokenTTL).Unix(),
+		"jti":      id,
 	})
-	return token.SignedString([]byte("dogdogdog"))
+	return token.SignedString([]byte(config.AppConfig.Auth.JWTSecret))
 }
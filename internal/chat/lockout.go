@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"chat_app/config"
+	"chat_app/internal/storage"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// loginLimit is what one lockout key, an account or a client address, may do
+type loginLimit struct {
+	key          string
+	freeAttempts int
+	maxAttempts  int
+}
+
+// loginLimits returns the limits a login for username counts against. The
+// client address is left out when it is not known, like for in-process calls.
+func loginLimits(ctx context.Context, username string) []loginLimit {
+	cfg := config.AppConfig.Auth.Lockout
+	limits := []loginLimit{{key: accountLockoutKey(username), freeAttempts: cfg.FreeAttempts, maxAttempts: cfg.MaxAttempts}}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		if host != "" {
+			limits = append(limits, loginLimit{key: "ip:" + host, freeAttempts: cfg.IPFreeAttempts, maxAttempts: cfg.IPMaxAttempts})
+		}
+	}
+	return limits
+}
+
+func accountLockoutKey(username string) string {
+	return "user:" + username
+}
+
+// lockedOutError tells the caller how long to wait
+func lockedOutError(remaining time.Duration) error {
+	return status.Errorf(codes.ResourceExhausted, "Too many failed login attempts, try again in %ds", (remaining+time.Second-1)/time.Second)
+}
+
+// loginLockRemaining returns how long the longest of the locks on limits still lasts, or 0
+func loginLockRemaining(redisClient *redis.Client, limits []loginLimit) (time.Duration, error) {
+	var longest time.Duration
+	for _, limit := range limits {
+		remaining, err := storage.GetLoginLock(redisClient, limit.key)
+		if err != nil {
+			return 0, err
+		}
+		longest = max(longest, remaining)
+	}
+	return longest, nil
+}
+
+// recordLoginFailure counts a failed login against limits and locks those
+// that went over their free attempts
+func recordLoginFailure(redisClient *redis.Client, limits []loginLimit) error {
+	cfg := config.AppConfig.Auth.Lockout
+	for _, limit := range limits {
+		failures, err := storage.RecordLoginFailure(redisClient, limit.key, cfg.Window)
+		if err != nil {
+			return err
+		}
+		if delay := lockoutDelay(cfg, failures, limit); delay > 0 {
+			if err := storage.LockLogin(redisClient, limit.key, delay); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lockoutDelay is how long logins are blocked after the given number of
+// failures: nothing for the free attempts, then a delay doubling with every
+// failure up to the maximum, then the full lockout
+func lockoutDelay(cfg config.LockoutConfig, failures int64, limit loginLimit) time.Duration {
+	switch {
+	case failures >= int64(limit.maxAttempts):
+		return cfg.Duration
+	case failures <= int64(limit.freeAttempts):
+		return 0
+	}
+	delay := cfg.BaseDelay
+	for i := int64(limit.freeAttempts) + 1; i < failures && delay < cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, cfg.MaxDelay)
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// comparePassword checks password against hashedPassword. Without a hash, as
+// for an unknown user, it compares against a made up one so the answer takes
+// as long as for a real account and cannot tell which usernames exist.
+func comparePassword(hashedPassword, password string) bool {
+	if hashedPassword == "" {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil
+}
@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"chat_app/config"
+	pb "chat_app/pb"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	cfg := config.LockoutConfig{BaseDelay: time.Second, MaxDelay: 30 * time.Second, Duration: 15 * time.Minute}
+	limit := loginLimit{freeAttempts: 3, maxAttempts: 10}
+	want := []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 15 * time.Minute, 15 * time.Minute}
+	for i, want := range want {
+		failures := int64(i + 1)
+		if got := lockoutDelay(cfg, failures, limit); got != want {
+			t.Errorf("lockoutDelay after %d failures = %s, want %s", failures, got, want)
+		}
+	}
+}
+
+// fromAddr returns a context for calls made from the client address
+func fromAddr(addr string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 40000}})
+}
+
+func TestAccountLockout(t *testing.T) {
+	s, mr := newTestServer(t)
+	setConfig(t, &config.AppConfig.Auth.Lockout, config.LockoutConfig{
+		Window: 15 * time.Minute, FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: 4 * time.Second,
+		MaxAttempts: 5, Duration: 15 * time.Minute, IPFreeAttempts: 100, IPMaxAttempts: 100,
+	})
+	registerUser(t, s, "alice")
+	ctx := fromAddr("192.0.2.1")
+
+	login := func(password string) error {
+		_, err := s.Login(ctx, &pb.LoginRequest{Username: "alice", Password: password})
+		return err
+	}
+
+	wantCode(t, "first failure", login("wrong"), codes.Unauthenticated)
+	wantCode(t, "second failure", login("wrong"), codes.Unauthenticated)
+	wantCode(t, "third failure", login("wrong"), codes.Unauthenticated)
+	// the third went over the free attempts, so even the right password waits
+	wantCode(t, "while delayed", login(testPassword), codes.ResourceExhausted)
+
+	mr.FastForward(time.Second)
+	wantCode(t, "after the delay", login(testPassword), codes.OK)
+
+	// a successful login starts the count again
+	wantCode(t, "failure after success", login("wrong"), codes.Unauthenticated)
+	wantCode(t, "failure after success", login("wrong"), codes.Unauthenticated)
+	wantCode(t, "within the free attempts", login(testPassword), codes.OK)
+
+	for i := 0; i < 5; i++ {
+		login("wrong")
+		mr.FastForward(4 * time.Second)
+	}
+	wantCode(t, "after max attempts", login(testPassword), codes.ResourceExhausted)
+	mr.FastForward(10 * time.Minute)
+	wantCode(t, "during the lockout", login(testPassword), codes.ResourceExhausted)
+	mr.FastForward(5 * time.Minute)
+	wantCode(t, "after the lockout", login(testPassword), codes.OK)
+
+	// failures are forgotten after the window
+	login("wrong")
+	login("wrong")
+	mr.FastForward(16 * time.Minute)
+	login("wrong")
+	wantCode(t, "failures outside the window", login(testPassword), codes.OK)
+}
+
+func TestAddressLockout(t *testing.T) {
+	s, _ := newTestServer(t)
+	setConfig(t, &config.AppConfig.Auth.Lockout, config.LockoutConfig{
+		Window: 15 * time.Minute, FreeAttempts: 100, BaseDelay: time.Second, MaxDelay: time.Second,
+		MaxAttempts: 100, Duration: 15 * time.Minute, IPFreeAttempts: 3, IPMaxAttempts: 3,
+	})
+	registerUser(t, s, "alice")
+
+	// guessing at several accounts, existing or not, from one address
+	for _, username := range []string{"bob", "carol", "dave"} {
+		_, err := s.Login(fromAddr("192.0.2.1"), &pb.LoginRequest{Username: username, Password: "guess"})
+		wantCode(t, "guess for "+username, err, codes.Unauthenticated)
+	}
+
+	_, err := s.Login(fromAddr("192.0.2.1"), &pb.LoginRequest{Username: "alice", Password: testPassword})
+	wantCode(t, "from the locked address", err, codes.ResourceExhausted)
+	_, err = s.Login(fromAddr("198.51.100.7"), &pb.LoginRequest{Username: "alice", Password: testPassword})
+	wantCode(t, "from another address", err, codes.OK)
+}
@@ -0,0 +1,46 @@
+package chat
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// bannedWords matches any banned word or phrase that is not part of a longer
+// word, ignoring case. A nil pattern bans nothing.
+type bannedWords struct {
+	pattern atomic.Pointer[regexp.Regexp]
+}
+
+// SetBannedWords replaces the banned words list. It is safe to call while
+// messages are being sent, which lets the list be changed on config reload.
+func (s *ChatServer) SetBannedWords(words []string) {
+	var quoted []string
+	for _, word := range words {
+		// words of a phrase may be separated by any whitespace
+		var parts []string
+		for _, part := range strings.Fields(word) {
+			parts = append(parts, regexp.QuoteMeta(part))
+		}
+		if len(parts) > 0 {
+			quoted = append(quoted, strings.Join(parts, `\s+`))
+		}
+	}
+
+	if len(quoted) == 0 {
+		s.bannedWords.pattern.Store(nil)
+		return
+	}
+	s.bannedWords.pattern.Store(regexp.MustCompile(`(?i)(?:^|[^\p{L}\p{N}_])(?:` + strings.Join(quoted, "|") + `)(?:$|[^\p{L}\p{N}_])`))
+}
+
+func (s *ChatServer) checkBannedWords(text string) error {
+	pattern := s.bannedWords.pattern.Load()
+	if pattern != nil && pattern.MatchString(text) {
+		return status.Errorf(codes.InvalidArgument, "Message contains a banned word")
+	}
+	return nil
+}
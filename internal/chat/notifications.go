@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"chat_app/internal/logger"
+	"chat_app/internal/markdown"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultNotificationLimit = 50
+
+func (s *ChatServer) ListNotifications(ctx context.Context, req *pb.ListNotificationsRequest) (*pb.ListNotificationsResponse, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	limit := int(req.Limit)
+	if limit <= 0 || limit > defaultNotificationLimit {
+		limit = defaultNotificationLimit
+	}
+
+	notifications, err := storage.GetNotifications(s.redisFor(ctx), username, req.IncludeAcked, limit)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to list notifications", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to list notifications")
+	}
+
+	return &pb.ListNotificationsResponse{Notifications: notifications}, nil
+}
+
+func (s *ChatServer) AckNotification(ctx context.Context, req *pb.AckNotificationRequest) (*pb.Empty, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	err := storage.AckNotification(s.redisFor(ctx), username, req.Id)
+	if err == redis.Nil {
+		return nil, status.Errorf(codes.NotFound, "Notification not found")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to acknowledge notification", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to acknowledge notification")
+	}
+
+	return &pb.Empty{}, nil
+}
+
+func (s *ChatServer) StreamNotifications(req *pb.Empty, stream pb.ChatService_StreamNotificationsServer) error {
+	username, ok := UsernameFromContext(stream.Context())
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	pubsub := storage.SubscribeToNotifications(s.redisFor(stream.Context()), username)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.goingAway:
+			return errShuttingDown
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			var notification pb.Notification
+			if err := json.Unmarshal([]byte(msg.Payload), &notification); err != nil {
+				logger.FromContext(stream.Context()).Error("Failed to unmarshal notification", zap.Error(err))
+				continue
+			}
+
+			if err := stream.Send(&notification); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// notifyMentions stores and publishes a notification for every existing user
+// mentioned in the message, except the sender
+func (s *ChatServer) notifyMentions(ctx context.Context, sender string, msg *pb.ChatMessage) {
+	for _, username := range markdown.Mentions(msg.Segments) {
+		if username == sender {
+			continue
+		}
+
+		if _, err := storage.GetUser(s.redisFor(ctx), username); err != nil {
+			if err != redis.Nil {
+				logger.Log.Error("Failed to look up mentioned user", zap.Error(err))
+			}
+			continue
+		}
+
+		s.notify(ctx, username, pb.NotificationType_NOTIFICATION_MENTION, msg)
+	}
+}
+
+// notify adds a notification to the user's inbox and pushes it to their streams
+func (s *ChatServer) notify(ctx context.Context, username string, notificationType pb.NotificationType, msg *pb.ChatMessage) {
+	id, err := newID()
+	if err != nil {
+		logger.Log.Error("Failed to generate notification id", zap.Error(err))
+		return
+	}
+
+	notification := &pb.Notification{
+		Id:        id,
+		Type:      notificationType,
+		Message:   msg,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := storage.SaveNotification(s.redisFor(ctx), username, notification); err != nil {
+		logger.Log.Error("Failed to save notification", zap.Error(err), zap.String("user", username))
+		return
+	}
+	if err := storage.PublishNotification(s.redisFor(ctx), username, notification); err != nil {
+		logger.Log.Error("Failed to publish notification", zap.Error(err), zap.String("user", username))
+	}
+}
@@ -0,0 +1,93 @@
+package chat
+
+import (
+	pb "chat_app/pb"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"google.golang.org/grpc/codes"
+)
+
+// streamNotifications opens a notification stream as the user of ctx and
+// returns once it is subscribed
+func streamNotifications(t *testing.T, s *ChatServer, mr *miniredis.Miniredis, ctx context.Context) *testStream[*pb.Notification] {
+	t.Helper()
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &testStream[*pb.Notification]{ctx: ctx, sent: make(chan *pb.Notification, 100)}
+	done := make(chan struct{})
+	go func() {
+		s.StreamNotifications(&pb.Empty{}, stream)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	username, _ := UsernameFromContext(ctx)
+	channel := "user_notifications:" + username
+	for deadline := time.Now().Add(2 * time.Second); mr.PubSubNumSub(channel)[channel] == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the notification stream did not subscribe")
+		}
+	}
+	return stream
+}
+
+func TestMentionNotifications(t *testing.T) {
+	s, mr := newTestServer(t)
+	alice := registerUser(t, s, "alice")
+	bob := registerUser(t, s, "bob")
+	joinRoom(t, s, "bob", "general")
+
+	stream := streamNotifications(t, s, mr, bob)
+	// alice mentioning herself or someone who does not exist notifies nobody
+	post(t, s, alice, "general", "hey @bob, ask @nobody or @alice, but not @bob twice")
+	post(t, s, alice, "general", "no mention here")
+
+	got := stream.next(t)
+	if got.Type != pb.NotificationType_NOTIFICATION_MENTION || got.Message.Room != "general" || got.Message.User != "alice" {
+		t.Errorf("streamed %v", got)
+	}
+	select {
+	case extra := <-stream.sent:
+		t.Errorf("streamed another notification %v", extra)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	list := func(ctx context.Context, includeAcked bool) []*pb.Notification {
+		t.Helper()
+		resp, err := s.ListNotifications(ctx, &pb.ListNotificationsRequest{IncludeAcked: includeAcked})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Notifications
+	}
+	if inbox := list(alice, true); len(inbox) != 0 {
+		t.Errorf("alice was notified: %v", inbox)
+	}
+	inbox := list(bob, false)
+	if len(inbox) != 1 || inbox[0].Id != got.Id || inbox[0].Acked {
+		t.Fatalf("bob's inbox: %v", inbox)
+	}
+
+	if _, err := s.AckNotification(bob, &pb.AckNotificationRequest{Id: got.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if inbox := list(bob, false); len(inbox) != 0 {
+		t.Errorf("unacknowledged after the ack: %v", inbox)
+	}
+	if inbox := list(bob, true); len(inbox) != 1 || !inbox[0].Acked {
+		t.Errorf("all after the ack: %v", inbox)
+	}
+
+	_, err := s.AckNotification(bob, &pb.AckNotificationRequest{Id: "missing"})
+	wantCode(t, "ack a missing notification", err, codes.NotFound)
+	// one user cannot acknowledge another's notifications
+	_, err = s.AckNotification(alice, &pb.AckNotificationRequest{Id: got.Id})
+	wantCode(t, "ack bob's notification as alice", err, codes.NotFound)
+	_, err = s.ListNotifications(context.Background(), &pb.ListNotificationsRequest{})
+	wantCode(t, "list without a user", err, codes.Unauthenticated)
+}
@@ -0,0 +1,259 @@
+package chat
+
+import (
+	"chat_app/config"
+	"chat_app/internal/audit"
+	"chat_app/internal/logger"
+	"chat_app/internal/notifier"
+	"chat_app/internal/storage"
+	"chat_app/internal/tracing"
+	pb "chat_app/pb"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateUsername(username string) error {
+	cfg := config.AppConfig.Auth.Username
+	if len(username) < cfg.MinLength || len(username) > cfg.MaxLength {
+		return status.Errorf(codes.InvalidArgument, "Username must be %d to %d characters long", cfg.MinLength, cfg.MaxLength)
+	}
+	if !usernamePattern.MatchString(username) {
+		return status.Errorf(codes.InvalidArgument, "Usernames may only contain letters, digits, '_' and '-'")
+	}
+	return nil
+}
+
+// validatePassword checks password against auth.password and names every
+// rule it breaks, so users can fix them all at once
+func validatePassword(username, password string) error {
+	cfg := config.AppConfig.Auth.Password
+	if len(password) < cfg.MinLength || len(password) > cfg.MaxLength {
+		return status.Errorf(codes.InvalidArgument, "Password must be %d to %d bytes long", cfg.MinLength, cfg.MaxLength)
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	var missing []string
+	if cfg.RequireUpper && !hasUpper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if cfg.RequireLower && !hasLower {
+		missing = append(missing, "a lowercase letter")
+	}
+	if cfg.RequireDigit && !hasDigit {
+		missing = append(missing, "a digit")
+	}
+	if cfg.RequireSymbol && !hasSymbol {
+		missing = append(missing, "a symbol")
+	}
+	if len(missing) > 0 {
+		return status.Errorf(codes.InvalidArgument, "Password must contain %s", strings.Join(missing, ", "))
+	}
+
+	if cfg.RejectUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return status.Errorf(codes.InvalidArgument, "Password must not contain the username")
+	}
+	return nil
+}
+
+func hashPassword(ctx context.Context, password string) (string, error) {
+	// hashing is deliberately slow, so it gets its own span
+	_, span := tracing.Start(ctx, "bcrypt.GenerateFromPassword")
+	defer span.End()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hashedPassword), err
+}
+
+// setPassword replaces the user's password and ends their session. Reset
+// tokens sent for the old password are revoked, so an older reset link cannot
+// undo the change.
+func setPassword(redisClient *redis.Client, username, password string) error {
+	hashedPassword, err := hashPassword(redisClient.Context(), password)
+	if err != nil {
+		return err
+	}
+	if err := storage.SaveUser(redisClient, username, hashedPassword); err != nil {
+		return err
+	}
+	if err := storage.DeletePasswordResets(redisClient, username); err != nil {
+		return err
+	}
+	return storage.DeleteToken(redisClient, username)
+}
+
+// ChangePassword checks the current password like Login does, including the
+// lockout, and returns a new session token since the old one stops working
+func (s *ChatServer) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.AuthResponse, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+	if err := validatePassword(username, req.NewPassword); err != nil {
+		return nil, err
+	}
+	redisClient := s.redisFor(ctx)
+
+	limits := loginLimits(ctx, username)
+	locked, err := loginLockRemaining(redisClient, limits)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check login lockout", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to change password")
+	}
+	if locked > 0 {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionChangePassword, Actor: username, Reason: "locked out"})
+		return nil, lockedOutError(locked)
+	}
+
+	hashedPassword, err := storage.GetUser(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to change password")
+	}
+	if hashedPassword == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Accounts that log in with single sign-on have no password")
+	}
+	_, span := tracing.Start(ctx, "bcrypt.CompareHashAndPassword")
+	ok = comparePassword(hashedPassword, req.CurrentPassword)
+	span.End()
+	if !ok {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionChangePassword, Actor: username, Reason: "wrong password"})
+		if err := recordLoginFailure(redisClient, limits); err != nil {
+			logger.FromContext(ctx).Error("Failed to record failed login", zap.Error(err))
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "Current password is incorrect")
+	}
+
+	if err := setPassword(redisClient, username, req.NewPassword); err != nil {
+		logger.FromContext(ctx).Error("Failed to change password", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to change password")
+	}
+	if err := storage.ClearLoginFailures(redisClient, accountLockoutKey(username)); err != nil {
+		logger.FromContext(ctx).Error("Failed to clear failed logins", zap.Error(err))
+	}
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionChangePassword, Actor: username, Success: true})
+
+	return startSession(redisClient, username)
+}
+
+// RequestPasswordReset sends the user a single use reset token. It answers
+// the same for unknown users, and while a user's previous token is still in
+// its cooldown.
+func (s *ChatServer) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.Empty, error) {
+	if req.Username == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Username must not be empty")
+	}
+	redisClient := s.redisFor(ctx)
+	cfg := config.AppConfig.Auth.PasswordReset
+
+	hashedPassword, err := storage.GetUser(redisClient, req.Username)
+	if err == redis.Nil {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionRequestPasswordReset, Actor: req.Username, Reason: "unknown user"})
+		return &pb.Empty{}, nil
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to request password reset")
+	}
+	if hashedPassword == "" {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionRequestPasswordReset, Actor: req.Username, Reason: "single sign-on user"})
+		return &pb.Empty{}, nil
+	}
+
+	started, err := storage.StartPasswordResetCooldown(redisClient, req.Username, cfg.Cooldown)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to start password reset cooldown", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to request password reset")
+	}
+	if !started {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionRequestPasswordReset, Actor: req.Username, Reason: "cooldown"})
+		return &pb.Empty{}, nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logger.FromContext(ctx).Error("Failed to generate reset token", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to request password reset")
+	}
+	token := hex.EncodeToString(secret)
+	if err := storage.SavePasswordReset(redisClient, hashSecret(token), req.Username, cfg.TokenTTL); err != nil {
+		logger.FromContext(ctx).Error("Failed to save reset token", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to request password reset")
+	}
+
+	err = s.notifier.Notify(ctx, &notifier.Message{
+		To:      req.Username,
+		Subject: "Password reset",
+		Body:    fmt.Sprintf("Someone asked to reset your password. If it was you, use this token within %s: %s", cfg.TokenTTL, token),
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to send reset token", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to request password reset")
+	}
+
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionRequestPasswordReset, Actor: req.Username, Success: true})
+	return &pb.Empty{}, nil
+}
+
+// ResetPassword sets a new password with a token from RequestPasswordReset
+// and ends the user's session. It also lifts a login lockout of the account.
+func (s *ChatServer) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*pb.Empty, error) {
+	redisClient := s.redisFor(ctx)
+	tokenHash := hashSecret(req.Token)
+
+	username, err := storage.GetPasswordReset(redisClient, tokenHash)
+	if err == redis.Nil || req.Token == "" {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionResetPassword, Reason: "invalid token"})
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid or expired reset token")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to get reset token", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to reset password")
+	}
+	// checked before the token is used up, so a rejected password can be retried
+	if err := validatePassword(username, req.NewPassword); err != nil {
+		return nil, err
+	}
+
+	// a token used at the same time by another request counts as invalid
+	if _, err := storage.TakePasswordReset(redisClient, tokenHash); err == redis.Nil {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionResetPassword, Actor: username, Reason: "invalid token"})
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid or expired reset token")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to take reset token", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to reset password")
+	}
+
+	if err := setPassword(redisClient, username, req.NewPassword); err != nil {
+		logger.FromContext(ctx).Error("Failed to reset password", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to reset password")
+	}
+	if err := storage.ClearLoginFailures(redisClient, accountLockoutKey(username)); err != nil {
+		logger.FromContext(ctx).Error("Failed to clear failed logins", zap.Error(err))
+	}
+
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionResetPassword, Actor: username, Success: true})
+	return &pb.Empty{}, nil
+}
@@ -0,0 +1,169 @@
+package chat
+
+import (
+	"chat_app/config"
+	"chat_app/internal/notifier"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidatePassword(t *testing.T) {
+	newTestServer(t)
+	setConfig(t, &config.AppConfig.Auth.Password, config.PasswordConfig{
+		MinLength: 8, MaxLength: 72,
+		RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true,
+		RejectUsername: true,
+	})
+
+	tests := []struct {
+		password string
+		// part of the error message, "" if the password is fine
+		want string
+	}{
+		{"Passw0rd!", ""},
+		{"Ünïcödé1 ok", ""},
+		{"Sh0rt!", "8 to 72 bytes"},
+		{"Aa1!" + strings.Repeat("x", 69), "8 to 72 bytes"},
+		// multibyte characters count in bytes
+		{"Aa1!" + strings.Repeat("é", 35), "8 to 72 bytes"},
+		{"password1!", "an uppercase letter"},
+		{"PASSWORD1!", "a lowercase letter"},
+		{"Password!!", "a digit"},
+		{"Password12", "a symbol"},
+		{"password", "an uppercase letter, a digit, a symbol"},
+		{"MyAlice123!", "must not contain the username"},
+	}
+	for _, tt := range tests {
+		err := validatePassword("alice", tt.password)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("validatePassword(%q): %v", tt.password, err)
+			}
+			continue
+		}
+		if status.Code(err) != codes.InvalidArgument || !strings.Contains(status.Convert(err).Message(), tt.want) {
+			t.Errorf("validatePassword(%q) = %v, want %q", tt.password, err, tt.want)
+		}
+	}
+
+	setConfig(t, &config.AppConfig.Auth.Password, config.PasswordConfig{MinLength: 8, MaxLength: 72})
+	if err := validatePassword("alice", "alice-all-lowercase"); err != nil {
+		t.Errorf("with no character rules: %v", err)
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	newTestServer(t)
+	setConfig(t, &config.AppConfig.Auth.Username, config.UsernameConfig{MinLength: 3, MaxLength: 8})
+
+	for _, username := range []string{"bob", "a_b-c", "Alice123"} {
+		if err := validateUsername(username); err != nil {
+			t.Errorf("validateUsername(%q): %v", username, err)
+		}
+	}
+	for _, username := range []string{"", "ab", "toolongname", "a b", "al:ce", "bob*", "ålice"} {
+		if err := validateUsername(username); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("validateUsername(%q) = %v", username, err)
+		}
+	}
+}
+
+// testNotifier keeps the messages it was asked to send
+type testNotifier struct {
+	mu       sync.Mutex
+	messages []*notifier.Message
+}
+
+func (n *testNotifier) Notify(ctx context.Context, msg *notifier.Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, msg)
+	return nil
+}
+
+func (n *testNotifier) Close() error { return nil }
+
+func TestPasswordReset(t *testing.T) {
+	s, _ := newTestServer(t)
+	notes := &testNotifier{}
+	s.notifier = notes
+	registerUser(t, s, "alice")
+	session, err := storage.GetToken(s.redisClient, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.RequestPasswordReset(context.Background(), &pb.RequestPasswordResetRequest{Username: "nobody"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RequestPasswordReset(context.Background(), &pb.RequestPasswordResetRequest{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	// within the cooldown, and answered alike
+	if _, err := s.RequestPasswordReset(context.Background(), &pb.RequestPasswordResetRequest{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(notes.messages) != 1 || notes.messages[0].To != "alice" {
+		t.Fatalf("got messages %v", notes.messages)
+	}
+	body := notes.messages[0].Body
+	token := body[strings.LastIndex(body, " ")+1:]
+
+	_, err = s.ResetPassword(context.Background(), &pb.ResetPasswordRequest{Token: "not-the-token", NewPassword: "Different456!"})
+	wantCode(t, "wrong token", err, codes.Unauthenticated)
+	_, err = s.ResetPassword(context.Background(), &pb.ResetPasswordRequest{Token: token, NewPassword: "weak"})
+	wantCode(t, "weak password", err, codes.InvalidArgument)
+	_, err = s.ResetPassword(context.Background(), &pb.ResetPasswordRequest{Token: token, NewPassword: "Different456!"})
+	wantCode(t, "reset", err, codes.OK)
+	_, err = s.ResetPassword(context.Background(), &pb.ResetPasswordRequest{Token: token, NewPassword: "Another789!"})
+	wantCode(t, "token used twice", err, codes.Unauthenticated)
+
+	_, err = s.Authenticate(context.Background(), session)
+	wantCode(t, "session from before the reset", err, codes.Unauthenticated)
+	_, err = s.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: testPassword})
+	wantCode(t, "old password", err, codes.Unauthenticated)
+	_, err = s.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "Different456!"})
+	wantCode(t, "new password", err, codes.OK)
+}
+
+func TestPasswordResetRevokesOtherTokens(t *testing.T) {
+	s, _ := newTestServer(t)
+	notes := &testNotifier{}
+	s.notifier = notes
+	setConfig(t, &config.AppConfig.Auth.PasswordReset.Cooldown, 0)
+	registerUser(t, s, "alice")
+
+	resetToken := func() string {
+		t.Helper()
+		if _, err := s.RequestPasswordReset(context.Background(), &pb.RequestPasswordResetRequest{Username: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		body := notes.messages[len(notes.messages)-1].Body
+		return body[strings.LastIndex(body, " ")+1:]
+	}
+
+	older, newer := resetToken(), resetToken()
+	_, err := s.ResetPassword(context.Background(), &pb.ResetPasswordRequest{Token: newer, NewPassword: "Different456!"})
+	wantCode(t, "reset with the newer token", err, codes.OK)
+	_, err = s.ResetPassword(context.Background(), &pb.ResetPasswordRequest{Token: older, NewPassword: "Attacker789!"})
+	wantCode(t, "reset with the older token", err, codes.Unauthenticated)
+
+	// a password change revokes them as well
+	leaked := resetToken()
+	resp, err := s.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: "Different456!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ChangePassword(authenticated(t, s, resp.Token), &pb.ChangePasswordRequest{CurrentPassword: "Different456!", NewPassword: "Another789!"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.ResetPassword(context.Background(), &pb.ResetPasswordRequest{Token: leaked, NewPassword: "Attacker789!"})
+	wantCode(t, "reset after a password change", err, codes.Unauthenticated)
+}
@@ -0,0 +1,109 @@
+package chat
+
+import (
+	pb "chat_app/pb"
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestReadCursors(t *testing.T) {
+	s, _ := newTestServer(t)
+	alice := registerUser(t, s, "alice")
+	bob := registerUser(t, s, "bob")
+	joinRoom(t, s, "bob", "general")
+	joinRoom(t, s, "bob", "random")
+	for _, text := range []string{"one", "two", "three"} {
+		post(t, s, alice, "general", text)
+	}
+
+	unread := func() map[string]int64 {
+		t.Helper()
+		resp, err := s.ListRooms(bob, &pb.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int64)
+		for _, room := range resp.Rooms {
+			counts[room.Name] = room.UnreadCount
+		}
+		return counts
+	}
+	markRead := func(seq int64) {
+		t.Helper()
+		if _, err := s.MarkRead(bob, &pb.MarkReadRequest{Room: "general", Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := unread(); len(got) != 2 || got["general"] != 3 || got["random"] != 0 {
+		t.Errorf("before reading: %v", got)
+	}
+	markRead(2)
+	if got := unread()["general"]; got != 1 {
+		t.Errorf("read up to 2: %d unread", got)
+	}
+	// the cursor never moves back
+	markRead(1)
+	if got := unread()["general"]; got != 1 {
+		t.Errorf("read up to 1 after 2: %d unread", got)
+	}
+	// zero reads everything
+	markRead(0)
+	if got := unread()["general"]; got != 0 {
+		t.Errorf("read everything: %d unread", got)
+	}
+	post(t, s, alice, "general", "four")
+	if got := unread()["general"]; got != 1 {
+		t.Errorf("after a new message: %d unread", got)
+	}
+	// a seq past the end is the end, so the next message still counts
+	markRead(100)
+	post(t, s, alice, "general", "five")
+	if got := unread()["general"]; got != 1 {
+		t.Errorf("after reading past the end: %d unread", got)
+	}
+
+	_, err := s.MarkRead(bob, &pb.MarkReadRequest{})
+	wantCode(t, "no room", err, codes.InvalidArgument)
+	_, err = s.MarkRead(context.Background(), &pb.MarkReadRequest{Room: "general"})
+	wantCode(t, "no user", err, codes.Unauthenticated)
+}
+
+func TestReadReceiptsAreOptIn(t *testing.T) {
+	s, _ := newTestServer(t)
+	alice := registerUser(t, s, "alice")
+	bob := registerUser(t, s, "bob")
+	carol := registerUser(t, s, "carol")
+
+	receipts := streamMessages(t, s, bob, &pb.StreamMessagesRequest{Room: "general", ReadReceipts: true})
+	noReceipts := streamMessages(t, s, carol, &pb.StreamMessagesRequest{Room: "general"})
+	post(t, s, alice, "general", "hello")
+	if _, err := s.MarkRead(carol, &pb.MarkReadRequest{Room: "general"}); err != nil {
+		t.Fatal(err)
+	}
+	post(t, s, alice, "general", "bye")
+
+	// bob sees carol join, the message, carol's receipt and the next message
+	var got []pb.EventType
+	for len(got) < 4 {
+		msg := receipts.next(t)
+		got = append(got, msg.Type)
+		if msg.Type == pb.EventType_EVENT_READ_RECEIPT && (msg.User != "carol" || msg.Seq != 1) {
+			t.Errorf("got receipt %v", msg)
+		}
+	}
+	want := []pb.EventType{pb.EventType_EVENT_JOIN, pb.EventType_EVENT_MESSAGE, pb.EventType_EVENT_READ_RECEIPT, pb.EventType_EVENT_MESSAGE}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("with read receipts: got %v, want %v", got, want)
+		}
+	}
+	// carol does not
+	for _, text := range []string{"hello", "bye"} {
+		if msg := noReceipts.next(t); msg.Type != pb.EventType_EVENT_MESSAGE || msg.Message != text {
+			t.Errorf("without read receipts: got %v, want %q", msg, text)
+		}
+	}
+}
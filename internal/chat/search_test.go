@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"chat_app/internal/search"
+	pb "chat_app/pb"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestSearchMessages(t *testing.T) {
+	for _, backend := range []string{"redis", "memory"} {
+		t.Run(backend, func(t *testing.T) {
+			s, _ := newTestServer(t)
+			index, err := search.NewIndex(backend, s.redisClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.searchIndex = index
+			testSearchMessages(t, s)
+		})
+	}
+}
+
+func testSearchMessages(t *testing.T, s *ChatServer) {
+	alice := registerUser(t, s, "alice")
+	bob := registerUser(t, s, "bob")
+	joinRoom(t, s, "alice", "general")
+	joinRoom(t, s, "alice", "secret")
+	joinRoom(t, s, "bob", "general")
+
+	for _, msg := range []*pb.ChatMessage{
+		{Room: "general", Message: "deploy is done", Timestamp: 1000},
+		{Room: "general", Message: "who broke the deploy?", Timestamp: 2000},
+		{Room: "secret", Message: "deploy the surprise", Timestamp: 1500},
+	} {
+		if err := s.PostMessage(alice, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PostMessage(bob, &pb.ChatMessage{Room: "general", Message: "deploy again", Timestamp: 3000}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  *pb.SearchMessagesRequest
+		want []string
+	}{
+		{"rooms alice is in", &pb.SearchMessagesRequest{Query: "deploy"}, []string{"deploy is done", "who broke the deploy?", "deploy the surprise", "deploy again"}},
+		{"one room", &pb.SearchMessagesRequest{Query: "deploy", Room: "secret"}, []string{"deploy the surprise"}},
+		{"one author", &pb.SearchMessagesRequest{Query: "deploy", User: "bob"}, []string{"deploy again"}},
+		{"time range", &pb.SearchMessagesRequest{Query: "deploy", Since: 1200, Until: 2500}, []string{"who broke the deploy?", "deploy the surprise"}},
+		{"no match", &pb.SearchMessagesRequest{Query: "lunch"}, nil},
+	}
+	for _, tt := range tests {
+		resp, err := s.SearchMessages(alice, tt.req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !sameMessages(resp.Messages, tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, resp.Messages, tt.want)
+		}
+	}
+
+	// bob is not in the secret room, so its messages never show up for him
+	resp, err := s.SearchMessages(bob, &pb.SearchMessagesRequest{Query: "deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameMessages(resp.Messages, []string{"deploy is done", "who broke the deploy?", "deploy again"}) {
+		t.Errorf("bob got %v", resp.Messages)
+	}
+	_, err = s.SearchMessages(bob, &pb.SearchMessagesRequest{Query: "deploy", Room: "secret"})
+	wantCode(t, "search a room bob is not in", err, codes.PermissionDenied)
+}
+
+// sameMessages reports whether messages has exactly the texts in want, in any order
+func sameMessages(messages []*pb.ChatMessage, want []string) bool {
+	if len(messages) != len(want) {
+		return false
+	}
+	left := make(map[string]int)
+	for _, text := range want {
+		left[text]++
+	}
+	for _, msg := range messages {
+		if left[msg.Message] == 0 {
+			return false
+		}
+		left[msg.Message]--
+	}
+	return true
+}
@@ -1,120 +1,689 @@
 package chat
 
 import (
+	"chat_app/config"
+	"chat_app/internal/audit"
+	"chat_app/internal/blob"
 	"chat_app/internal/logger"
+	"chat_app/internal/markdown"
+	"chat_app/internal/metrics"
+	"chat_app/internal/notifier"
 	"chat_app/internal/ratelimit"
+	"chat_app/internal/search"
+	"chat_app/internal/sso"
 	"chat_app/internal/storage"
+	"chat_app/internal/tracing"
+	"chat_app/internal/webhook"
 	pb "chat_app/pb"
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	// "chat_app/internal/storage"
 )
 
+const (
+	// presence keys expire unless the stream refreshes them
+	presenceTTL       = 30 * time.Second
+	heartbeatInterval = 10 * time.Second
+	typingTTL         = 5 * time.Second
+)
+
 type ChatServer struct {
 	pb.UnimplementedChatServiceServer
 	rateLimiter *ratelimit.RateLimiter
 	redisClient *redis.Client
+	searchIndex search.Index
+	blobStore   blob.Store
+	webhooks    *webhook.Dispatcher
+	commands    *CommandRegistry
+	bannedWords bannedWords
+	history     atomic.Pointer[config.HistoryConfig]
+	auditLog    *audit.Log
+	notifier    notifier.Notifier
+	// nil unless single sign-on is configured
+	sso *sso.Provider
+
+	// closed by GoingAway when the server shuts down
+	goingAway     chan struct{}
+	goingAwayOnce sync.Once
 }
 
-func NewChatServer(rateLimiter *ratelimit.RateLimiter, redisClient *redis.Client) *ChatServer {
-	return &ChatServer{
+func NewChatServer(rateLimiter *ratelimit.RateLimiter, redisClient *redis.Client, searchIndex search.Index, blobStore blob.Store, webhooks *webhook.Dispatcher, auditLog *audit.Log, notifier notifier.Notifier, ssoProvider *sso.Provider) *ChatServer {
+	s := &ChatServer{
 		rateLimiter: rateLimiter,
 		redisClient: redisClient,
+		searchIndex: searchIndex,
+		blobStore:   blobStore,
+		webhooks:    webhooks,
+		auditLog:    auditLog,
+		notifier:    notifier,
+		sso:         ssoProvider,
+		commands:    NewCommandRegistry(),
+		goingAway:   make(chan struct{}),
 	}
+	s.registerBuiltinCommands()
+	s.SetBannedWords(config.AppConfig.Moderation.BannedWords)
+	s.SetHistory(config.AppConfig.History)
+	return s
+}
+
+// SetHistory changes how many messages are kept and replayed per room. Like
+// SetBannedWords it is safe to call while the server is running.
+func (s *ChatServer) SetHistory(history config.HistoryConfig) {
+	s.history.Store(&history)
+}
+
+// redisFor returns the Redis client bound to ctx, so storage calls made for a
+// request are traced as part of it
+func (s *ChatServer) redisFor(ctx context.Context) *redis.Client {
+	return s.redisClient.WithContext(ctx)
 }
 
 func (s *ChatServer) SendMessage(ctx context.Context, msg *pb.ChatMessage) (*pb.Empty, error) {
+	if err := s.PostMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+	return &pb.Empty{}, nil
+}
+
+// PostMessage validates, saves and publishes a message from the authenticated
+// user in ctx. It is the single publish path for gRPC and HTTP clients.
+func (s *ChatServer) PostMessage(ctx context.Context, msg *pb.ChatMessage) error {
 	if !s.rateLimiter.Allow() {
-		return nil, status.Errorf(codes.ResourceExhausted, "Rate limit exceeded")
+		return status.Errorf(codes.ResourceExhausted, "Rate limit exceeded")
+	}
+
+	sender, ok := UsernameFromContext(ctx)
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "No user in context")
 	}
+	// messages are always sent as the authenticated user
+	msg.User = sender
 
 	if err := ValidateMessage(msg); err != nil {
+		return err
+	}
+
+	if err := checkTokenScope(ctx, ScopeMessagesWrite, msg.Room); err != nil {
+		return err
+	}
+
+	// checked before commands run, so /me, /topic and /nick are covered too
+	if err := s.checkBannedWords(msg.Message); err != nil {
+		return err
+	}
+
+	// the type, recipient and formatting are decided by the server
+	msg.Type = pb.EventType_EVENT_MESSAGE
+	msg.Recipient = ""
+	msg.Segments = nil
+	msg.TraceContext = nil
+
+	if cmd, ok := parseCommand(msg); ok {
+		send, err := s.runCommand(ctx, cmd)
+		if err != nil || !send {
+			return err
+		}
+	}
+
+	LogMessageReceived(ctx, msg)
+
+	if err := s.resolveAttachments(ctx, sender, msg); err != nil {
+		return err
+	}
+
+	return s.saveAndPublish(ctx, sender, msg)
+}
+
+// saveAndPublish stores a validated message and delivers it to the room
+func (s *ChatServer) saveAndPublish(ctx context.Context, sender string, msg *pb.ChatMessage) error {
+	redisClient := s.redisFor(ctx)
+
+	if msg.Segments == nil {
+		msg.Segments = markdown.Parse(msg.Message)
+	}
+
+	nick, err := storage.GetNick(redisClient, msg.Room, sender)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get nick", zap.Error(err))
+	}
+	msg.Nick = nick
+
+	if err := storage.SaveMessage(redisClient, msg, s.history.Load().MaxMessages); err != nil {
+		logger.FromContext(ctx).Error("Failed to save message", zap.Error(err))
+		return status.Errorf(codes.Internal, "Failed to save message")
+	}
+
+	channel := fmt.Sprintf("chat_messages:%s", msg.Room)
+	if err := storage.PublishMessage(redisClient, channel, msg); err != nil {
+		logger.FromContext(ctx).Error("Failed to publish message", zap.Error(err))
+		return status.Errorf(codes.Internal, "Failed to publish message")
+	}
+	metrics.MessagesSent.WithLabelValues(msg.Type.String()).Inc()
+
+	if err := s.searchIndex.Index(msg); err != nil {
+		logger.FromContext(ctx).Error("Failed to index message", zap.Error(err))
+	}
+
+	s.notifyMentions(ctx, sender, msg)
+	s.webhooks.Dispatch(webhook.EventMessage, msg.Room, sender, msg)
+
+	// the sender has obviously read their own message
+	if err := storage.AddUserRoom(redisClient, sender, msg.Room); err != nil {
+		logger.FromContext(ctx).Error("Failed to record room membership", zap.Error(err))
+	}
+	if _, err := storage.SetReadCursor(redisClient, sender, msg.Room, msg.Seq); err != nil {
+		logger.FromContext(ctx).Error("Failed to update read cursor", zap.Error(err))
+	}
+
+	logger.FromContext(ctx).Info("Message sent", zap.String("user", msg.User), zap.String("room", msg.Room), zap.Int("length", len(msg.Message)))
+	return nil
+}
+
+func (s *ChatServer) EditMessage(ctx context.Context, req *pb.EditMessageRequest) (*pb.ChatMessage, error) {
+	msg, err := s.ownMessage(ctx, req.Room, req.Seq)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Message == "" && len(msg.Attachments) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Message must not be empty")
+	}
+	if err := s.checkBannedWords(req.Message); err != nil {
+		return nil, err
+	}
+
+	msg.Message = req.Message
+	msg.Segments = markdown.Parse(req.Message)
+	msg.EditedAt = time.Now().Unix()
+
+	if err := storage.UpdateMessage(s.redisFor(ctx), msg); err != nil {
+		logger.FromContext(ctx).Error("Failed to update message", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to edit message")
+	}
+
+	if err := s.searchIndex.Index(msg); err != nil {
+		logger.FromContext(ctx).Error("Failed to index message", zap.Error(err))
+	}
+
+	// subscribers get the whole message so they can replace their copy
+	event := proto.Clone(msg).(*pb.ChatMessage)
+	event.Type = pb.EventType_EVENT_EDIT
+	channel := fmt.Sprintf("chat_messages:%s", msg.Room)
+	if err := storage.PublishMessage(s.redisFor(ctx), channel, event); err != nil {
+		logger.FromContext(ctx).Error("Failed to publish edit", zap.Error(err))
+	}
+
+	s.webhooks.Dispatch(webhook.EventEdit, msg.Room, msg.User, msg)
+
+	logger.FromContext(ctx).Info("Message edited", zap.String("user", msg.User), zap.String("room", msg.Room), zap.Int64("seq", msg.Seq))
+	return msg, nil
+}
+
+func (s *ChatServer) DeleteMessage(ctx context.Context, req *pb.DeleteMessageRequest) (*pb.Empty, error) {
+	msg, err := s.ownMessage(ctx, req.Room, req.Seq)
+	if err != nil {
 		return nil, err
 	}
 
-	LogMessageReceived(msg)
+	if err := storage.DeleteMessage(s.redisFor(ctx), msg.Room, msg.Seq); err != nil {
+		logger.FromContext(ctx).Error("Failed to delete message", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to delete message")
+	}
 
-	if err := storage.SaveMessage(s.redisClient, msg); err != nil {
-		logger.Log.Error("Failed to save message", zap.Error(err))
-		return nil, status.Errorf(codes.Internal, "Failed to save message")
+	if err := s.searchIndex.Remove(msg.Id); err != nil {
+		logger.FromContext(ctx).Error("Failed to remove message from index", zap.Error(err))
 	}
 
 	channel := fmt.Sprintf("chat_messages:%s", msg.Room)
-	if err := storage.PublishMessage(s.redisClient, channel, msg); err != nil {
-		logger.Log.Error("Failed to publish message", zap.Error(err))
-		return nil, status.Errorf(codes.Internal, "Failed to publish message")
+	err = storage.PublishMessage(s.redisFor(ctx), channel, &pb.ChatMessage{
+		User:      msg.User,
+		Timestamp: time.Now().Unix(),
+		Room:      msg.Room,
+		Type:      pb.EventType_EVENT_DELETE,
+		Id:        msg.Id,
+		Seq:       msg.Seq,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to publish delete", zap.Error(err))
 	}
 
-	logger.Log.Info("Message sent", zap.String("user", msg.User), zap.String("room", msg.Room), zap.String("message", msg.Message))
+	s.webhooks.Dispatch(webhook.EventDelete, msg.Room, msg.User, msg)
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionDeleteMessage, Actor: msg.User, Target: msg.Id, Room: msg.Room, Success: true})
+
+	logger.FromContext(ctx).Info("Message deleted", zap.String("user", msg.User), zap.String("room", msg.Room), zap.Int64("seq", msg.Seq))
 	return &pb.Empty{}, nil
 }
 
+// ownMessage loads a message from the room history, checking that the authenticated user wrote it
+func (s *ChatServer) ownMessage(ctx context.Context, room string, seq int64) (*pb.ChatMessage, error) {
+	if room == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Room must not be empty")
+	}
+
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	msg, err := storage.GetMessage(s.redisFor(ctx), room, seq)
+	if err == redis.Nil {
+		return nil, status.Errorf(codes.NotFound, "Message not found")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to get message", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to get message")
+	}
+
+	if msg.User != username {
+		return nil, status.Errorf(codes.PermissionDenied, "Only the author can change a message")
+	}
+	return msg, nil
+}
+
 func (s *ChatServer) StreamMessages(req *pb.StreamMessagesRequest, stream pb.ChatService_StreamMessagesServer) error {
-	logger.Log.Info("New client connected to message stream", zap.String("room,", req.Room))
+	ctx := stream.Context()
+	logger.FromContext(ctx).Info("New client connected to message stream", zap.String("room,", req.Room))
+
+	username, _ := UsernameFromContext(ctx)
+	if err := checkTokenScope(stream.Context(), ScopeMessagesRead, req.Room); err != nil {
+		return err
+	}
 
-	lastMessages, err := storage.GetLastNMessages(s.redisClient, req.Room, 15)
+	lastMessages, err := storage.GetLastNMessages(s.redisFor(ctx), req.Room, s.history.Load().Replay)
 	if err != nil {
-		logger.Log.Error("Failed to fetch last messages", zap.Error(err))
+		logger.FromContext(stream.Context()).Error("Failed to fetch last messages", zap.Error(err))
 	} else {
 		// send last messages to the client
 		for _, msg := range lastMessages {
 			if err := stream.Send(msg); err != nil {
-				LogStreamEnded(err)
+				LogStreamEnded(stream.Context(), err)
 				return err
 			}
 		}
 	}
 
 	channel := fmt.Sprintf("chat_messages:%s", req.Room)
-	pubsub := storage.SubscribeToMessages(s.redisClient, channel)
+	pubsub := storage.SubscribeToMessages(s.redisFor(ctx), channel)
 	defer pubsub.Close()
 
 	ch := pubsub.Channel()
 
-	for msg := range ch {
-		var chatMessage pb.ChatMessage
-		if err := json.Unmarshal([]byte(msg.Payload), &chatMessage); err != nil {
-			logger.Log.Error("Failed to unmarshal message", zap.Error(err))
-			continue
+	if username != "" {
+		if err := storage.AddUserRoom(s.redisFor(ctx), username, req.Room); err != nil {
+			logger.FromContext(stream.Context()).Error("Failed to record room membership", zap.Error(err))
 		}
+		s.joinRoom(ctx, req.Room, username)
+		// the stream's context is canceled by the time it ends
+		defer s.leaveRoom(context.WithoutCancel(ctx), req.Room, username)
+	}
 
-		if err := stream.Send(&chatMessage); err != nil {
-			LogStreamEnded(err)
-			return err
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			LogStreamEnded(stream.Context(), nil)
+			return nil
+		case <-s.goingAway:
+			stream.Send(&pb.ChatMessage{
+				Type:      pb.EventType_EVENT_GOING_AWAY,
+				Room:      req.Room,
+				Message:   "Server is going away, please reconnect",
+				Timestamp: time.Now().Unix(),
+			})
+			LogStreamEnded(stream.Context(), nil)
+			return errShuttingDown
+		case <-heartbeat.C:
+			if username == "" {
+				continue
+			}
+			if err := storage.SetPresence(s.redisFor(ctx), req.Room, username, presenceTTL); err != nil {
+				logger.FromContext(stream.Context()).Error("Failed to refresh presence", zap.Error(err), zap.String("room", req.Room))
+			}
+		case msg, ok := <-ch:
+			if !ok {
+				LogStreamEnded(stream.Context(), nil)
+				return nil
+			}
+
+			var chatMessage pb.ChatMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &chatMessage); err != nil {
+				logger.FromContext(stream.Context()).Error("Failed to unmarshal message", zap.Error(err))
+				continue
+			}
+
+			if chatMessage.Type == pb.EventType_EVENT_READ_RECEIPT && !req.ReadReceipts {
+				continue
+			}
+			if chatMessage.Recipient != "" && chatMessage.Recipient != username {
+				continue
+			}
+
+			// delivery is traced as part of the sender's request, and linked to
+			// the stream; events published outside a request are not traced
+			_, span := tracing.Start(tracing.Extract(context.Background(), chatMessage.TraceContext), "chat.deliver",
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithLinks(trace.LinkFromContext(stream.Context())),
+				trace.WithAttributes(attribute.String("chat.room", req.Room), attribute.String("chat.user", username)),
+			)
+			chatMessage.TraceContext = nil
+
+			err := stream.Send(&chatMessage)
+			span.End()
+			if err != nil {
+				LogStreamEnded(stream.Context(), err)
+				return err
+			}
 		}
 	}
+}
 
-	LogStreamEnded(nil)
-	return nil
+var errShuttingDown = status.Error(codes.Unavailable, "Server is shutting down")
+
+// GoingAway ends every message and notification stream, telling message
+// streams first with an EVENT_GOING_AWAY event, so the gRPC and HTTP servers
+// can drain. Streams opened afterwards end straight away.
+func (s *ChatServer) GoingAway() {
+	s.goingAwayOnce.Do(func() {
+		close(s.goingAway)
+	})
+}
+
+func (s *ChatServer) SetTyping(ctx context.Context, req *pb.TypingRequest) (*pb.Empty, error) {
+	if req.Room == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Room must not be empty")
+	}
+
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	if err := storage.SetTyping(s.redisFor(ctx), req.Room, username, req.Typing, typingTTL); err != nil {
+		logger.FromContext(ctx).Error("Failed to update typing state", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to update typing state")
+	}
+
+	eventType := pb.EventType_EVENT_TYPING_STOP
+	if req.Typing {
+		eventType = pb.EventType_EVENT_TYPING_START
+	}
+	if err := s.publishEvent(ctx, req.Room, username, eventType); err != nil {
+		logger.FromContext(ctx).Error("Failed to publish typing event", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to publish typing event")
+	}
+
+	return &pb.Empty{}, nil
+}
+
+func (s *ChatServer) ListRoomMembersOnline(ctx context.Context, req *pb.ListRoomMembersOnlineRequest) (*pb.ListRoomMembersOnlineResponse, error) {
+	if req.Room == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Room must not be empty")
+	}
+
+	online, err := storage.GetOnlineUsers(s.redisFor(ctx), req.Room, presenceTTL)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to list online members", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to list online members")
+	}
+
+	sort.Slice(online, func(i, j int) bool { return online[i].Username < online[j].Username })
+
+	resp := &pb.ListRoomMembersOnlineResponse{}
+	for _, p := range online {
+		resp.Members = append(resp.Members, &pb.RoomMember{
+			Username: p.Username,
+			LastSeen: p.LastSeen,
+			Typing:   p.Typing,
+		})
+	}
+	return resp, nil
+}
+
+func (s *ChatServer) MarkRead(ctx context.Context, req *pb.MarkReadRequest) (*pb.Empty, error) {
+	if req.Room == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Room must not be empty")
+	}
+
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	latest, err := storage.GetRoomSeq(s.redisFor(ctx), req.Room)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get room sequence", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to mark room as read")
+	}
+
+	// zero means everything up to now
+	seq := req.Seq
+	if seq == 0 || seq > latest {
+		seq = latest
+	}
+
+	cursor, err := storage.SetReadCursor(s.redisFor(ctx), username, req.Room, seq)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to update read cursor", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to mark room as read")
+	}
+
+	channel := fmt.Sprintf("chat_messages:%s", req.Room)
+	err = storage.PublishMessage(s.redisFor(ctx), channel, &pb.ChatMessage{
+		User:      username,
+		Timestamp: time.Now().Unix(),
+		Room:      req.Room,
+		Type:      pb.EventType_EVENT_READ_RECEIPT,
+		Seq:       cursor,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to publish read receipt", zap.Error(err))
+	}
+
+	return &pb.Empty{}, nil
+}
+
+func (s *ChatServer) ListRooms(ctx context.Context, req *pb.Empty) (*pb.ListRoomsResponse, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	rooms, err := storage.GetUserRooms(s.redisFor(ctx), username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to list rooms", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to list rooms")
+	}
+
+	resp := &pb.ListRoomsResponse{}
+	for _, room := range rooms {
+		latest, err := storage.GetRoomSeq(s.redisFor(ctx), room)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to get room sequence", zap.Error(err))
+			return nil, status.Errorf(codes.Internal, "Failed to list rooms")
+		}
+
+		cursor, err := storage.GetReadCursor(s.redisFor(ctx), username, room)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to get read cursor", zap.Error(err))
+			return nil, status.Errorf(codes.Internal, "Failed to list rooms")
+		}
+
+		unread := latest - cursor
+		if unread < 0 {
+			unread = 0
+		}
+
+		topic, err := storage.GetRoomTopic(s.redisFor(ctx), room)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to get topic", zap.Error(err))
+			return nil, status.Errorf(codes.Internal, "Failed to list rooms")
+		}
+
+		resp.Rooms = append(resp.Rooms, &pb.RoomInfo{
+			Name:        room,
+			LastSeq:     latest,
+			UnreadCount: unread,
+			Topic:       topic,
+		})
+	}
+
+	return resp, nil
+}
+
+func (s *ChatServer) SearchMessages(ctx context.Context, req *pb.SearchMessagesRequest) (*pb.SearchMessagesResponse, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	// only search rooms the user has joined
+	rooms, err := storage.GetUserRooms(s.redisFor(ctx), username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to list rooms", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to search messages")
+	}
+
+	if req.Room != "" {
+		if !containsString(rooms, req.Room) {
+			return nil, status.Errorf(codes.PermissionDenied, "Not a member of room %s", req.Room)
+		}
+		rooms = []string{req.Room}
+	}
+
+	results, err := s.searchIndex.Search(search.Query{
+		Text:  req.Query,
+		Rooms: rooms,
+		User:  req.User,
+		Since: req.Since,
+		Until: req.Until,
+		Limit: int(req.Limit),
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to search messages", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to search messages")
+	}
+
+	return &pb.SearchMessagesResponse{Messages: results}, nil
+}
+
+// joinRoom counts a new stream of the user and announces them when it is their first
+func (s *ChatServer) joinRoom(ctx context.Context, room, username string) {
+	connections, err := storage.AddPresence(s.redisFor(ctx), room, username, presenceTTL)
+	if err != nil {
+		logger.Log.Error("Failed to set presence", zap.Error(err), zap.String("room", room))
+	} else if connections > 1 {
+		return
+	}
+	if err := s.publishEvent(ctx, room, username, pb.EventType_EVENT_JOIN); err != nil {
+		logger.Log.Error("Failed to publish join event", zap.Error(err), zap.String("room", room))
+	}
+	s.webhooks.Dispatch(webhook.EventJoin, room, username, nil)
+}
+
+// leaveRoom closes one stream of the user and announces they left when it was their last
+func (s *ChatServer) leaveRoom(ctx context.Context, room, username string) {
+	connections, err := storage.RemovePresence(s.redisFor(ctx), room, username)
+	if err != nil {
+		logger.Log.Error("Failed to remove presence", zap.Error(err), zap.String("room", room))
+	} else if connections > 0 {
+		return
+	}
+	if err := s.publishEvent(ctx, room, username, pb.EventType_EVENT_LEAVE); err != nil {
+		logger.Log.Error("Failed to publish leave event", zap.Error(err), zap.String("room", room))
+	}
+}
+
+// publishEvent sends an ephemeral event to the room's subscribers without saving it to history
+func (s *ChatServer) publishEvent(ctx context.Context, room, username string, eventType pb.EventType) error {
+	channel := fmt.Sprintf("chat_messages:%s", room)
+	return storage.PublishMessage(s.redisFor(ctx), channel, &pb.ChatMessage{
+		User:      username,
+		Timestamp: time.Now().Unix(),
+		Room:      room,
+		Type:      eventType,
+	})
 }
 
 func (s *ChatServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.AuthResponse, error) {
-	return HandleRegister(s.redisClient, req)
+	return HandleRegister(s.redisFor(ctx), s.auditLog, req)
 }
 
 func (s *ChatServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.AuthResponse, error) {
-	return HandleLogin(s.redisClient, req)
+	return HandleLogin(s.redisFor(ctx), s.auditLog, req)
 }
 
 func (s *ChatServer) AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	logger.Log.Info("AuthInterceptor called for method", zap.String("method", info.FullMethod))
-	if info.FullMethod == "/chat.ChatService/Login" || info.FullMethod == "/chat.ChatService/Register" {
-		logger.Log.Info("Hit login or register point")
+	if IsPublicMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	if isHealthCheck(info.FullMethod) {
 		return handler(ctx, req)
 	}
 
+	newCtx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(newCtx, req)
+}
+
+func (s *ChatServer) StreamAuthInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if isHealthCheck(info.FullMethod) {
+		return handler(srv, ss)
+	}
+
+	newCtx, err := s.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: newCtx})
+}
+
+// publicMethods are the RPCs that can be called without a token
+var publicMethods = map[string]bool{
+	"/chat.ChatService/Login":                true,
+	"/chat.ChatService/Register":             true,
+	"/chat.ChatService/RequestPasswordReset": true,
+	"/chat.ChatService/ResetPassword":        true,
+	"/chat.ChatService/VerifyTwoFactor":      true,
+	"/chat.ChatService/LoginOIDC":            true,
+}
+
+func IsPublicMethod(method string) bool {
+	return publicMethods[method]
+}
+
+// isHealthCheck reports whether method belongs to grpc.health.v1, which probes call without a token
+func isHealthCheck(method string) bool {
+	return strings.HasPrefix(method, "/grpc.health.v1.Health/")
+}
+
+// authenticate verifies the token in the incoming metadata and returns a
+// context carrying the caller's identity
+func (s *ChatServer) authenticate(ctx context.Context, method string) (context.Context, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		logger.Log.Error("No metadata provided")
+		logger.FromContext(ctx).Error("No metadata provided")
 		return nil, status.Errorf(codes.Unauthenticated, "No metadata provided")
 	}
 
@@ -123,33 +692,141 @@ func (s *ChatServer) AuthInterceptor(ctx context.Context, req interface{}, info
 		return nil, status.Errorf(codes.Unauthenticated, "No token provided")
 	}
 
+	newCtx, err := s.authenticateToken(ctx, token[0], method)
+	if err != nil {
+		return nil, err
+	}
+
+	// bots can only reach the RPCs their token is scoped for
+	if apiToken, isBot := newCtx.Value("apiToken").(*pb.APIToken); isBot {
+		if _, allowed := botMethodScopes[method]; !allowed {
+			s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionAuthenticate, Actor: apiToken.Bot, Target: method, Reason: "method not allowed for bots"})
+			return nil, status.Errorf(codes.PermissionDenied, "Bots may not call %s", method)
+		}
+	}
+
+	return newCtx, nil
+}
+
+// Authenticate checks a user session token or bot API token and returns ctx
+// with the caller's identity attached. The HTTP handlers call it directly
+// since they do not go through the interceptors.
+func (s *ChatServer) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	return s.authenticateToken(ctx, token, "")
+}
+
+// authenticateToken is Authenticate for a call of method, empty if the
+// caller is not an RPC
+func (s *ChatServer) authenticateToken(ctx context.Context, token, method string) (context.Context, error) {
+	newCtx, err := s.checkToken(ctx, token)
+	if status.Code(err) == codes.Unauthenticated {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionAuthenticate, Reason: status.Convert(err).Message()})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, isBot := newCtx.Value("apiToken").(*pb.APIToken); !isBot {
+		username, _ := UsernameFromContext(newCtx)
+		if err := s.checkTwoFactorRequired(newCtx, username, method); err != nil {
+			if status.Code(err) == codes.PermissionDenied {
+				s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionAuthenticate, Actor: username, Target: method, Reason: "two-factor authentication required"})
+			}
+			return nil, err
+		}
+	}
+	return newCtx, nil
+}
+
+// checkToken is Authenticate without auditing rejected tokens
+func (s *ChatServer) checkToken(ctx context.Context, token string) (context.Context, error) {
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		apiToken, err := s.authenticateAPIToken(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.AddFields(ctx, zap.String("user", apiToken.Bot), zap.String("apiToken", apiToken.Id))
+		ctx = context.WithValue(ctx, "apiToken", apiToken)
+		return context.WithValue(ctx, "username", apiToken.Bot), nil
+	}
+
+	username, err := s.authenticateSession(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.AddFields(ctx, zap.String("user", username))
+	return context.WithValue(ctx, "username", username), nil
+}
+
+// CheckSession returns an error once a token that passed Authenticate has
+// expired or been revoked, by a password change for instance. Connections that
+// outlive a request, like IRC clients, call it before acting for the user again.
+func (s *ChatServer) CheckSession(ctx context.Context, token string) error {
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		_, err := s.authenticateAPIToken(ctx, token)
+		return err
+	}
+	_, err := s.authenticateSession(ctx, token)
+	return err
+}
+
+// authenticateSession checks a user's session JWT and returns its username
+func (s *ChatServer) authenticateSession(ctx context.Context, token string) (string, error) {
 	claims := &jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(token[0], claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte("dogdogdog"), nil
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(config.AppConfig.Auth.JWTSecret), nil
 	})
 	if err != nil {
-		return nil, status.Errorf(codes.Unauthenticated, "Invalid token")
+		return "", status.Errorf(codes.Unauthenticated, "Invalid token")
 	}
 
-	username := (*claims)["username"].(string)
+	username, ok := (*claims)["username"].(string)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "Invalid token")
+	}
 
 	// verify token against redis
-	storedToken, err := storage.GetToken(s.redisClient, username)
+	storedToken, err := storage.GetToken(s.redisFor(ctx), username)
 	if err != nil {
 		if err == redis.Nil {
 			// token doesn't exist in redis
-			return nil, status.Errorf(codes.Unauthenticated, "Token not found or expired")
+			return "", status.Errorf(codes.Unauthenticated, "Token not found or expired")
 		}
 
 		// some other error occured
-		logger.Log.Error("Error retrieving token from redis: ", zap.Error(err))
-		return nil, status.Errorf(codes.Internal, "Error verifying token")
+		logger.FromContext(ctx).Error("Error retrieving token from redis: ", zap.Error(err))
+		return "", status.Errorf(codes.Internal, "Error verifying token")
 	}
 
-	if storedToken != token[0] {
-		return nil, status.Errorf(codes.Unauthenticated, "Invalid token")
+	if storedToken != token {
+		return "", status.Errorf(codes.Unauthenticated, "Invalid token")
 	}
 
-	newCtx := context.WithValue(ctx, "username", username)
-	return handler(newCtx, req)
+	return username, nil
+}
+
+// authenticatedStream overrides the stream context so handlers can see the authenticated user
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func UsernameFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value("username").(string)
+	return username, ok && username != ""
 }
@@ -0,0 +1,201 @@
+package chat
+
+import (
+	"chat_app/config"
+	"chat_app/internal/audit"
+	"chat_app/internal/blob"
+	"chat_app/internal/logger"
+	"chat_app/internal/notifier"
+	"chat_app/internal/ratelimit"
+	"chat_app/internal/search"
+	"chat_app/internal/storage"
+	"chat_app/internal/webhook"
+	pb "chat_app/pb"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testPassword = "Password123!"
+
+func newTestServer(t *testing.T) (*ChatServer, *miniredis.Miniredis) {
+	t.Helper()
+	if config.AppConfig == nil {
+		if err := config.LoadConfig(""); err != nil {
+			t.Fatal(err)
+		}
+		config.AppConfig.Logger.Level = "error"
+		if err := logger.InitLogger(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	blobStore, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks := webhook.NewDispatcher(redisClient, webhook.Options{MaxAttempts: 1, Timeout: time.Second, MaxConcurrent: 1})
+	s := NewChatServer(ratelimit.NewRateLimiter(rate.Inf, 100), redisClient, search.NewRedisIndex(redisClient), blobStore, webhooks, audit.NewLog(audit.NewRedisSink(redisClient, 0)), notifier.NewLogNotifier(), nil)
+	return s, mr
+}
+
+// setConfig changes a setting for the rest of the test
+func setConfig[T any](t *testing.T, setting *T, value T) {
+	old := *setting
+	*setting = value
+	t.Cleanup(func() { *setting = old })
+}
+
+// registerUser returns the context of a call made with the new user's session
+func registerUser(t *testing.T, s *ChatServer, username string) context.Context {
+	t.Helper()
+	resp, err := s.Register(context.Background(), &pb.RegisterRequest{Username: username, Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticated(t, s, resp.Token)
+}
+
+func authenticated(t *testing.T, s *ChatServer, token string) context.Context {
+	t.Helper()
+	ctx, err := s.Authenticate(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// joinRoom makes the user a member of room, as opening a stream does
+func joinRoom(t *testing.T, s *ChatServer, username, room string) {
+	t.Helper()
+	if err := storage.AddUserRoom(s.redisClient, username, room); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// post sends a message to room as the user of ctx
+func post(t *testing.T, s *ChatServer, ctx context.Context, room, text string) {
+	t.Helper()
+	if err := s.PostMessage(ctx, &pb.ChatMessage{Room: room, Message: text, Timestamp: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testStream is the server side of a stream, handing what is sent to the test
+type testStream[T any] struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan T
+}
+
+func (s *testStream[T]) Context() context.Context { return s.ctx }
+
+func (s *testStream[T]) Send(m T) error {
+	s.sent <- m
+	return nil
+}
+
+// next returns the next message sent on the stream
+func (s *testStream[T]) next(t *testing.T) T {
+	t.Helper()
+	var m T
+	select {
+	case m = <-s.sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing sent on the stream")
+	}
+	return m
+}
+
+// streamMessages opens a message stream as the user of ctx and returns once
+// its own join event arrives, which means the stream is subscribed to the room
+func streamMessages(t *testing.T, s *ChatServer, ctx context.Context, req *pb.StreamMessagesRequest) *testStream[*pb.ChatMessage] {
+	t.Helper()
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &testStream[*pb.ChatMessage]{ctx: ctx, sent: make(chan *pb.ChatMessage, 100)}
+	done := make(chan struct{})
+	go func() {
+		s.StreamMessages(req, stream)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	username, _ := UsernameFromContext(ctx)
+	for {
+		if msg := stream.next(t); msg.Type == pb.EventType_EVENT_JOIN && msg.User == username {
+			return stream
+		}
+	}
+}
+
+func wantCode(t *testing.T, what string, err error, want codes.Code) {
+	t.Helper()
+	if status.Code(err) != want {
+		t.Errorf("%s: got %v, want %s", what, err, want)
+	}
+}
+
+func TestLeavingOneStreamKeepsUserOnline(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx := registerUser(t, s, "alice")
+	events := storage.SubscribeToMessages(s.redisClient, "chat_messages:general")
+	defer events.Close()
+	if _, err := events.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	online := func() bool {
+		t.Helper()
+		resp, err := s.ListRoomMembersOnline(ctx, &pb.ListRoomMembersOnlineRequest{Room: "general"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(resp.Members) == 1 && resp.Members[0].Username == "alice"
+	}
+
+	s.joinRoom(ctx, "general", "alice")
+	s.joinRoom(ctx, "general", "alice")
+	s.leaveRoom(ctx, "general", "alice")
+	if !online() {
+		t.Error("alice is offline with a stream still open")
+	}
+	s.leaveRoom(ctx, "general", "alice")
+	if online() {
+		t.Error("alice is online after the last stream closed")
+	}
+
+	// one join and one leave were announced
+	var got []pb.EventType
+	for len(got) < 2 {
+		select {
+		case msg := <-events.Channel():
+			var event pb.ChatMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, event.Type)
+		case <-time.After(time.Second):
+			t.Fatalf("got events %v", got)
+		}
+	}
+	if got[0] != pb.EventType_EVENT_JOIN || got[1] != pb.EventType_EVENT_LEAVE {
+		t.Errorf("got events %v", got)
+	}
+	select {
+	case msg := <-events.Channel():
+		t.Errorf("got extra event %s", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"chat_app/config"
+	"chat_app/internal/audit"
+	"chat_app/internal/logger"
+	"chat_app/internal/metrics"
+	"chat_app/internal/sso"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// LoginOIDC logs in with an ID token the client got from the single sign-on
+// provider itself. Such tokens carry no nonce of ours, so to keep one that
+// leaked from being replayed, it must be recent and logs in only once.
+func (s *ChatServer) LoginOIDC(ctx context.Context, req *pb.LoginOIDCRequest) (*pb.AuthResponse, error) {
+	if s.sso == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Single sign-on is not configured")
+	}
+
+	identity, err := s.sso.Verify(ctx, req.IdToken, "")
+	if err != nil {
+		logger.FromContext(ctx).Info("Rejected ID token", zap.Error(err))
+		metrics.Logins.WithLabelValues("failure").Inc()
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionSSOLogin, Reason: "invalid id token"})
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid ID token")
+	}
+	if time.Since(identity.IssuedAt) > config.AppConfig.OIDC.MaxTokenAge {
+		metrics.Logins.WithLabelValues("failure").Inc()
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionSSOLogin, Actor: identity.Username, Target: identity.Subject, Reason: "id token too old"})
+		return nil, status.Errorf(codes.Unauthenticated, "ID token is too old, log in again")
+	}
+
+	// kept a little past the expiry for clocks that are behind
+	fresh, err := storage.UseIDToken(s.redisFor(ctx), hashSecret(req.IdToken), time.Until(identity.Expiry)+time.Minute)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to save used ID token", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to log in")
+	}
+	if !fresh {
+		metrics.Logins.WithLabelValues("failure").Inc()
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionSSOLogin, Actor: identity.Username, Target: identity.Subject, Reason: "id token reused"})
+		return nil, status.Errorf(codes.Unauthenticated, "ID token was already used, log in again")
+	}
+	return s.LoginSSO(ctx, identity)
+}
+
+// LoginSSO starts a session for a user the provider vouched for, creating
+// the user on their first login. The provider is trusted to have checked a
+// second factor, so two-factor authentication is not asked for.
+func (s *ChatServer) LoginSSO(ctx context.Context, identity *sso.Identity) (*pb.AuthResponse, error) {
+	redisClient := s.redisFor(ctx)
+
+	username, err := storage.GetSSOUser(redisClient, identity.Issuer, identity.Subject)
+	if err == redis.Nil {
+		username, err = s.provisionSSOUser(ctx, identity)
+		if err != nil {
+			metrics.Logins.WithLabelValues("failure").Inc()
+			s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionSSOLogin, Actor: identity.Username, Target: identity.Subject, Reason: status.Convert(err).Message()})
+			return nil, err
+		}
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to get single sign-on user", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to log in")
+	}
+
+	logger.AddFields(ctx, zap.String("user", username))
+	metrics.Logins.WithLabelValues("success").Inc()
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionSSOLogin, Actor: username, Target: identity.Subject, Success: true})
+	return startSession(redisClient, username)
+}
+
+// provisionSSOUser creates the user for a subject that logs in for the first
+// time, named after the provider's username
+func (s *ChatServer) provisionSSOUser(ctx context.Context, identity *sso.Identity) (string, error) {
+	redisClient := s.redisFor(ctx)
+	username := identity.Username
+
+	if err := validateUsername(username); err != nil {
+		return "", status.Errorf(codes.PermissionDenied, "%s is not a valid username here: %s", username, status.Convert(err).Message())
+	}
+
+	// bots and users share the namespace of message authors
+	_, err := storage.GetBot(redisClient, username)
+	if err == nil {
+		return "", status.Errorf(codes.AlreadyExists, "Username %s is taken by a bot", username)
+	} else if err != redis.Nil {
+		logger.FromContext(ctx).Error("Error checking bot existence:", zap.Error(err))
+		return "", status.Errorf(codes.Internal, "Failed to log in")
+	}
+
+	linked, err := storage.SaveSSOUser(redisClient, identity.Issuer, identity.Subject, username, config.AppConfig.OIDC.LinkExistingUsers)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to save single sign-on user", zap.Error(err))
+		return "", status.Errorf(codes.Internal, "Failed to log in")
+	}
+	if !linked {
+		return "", status.Errorf(codes.AlreadyExists, "Username %s is taken by an account that logs in with a password", username)
+	}
+
+	logger.FromContext(ctx).Info("Provisioned single sign-on user", zap.String("user", username), zap.String("issuer", identity.Issuer))
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionRegister, Actor: username, Target: identity.Subject, Success: true})
+	return username, nil
+}
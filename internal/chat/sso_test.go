@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"chat_app/config"
+	"chat_app/internal/mockidp"
+	"chat_app/internal/sso"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func newTestSSOServer(t *testing.T) (*ChatServer, *mockidp.Server) {
+	t.Helper()
+	s, _ := newTestServer(t)
+	idpServer := httptest.NewUnstartedServer(nil)
+	idp, err := mockidp.New("http://" + idpServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpServer.Config.Handler = idp
+	idpServer.Start()
+	t.Cleanup(idpServer.Close)
+
+	s.sso, err = sso.New(context.Background(), sso.Options{
+		Issuer:         idpServer.URL,
+		ClientID:       "chat-web",
+		DeviceClientID: "chat-cli",
+		Scopes:         []string{"openid"},
+		UsernameClaim:  "preferred_username",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, idp
+}
+
+func loginOIDC(t *testing.T, s *ChatServer, idp *mockidp.Server, username string, issuedAt time.Time) (*pb.AuthResponse, error) {
+	t.Helper()
+	idToken, err := idp.IDToken("chat-cli", username, "", issuedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.LoginOIDC(context.Background(), &pb.LoginOIDCRequest{IdToken: idToken})
+}
+
+func TestLoginOIDCProvisionsUser(t *testing.T) {
+	s, idp := newTestSSOServer(t)
+
+	resp, err := loginOIDC(t, s, idp, "carol", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Username != "carol" {
+		t.Errorf("got username %q", resp.Username)
+	}
+	ctx := authenticated(t, s, resp.Token)
+
+	// the account has no password to log in, change or reset with
+	_, err = s.Login(context.Background(), &pb.LoginRequest{Username: "carol", Password: ""})
+	wantCode(t, "password login", err, codes.Unauthenticated)
+	_, err = s.ChangePassword(ctx, &pb.ChangePasswordRequest{NewPassword: testPassword})
+	wantCode(t, "change password", err, codes.FailedPrecondition)
+	_, err = s.EnrollTwoFactor(ctx, &pb.Empty{})
+	wantCode(t, "enroll two-factor", err, codes.FailedPrecondition)
+	_, err = s.Register(context.Background(), &pb.RegisterRequest{Username: "carol", Password: testPassword})
+	wantCode(t, "register", err, codes.AlreadyExists)
+
+	resp, err = loginOIDC(t, s, idp, "carol", time.Now())
+	if err != nil || resp.Username != "carol" {
+		t.Errorf("second login: got %v, %v", resp, err)
+	}
+}
+
+func TestLoginOIDCRejectsReplays(t *testing.T) {
+	s, idp := newTestSSOServer(t)
+
+	idToken, err := idp.IDToken("chat-cli", "carol", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoginOIDC(context.Background(), &pb.LoginOIDCRequest{IdToken: idToken}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.LoginOIDC(context.Background(), &pb.LoginOIDCRequest{IdToken: idToken})
+	wantCode(t, "reused token", err, codes.Unauthenticated)
+
+	_, err = loginOIDC(t, s, idp, "carol", time.Now().Add(-config.AppConfig.OIDC.MaxTokenAge-time.Minute))
+	wantCode(t, "old token", err, codes.Unauthenticated)
+
+	otherClient, err := idp.IDToken("someone-else", "carol", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.LoginOIDC(context.Background(), &pb.LoginOIDCRequest{IdToken: otherClient})
+	wantCode(t, "token for another client", err, codes.Unauthenticated)
+}
+
+func TestLoginOIDCLinking(t *testing.T) {
+	s, idp := newTestSSOServer(t)
+	setConfig(t, &config.AppConfig.OIDC.LinkExistingUsers, true)
+
+	// a password account is never taken over, even with linking on
+	registerUser(t, s, "alice")
+	_, err := loginOIDC(t, s, idp, "alice", time.Now())
+	wantCode(t, "password account", err, codes.AlreadyExists)
+
+	// nor is one linked to another subject
+	if _, err := storage.SaveSSOUser(s.redisClient, "https://old.example.com", "dave-1", "dave", false); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loginOIDC(t, s, idp, "dave", time.Now())
+	wantCode(t, "account of another subject", err, codes.AlreadyExists)
+	if username, err := storage.GetSSOUser(s.redisClient, "https://old.example.com", "dave-1"); err != nil || username != "dave" {
+		t.Errorf("earlier subject's link: got %q, %v", username, err)
+	}
+
+	// an account without any way to log in is
+	if err := storage.SaveUser(s.redisClient, "frank", ""); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := loginOIDC(t, s, idp, "frank", time.Now())
+	if err != nil || resp.Username != "frank" {
+		t.Errorf("account without credentials: got %v, %v", resp, err)
+	}
+
+	setConfig(t, &config.AppConfig.OIDC.LinkExistingUsers, false)
+	if _, err := storage.SaveSSOUser(s.redisClient, "https://old.example.com", "erin-1", "erin", false); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loginOIDC(t, s, idp, "erin", time.Now())
+	wantCode(t, "linking off", err, codes.AlreadyExists)
+}
+
+func TestSSOAdminsSkipTwoFactor(t *testing.T) {
+	s, idp := newTestSSOServer(t)
+	setConfig(t, &config.AppConfig.Auth.Admins, []string{"carol"})
+	setConfig(t, &config.AppConfig.Auth.TwoFactor.RequireForAdmins, true)
+
+	resp, err := loginOIDC(t, s, idp, "carol", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = call(s, resp.Token, "QueryAuditLog", func(ctx context.Context) error {
+		_, err := s.QueryAuditLog(ctx, &pb.QueryAuditLogRequest{})
+		return err
+	})
+	wantCode(t, "single sign-on admin", err, codes.OK)
+}
@@ -0,0 +1,362 @@
+package chat
+
+import (
+	"chat_app/config"
+	"chat_app/internal/audit"
+	"chat_app/internal/logger"
+	"chat_app/internal/metrics"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"context"
+	"crypto/rand"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	totpPeriod = 30 * time.Second
+	// codes of one period before and after are accepted too, for clocks that drift
+	totpSkew = 1
+	// recovery codes are 10 base32 characters, shown as xxxxx-xxxxx
+	recoveryCodeAlphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	recoveryCodeLength   = 10
+)
+
+// newTwoFactorChallenge returns the challenge a login gets for its password,
+// to be exchanged for a session with VerifyTwoFactor. Only its hash is stored.
+func newTwoFactorChallenge(redisClient *redis.Client, username string) (string, error) {
+	challenge, err := newID()
+	if err != nil {
+		return "", err
+	}
+	err = storage.SaveTwoFactorChallenge(redisClient, hashSecret(challenge), username, config.AppConfig.Auth.TwoFactor.ChallengeTTL)
+	return challenge, err
+}
+
+// validateTOTP returns the time step the code was generated for
+func validateTOTP(code, secret string, now time.Time) (int64, bool) {
+	for i := -totpSkew; i <= totpSkew; i++ {
+		t := now.Add(time.Duration(i) * totpPeriod)
+		ok, _ := totp.ValidateCustom(code, secret, t, totp.ValidateOpts{
+			Period:    uint(totpPeriod / time.Second),
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if ok {
+			return t.Unix() / int64(totpPeriod/time.Second), true
+		}
+	}
+	return 0, false
+}
+
+// checkSecondFactor accepts a code from the user's authenticator app that was
+// not used before, or one of their recovery codes, which is used up by it
+func checkSecondFactor(redisClient *redis.Client, username, secret, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if counter, ok := validateTOTP(code, secret, time.Now()); ok {
+		return storage.UseTOTPCounter(redisClient, username, counter, (2*totpSkew+1)*totpPeriod)
+	}
+
+	used, err := storage.UseRecoveryCode(redisClient, username, hashSecret(normalizeRecoveryCode(code)))
+	if used {
+		logger.FromContext(redisClient.Context()).Info("Recovery code used", zap.String("user", username))
+	}
+	return used, err
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes returns n recovery codes and the hashes to store
+func newRecoveryCodes(n int) ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < n; i++ {
+		b := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		for j := range b {
+			b[j] = recoveryCodeAlphabet[int(b[j])%len(recoveryCodeAlphabet)]
+		}
+		code := string(b[:recoveryCodeLength/2]) + "-" + string(b[recoveryCodeLength/2:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashSecret(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+// VerifyTwoFactor completes a login that returned a challenge. Wrong codes
+// count as failed logins, so they lead to the same lockout as wrong passwords.
+func (s *ChatServer) VerifyTwoFactor(ctx context.Context, req *pb.VerifyTwoFactorRequest) (*pb.AuthResponse, error) {
+	redisClient := s.redisFor(ctx)
+	challengeHash := hashSecret(req.Challenge)
+
+	username, err := storage.GetTwoFactorChallenge(redisClient, challengeHash)
+	if err == redis.Nil || req.Challenge == "" {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionLogin, Reason: "invalid two-factor challenge"})
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid or expired challenge, log in again")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to get two-factor challenge", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to log in")
+	}
+
+	limits := loginLimits(ctx, username)
+	locked, err := loginLockRemaining(redisClient, limits)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check login lockout", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to log in")
+	}
+	if locked > 0 {
+		metrics.Logins.WithLabelValues("locked").Inc()
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionLogin, Actor: username, Reason: "locked out"})
+		return nil, lockedOutError(locked)
+	}
+
+	secret, _, err := storage.GetTwoFactor(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get two-factor authentication", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to log in")
+	}
+	// disabled since the challenge was issued, then no code is right
+	ok := false
+	if secret != "" {
+		ok, err = checkSecondFactor(redisClient, username, secret, req.Code)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to check two-factor code", zap.Error(err))
+			return nil, status.Errorf(codes.Internal, "Failed to log in")
+		}
+	}
+	if !ok {
+		metrics.Logins.WithLabelValues("failure").Inc()
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionLogin, Actor: username, Reason: "wrong two-factor code"})
+		if err := recordLoginFailure(redisClient, limits); err != nil {
+			logger.FromContext(ctx).Error("Failed to record failed login", zap.Error(err))
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "Invalid code")
+	}
+
+	if err := storage.DeleteTwoFactorChallenge(redisClient, challengeHash); err != nil {
+		logger.FromContext(ctx).Error("Failed to delete two-factor challenge", zap.Error(err))
+	}
+	if err := storage.ClearLoginFailures(redisClient, accountLockoutKey(username)); err != nil {
+		logger.FromContext(ctx).Error("Failed to clear failed logins", zap.Error(err))
+	}
+	metrics.Logins.WithLabelValues("success").Inc()
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionLogin, Actor: username, Success: true})
+
+	return startSession(redisClient, username)
+}
+
+// EnrollTwoFactor generates a new secret for the user. It only takes effect
+// once ConfirmTwoFactor proves the user's app generates the right codes.
+func (s *ChatServer) EnrollTwoFactor(ctx context.Context, _ *pb.Empty) (*pb.TwoFactorEnrollment, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+	redisClient := s.redisFor(ctx)
+
+	secret, _, err := storage.GetTwoFactor(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get two-factor authentication", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to enroll")
+	}
+	if secret != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is already enabled")
+	}
+	// their logins never ask for a code, the provider does
+	hashedPassword, err := storage.GetUser(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to enroll")
+	}
+	if hashedPassword == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Accounts that log in with single sign-on use the provider's two-factor authentication")
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      config.AppConfig.Auth.TwoFactor.Issuer,
+		AccountName: username,
+		Period:      uint(totpPeriod / time.Second),
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to generate TOTP secret", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to enroll")
+	}
+	if err := storage.SavePendingTwoFactor(redisClient, username, key.Secret()); err != nil {
+		logger.FromContext(ctx).Error("Failed to save TOTP secret", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to enroll")
+	}
+
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionEnrollTwoFactor, Actor: username, Success: true})
+	return &pb.TwoFactorEnrollment{Secret: key.Secret(), Uri: key.URL()}, nil
+}
+
+// ConfirmTwoFactor enables two-factor authentication with the enrolled secret
+// and returns new recovery codes. They are not stored and cannot be shown again.
+func (s *ChatServer) ConfirmTwoFactor(ctx context.Context, req *pb.ConfirmTwoFactorRequest) (*pb.RecoveryCodes, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+	redisClient := s.redisFor(ctx)
+
+	secret, pending, err := storage.GetTwoFactor(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get two-factor authentication", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to enable two-factor authentication")
+	}
+	if secret != "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is already enabled")
+	}
+	if pending == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Call EnrollTwoFactor first")
+	}
+
+	counter, ok := validateTOTP(strings.TrimSpace(req.Code), pending, time.Now())
+	if !ok {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionEnableTwoFactor, Actor: username, Reason: "wrong code"})
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid code")
+	}
+	// the code must not log in again
+	if _, err := storage.UseTOTPCounter(redisClient, username, counter, (2*totpSkew+1)*totpPeriod); err != nil {
+		logger.FromContext(ctx).Error("Failed to record TOTP code", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to enable two-factor authentication")
+	}
+
+	recoveryCodes, hashes, err := newRecoveryCodes(config.AppConfig.Auth.TwoFactor.RecoveryCodes)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to generate recovery codes", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to enable two-factor authentication")
+	}
+	if err := storage.EnableTwoFactor(redisClient, username, pending, hashes); err != nil {
+		logger.FromContext(ctx).Error("Failed to enable two-factor authentication", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to enable two-factor authentication")
+	}
+
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionEnableTwoFactor, Actor: username, Success: true})
+	return &pb.RecoveryCodes{Codes: recoveryCodes}, nil
+}
+
+// DisableTwoFactor needs both the password and a code, so a stolen session
+// alone cannot turn it off
+func (s *ChatServer) DisableTwoFactor(ctx context.Context, req *pb.DisableTwoFactorRequest) (*pb.Empty, error) {
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+	redisClient := s.redisFor(ctx)
+
+	limits := loginLimits(ctx, username)
+	locked, err := loginLockRemaining(redisClient, limits)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check login lockout", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to disable two-factor authentication")
+	}
+	if locked > 0 {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionDisableTwoFactor, Actor: username, Reason: "locked out"})
+		return nil, lockedOutError(locked)
+	}
+
+	hashedPassword, err := storage.GetUser(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to disable two-factor authentication")
+	}
+	secret, _, err := storage.GetTwoFactor(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get two-factor authentication", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to disable two-factor authentication")
+	}
+	if secret == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Two-factor authentication is not enabled")
+	}
+
+	reason := ""
+	if !comparePassword(hashedPassword, req.Password) {
+		reason = "wrong password"
+	} else if ok, err := checkSecondFactor(redisClient, username, secret, req.Code); err != nil {
+		logger.FromContext(ctx).Error("Failed to check two-factor code", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to disable two-factor authentication")
+	} else if !ok {
+		reason = "wrong two-factor code"
+	}
+	if reason != "" {
+		s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionDisableTwoFactor, Actor: username, Reason: reason})
+		if err := recordLoginFailure(redisClient, limits); err != nil {
+			logger.FromContext(ctx).Error("Failed to record failed login", zap.Error(err))
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "Invalid password or code")
+	}
+
+	if err := storage.DisableTwoFactor(redisClient, username); err != nil {
+		logger.FromContext(ctx).Error("Failed to disable two-factor authentication", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to disable two-factor authentication")
+	}
+
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionDisableTwoFactor, Actor: username, Success: true})
+	return &pb.Empty{}, nil
+}
+
+// checkAdmin lets only the users listed in auth.admins through. Admins that
+// must enable two-factor authentication first never get this far, since
+// authentication refuses their sessions for anything else.
+func (s *ChatServer) checkAdmin(ctx context.Context, username string) error {
+	if !containsString(config.AppConfig.Auth.Admins, username) {
+		return status.Errorf(codes.PermissionDenied, "Only admins can do this")
+	}
+	return nil
+}
+
+// twoFactorSetupMethods are what admins can call before they enable
+// two-factor authentication, when auth.twoFactor.requireForAdmins is on
+var twoFactorSetupMethods = map[string]bool{
+	"/chat.ChatService/EnrollTwoFactor":  true,
+	"/chat.ChatService/ConfirmTwoFactor": true,
+}
+
+// checkTwoFactorRequired refuses the sessions of admins without two-factor
+// authentication when auth.twoFactor.requireForAdmins is on, except for
+// setting it up. It is checked on every call rather than at login, so it also
+// holds for sessions from before the admin was listed or the option was set.
+// Users that can only log in with single sign-on are left to the provider's
+// second factor.
+func (s *ChatServer) checkTwoFactorRequired(ctx context.Context, username, method string) error {
+	if !config.AppConfig.Auth.TwoFactor.RequireForAdmins || !containsString(config.AppConfig.Auth.Admins, username) || twoFactorSetupMethods[method] {
+		return nil
+	}
+	redisClient := s.redisFor(ctx)
+
+	hashedPassword, err := storage.GetUser(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user", zap.Error(err))
+		return status.Errorf(codes.Internal, "Error verifying token")
+	}
+	_, subject, err := storage.GetUserSSO(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get single sign-on user", zap.Error(err))
+		return status.Errorf(codes.Internal, "Error verifying token")
+	}
+	if hashedPassword == "" && subject != "" {
+		return nil
+	}
+	secret, _, err := storage.GetTwoFactor(redisClient, username)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get two-factor authentication", zap.Error(err))
+		return status.Errorf(codes.Internal, "Error verifying token")
+	}
+	if secret == "" {
+		return status.Errorf(codes.PermissionDenied, "Admins must enable two-factor authentication first")
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package chat
+
+import (
+	"chat_app/config"
+	pb "chat_app/pb"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(secret, at, totp.ValidateOpts{
+		Period:    uint(totpPeriod / time.Second),
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestValidateTOTP(t *testing.T) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: "chat", AccountName: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := key.Secret()
+	now := time.Unix(1700000000, 0)
+	step := now.Unix() / int64(totpPeriod/time.Second)
+
+	tests := []struct {
+		name    string
+		code    string
+		ok      bool
+		counter int64
+	}{
+		{"current period", totpCode(t, secret, now), true, step},
+		{"previous period", totpCode(t, secret, now.Add(-totpPeriod)), true, step - 1},
+		{"next period", totpCode(t, secret, now.Add(totpPeriod)), true, step + 1},
+		{"two periods ago", totpCode(t, secret, now.Add(-2*totpPeriod)), false, 0},
+		{"two periods ahead", totpCode(t, secret, now.Add(2*totpPeriod)), false, 0},
+		{"not digits", "abcdef", false, 0},
+		{"too short", totpCode(t, secret, now)[:5], false, 0},
+		{"empty", "", false, 0},
+	}
+	for _, tt := range tests {
+		counter, ok := validateTOTP(tt.code, secret, now)
+		if ok != tt.ok || counter != tt.counter {
+			t.Errorf("%s: got %d, %v, want %d, %v", tt.name, counter, ok, tt.counter, tt.ok)
+		}
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	recoveryCodes, hashes, err := newRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recoveryCodes) != 10 || len(hashes) != 10 {
+		t.Fatalf("got %d codes and %d hashes", len(recoveryCodes), len(hashes))
+	}
+
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := make(map[string]bool)
+	for i, code := range recoveryCodes {
+		if !format.MatchString(code) || seen[code] {
+			t.Errorf("bad or repeated code %q", code)
+		}
+		seen[code] = true
+		// typed in capitals, without the dash or with spaces, it is the same code
+		for _, typed := range []string{code, strings.ToUpper(code), strings.ReplaceAll(code, "-", ""), strings.ReplaceAll(code, "-", " ")} {
+			if hashSecret(normalizeRecoveryCode(typed)) != hashes[i] {
+				t.Errorf("%q does not match the hash of %q", typed, code)
+			}
+		}
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx := registerUser(t, s, "alice")
+
+	enrollment, err := s.EnrollTwoFactor(ctx, &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.Uri, "otpauth://totp/") {
+		t.Errorf("got uri %q", enrollment.Uri)
+	}
+	_, err = s.ConfirmTwoFactor(ctx, &pb.ConfirmTwoFactorRequest{Code: "000000"})
+	wantCode(t, "confirm with a wrong code", err, codes.InvalidArgument)
+	confirmCode := totpCode(t, enrollment.Secret, time.Now())
+	recovery, err := s.ConfirmTwoFactor(ctx, &pb.ConfirmTwoFactorRequest{Code: confirmCode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.EnrollTwoFactor(ctx, &pb.Empty{})
+	wantCode(t, "enroll again", err, codes.FailedPrecondition)
+
+	verify := func(code string) error {
+		t.Helper()
+		resp, err := s.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.TwoFactorRequired || resp.Token != "" || resp.Challenge == "" {
+			t.Fatalf("got login response %v", resp)
+		}
+		resp, err = s.VerifyTwoFactor(context.Background(), &pb.VerifyTwoFactorRequest{Challenge: resp.Challenge, Code: code})
+		if err == nil && resp.Token == "" {
+			t.Error("no session token")
+		}
+		return err
+	}
+
+	wantCode(t, "the code that confirmed enrollment", verify(confirmCode), codes.Unauthenticated)
+	nextCode := totpCode(t, enrollment.Secret, time.Now().Add(totpPeriod))
+	wantCode(t, "an unused code", verify(nextCode), codes.OK)
+	wantCode(t, "the same code again", verify(nextCode), codes.Unauthenticated)
+
+	recoveryCode := recovery.Codes[0]
+	wantCode(t, "a recovery code", verify(strings.ToUpper(recoveryCode)), codes.OK)
+	wantCode(t, "a used recovery code", verify(recoveryCode), codes.Unauthenticated)
+	wantCode(t, "another recovery code", verify(recovery.Codes[1]), codes.OK)
+
+	_, err = s.VerifyTwoFactor(context.Background(), &pb.VerifyTwoFactorRequest{Challenge: "made-up", Code: recovery.Codes[2]})
+	wantCode(t, "a made up challenge", err, codes.Unauthenticated)
+}
+
+// call runs method through the auth interceptor with token, like a gRPC client
+func call(s *ChatServer, token, method string, handler func(ctx context.Context) error) error {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", token))
+	_, err := s.AuthInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/chat.ChatService/" + method}, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return nil, handler(ctx)
+	})
+	return err
+}
+
+func TestAdminsNeedTwoFactor(t *testing.T) {
+	s, _ := newTestServer(t)
+	setConfig(t, &config.AppConfig.Auth.Admins, []string{"alice"})
+	setConfig(t, &config.AppConfig.Auth.TwoFactor.RequireForAdmins, true)
+
+	resp, err := s.Register(context.Background(), &pb.RegisterRequest{Username: "alice", Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryAuditLog := func(ctx context.Context) error {
+		_, err := s.QueryAuditLog(ctx, &pb.QueryAuditLogRequest{})
+		return err
+	}
+	listRooms := func(ctx context.Context) error {
+		_, err := s.ListRooms(ctx, &pb.Empty{})
+		return err
+	}
+
+	// the session is good for setting up two-factor authentication only
+	wantCode(t, "admin call", call(s, resp.Token, "QueryAuditLog", queryAuditLog), codes.PermissionDenied)
+	wantCode(t, "other call", call(s, resp.Token, "ListRooms", listRooms), codes.PermissionDenied)
+	_, err = s.Authenticate(context.Background(), resp.Token)
+	wantCode(t, "http or irc", err, codes.PermissionDenied)
+
+	var enrollment *pb.TwoFactorEnrollment
+	err = call(s, resp.Token, "EnrollTwoFactor", func(ctx context.Context) (err error) {
+		enrollment, err = s.EnrollTwoFactor(ctx, &pb.Empty{})
+		return err
+	})
+	wantCode(t, "enroll", err, codes.OK)
+	err = call(s, resp.Token, "ConfirmTwoFactor", func(ctx context.Context) error {
+		_, err := s.ConfirmTwoFactor(ctx, &pb.ConfirmTwoFactorRequest{Code: totpCode(t, enrollment.Secret, time.Now())})
+		return err
+	})
+	wantCode(t, "confirm", err, codes.OK)
+
+	// from then on the session can do everything, and so can later ones
+	wantCode(t, "admin call after enabling", call(s, resp.Token, "QueryAuditLog", queryAuditLog), codes.OK)
+	login, err := s.Login(context.Background(), &pb.LoginRequest{Username: "alice", Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := s.VerifyTwoFactor(context.Background(), &pb.VerifyTwoFactorRequest{Challenge: login.Challenge, Code: totpCode(t, enrollment.Secret, time.Now().Add(totpPeriod))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCode(t, "admin call with a new session", call(s, verified.Token, "ListRooms", listRooms), codes.OK)
+
+	// users that are not admins are not asked for it
+	bob, err := s.Register(context.Background(), &pb.RegisterRequest{Username: "bob", Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCode(t, "user call", call(s, bob.Token, "ListRooms", listRooms), codes.OK)
+	wantCode(t, "user calling an admin call", call(s, bob.Token, "QueryAuditLog", queryAuditLog), codes.PermissionDenied)
+}
@@ -0,0 +1,164 @@
+package chat
+
+import (
+	"chat_app/internal/audit"
+	"chat_app/internal/logger"
+	"chat_app/internal/storage"
+	"chat_app/internal/webhook"
+	pb "chat_app/pb"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *ChatServer) CreateWebhook(ctx context.Context, req *pb.CreateWebhookRequest) (*pb.Webhook, error) {
+	username, err := s.roomMember(ctx, req.Room)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.webhooks.CheckURL(req.Url); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Webhook url %s", err)
+	}
+	for _, event := range req.Events {
+		if !containsString(webhook.Events, event) {
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown webhook event %q", event)
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to generate webhook id", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to create webhook")
+	}
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to generate webhook secret", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to create webhook")
+	}
+
+	hook := &pb.Webhook{
+		Id:        id,
+		Room:      req.Room,
+		Url:       req.Url,
+		Events:    req.Events,
+		Secret:    secret,
+		CreatedBy: username,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := storage.SaveWebhook(s.redisFor(ctx), hook); err != nil {
+		logger.FromContext(ctx).Error("Failed to save webhook", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to create webhook")
+	}
+
+	logger.FromContext(ctx).Info("Webhook created", zap.String("id", id), zap.String("room", req.Room), zap.String("user", username))
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionCreateWebhook, Actor: username, Target: id, Room: req.Room, Success: true})
+	return hook, nil
+}
+
+// ListWebhooks returns the user's webhooks in the room and their dead
+// letters, or all of them to admins
+func (s *ChatServer) ListWebhooks(ctx context.Context, req *pb.ListWebhooksRequest) (*pb.ListWebhooksResponse, error) {
+	username, err := s.roomMember(ctx, req.Room)
+	if err != nil {
+		return nil, err
+	}
+	isAdmin := s.checkAdmin(ctx, username) == nil
+
+	webhooks, err := storage.GetWebhooks(s.redisFor(ctx), req.Room)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to list webhooks", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to list webhooks")
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].CreatedAt < webhooks[j].CreatedAt })
+
+	visible := make(map[string]bool)
+	var own []*pb.Webhook
+	for _, hook := range webhooks {
+		if !isAdmin && hook.CreatedBy != username {
+			continue
+		}
+		// the secret is only shown once, when the webhook is created
+		hook.Secret = ""
+		visible[hook.Id] = true
+		own = append(own, hook)
+	}
+
+	deadLetters, err := storage.GetDeadLetters(s.redisFor(ctx), req.Room)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to list webhook dead letters", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to list webhooks")
+	}
+	var ownDeadLetters []*pb.WebhookDeadLetter
+	for _, deadLetter := range deadLetters {
+		if visible[deadLetter.WebhookId] {
+			ownDeadLetters = append(ownDeadLetters, deadLetter)
+		}
+	}
+
+	return &pb.ListWebhooksResponse{Webhooks: own, DeadLetters: ownDeadLetters}, nil
+}
+
+func (s *ChatServer) DeleteWebhook(ctx context.Context, req *pb.DeleteWebhookRequest) (*pb.Empty, error) {
+	username, err := s.roomMember(ctx, req.Room)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks, err := storage.GetWebhooks(s.redisFor(ctx), req.Room)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to list webhooks", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to delete webhook")
+	}
+	var hook *pb.Webhook
+	for _, h := range webhooks {
+		if h.Id == req.Id {
+			hook = h
+		}
+	}
+	if hook == nil {
+		return nil, status.Errorf(codes.NotFound, "Webhook not found")
+	}
+	if hook.CreatedBy != username {
+		if err := s.checkAdmin(ctx, username); status.Code(err) == codes.PermissionDenied {
+			s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionDeleteWebhook, Actor: username, Target: req.Id, Room: req.Room, Reason: "not the creator"})
+			return nil, status.Errorf(codes.PermissionDenied, "Only the webhook's creator or an admin can delete it")
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	err = storage.DeleteWebhook(s.redisFor(ctx), req.Room, req.Id)
+	if err == redis.Nil {
+		return nil, status.Errorf(codes.NotFound, "Webhook not found")
+	} else if err != nil {
+		logger.FromContext(ctx).Error("Failed to delete webhook", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "Failed to delete webhook")
+	}
+
+	logger.FromContext(ctx).Info("Webhook deleted", zap.String("id", req.Id), zap.String("room", req.Room), zap.String("user", username))
+	s.auditLog.Record(ctx, &pb.AuditEvent{Action: audit.ActionDeleteWebhook, Actor: username, Target: req.Id, Room: req.Room, Success: true})
+	return &pb.Empty{}, nil
+}
+
+// roomMember returns the authenticated user if they are a member of the room
+func (s *ChatServer) roomMember(ctx context.Context, room string) (string, error) {
+	if room == "" {
+		return "", status.Errorf(codes.InvalidArgument, "Room must not be empty")
+	}
+
+	username, ok := UsernameFromContext(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "No user in context")
+	}
+
+	if err := s.checkRoomAccess(ctx, username, room); err != nil {
+		return "", err
+	}
+	return username, nil
+}
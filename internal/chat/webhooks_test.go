@@ -0,0 +1,52 @@
+package chat
+
+import (
+	"chat_app/config"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestWebhooksBelongToTheirCreator(t *testing.T) {
+	s, _ := newTestServer(t)
+	setConfig(t, &config.AppConfig.Auth.Admins, []string{"carol"})
+	alice := registerUser(t, s, "alice")
+	bob := registerUser(t, s, "bob")
+	carol := registerUser(t, s, "carol")
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if err := storage.AddUserRoom(s.redisClient, user, "general"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := s.CreateWebhook(alice, &pb.CreateWebhookRequest{Room: "general", Url: "http://169.254.169.254/latest/meta-data/"})
+	wantCode(t, "link-local url", err, codes.InvalidArgument)
+	hook, err := s.CreateWebhook(alice, &pb.CreateWebhookRequest{Room: "general", Url: "https://hooks.example.com/chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		user string
+		ctx  context.Context
+		want int
+	}{{"alice", alice, 1}, {"bob", bob, 0}, {"carol", carol, 1}} {
+		resp, err := s.ListWebhooks(tt.ctx, &pb.ListWebhooksRequest{Room: "general"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Webhooks) != tt.want {
+			t.Errorf("%s sees %d webhooks, want %d", tt.user, len(resp.Webhooks), tt.want)
+		}
+	}
+
+	_, err = s.DeleteWebhook(bob, &pb.DeleteWebhookRequest{Room: "general", Id: hook.Id})
+	wantCode(t, "delete by another member", err, codes.PermissionDenied)
+	_, err = s.DeleteWebhook(carol, &pb.DeleteWebhookRequest{Room: "general", Id: hook.Id})
+	wantCode(t, "delete by an admin", err, codes.OK)
+	_, err = s.DeleteWebhook(alice, &pb.DeleteWebhookRequest{Room: "general", Id: hook.Id})
+	wantCode(t, "delete again", err, codes.NotFound)
+}
@@ -0,0 +1,185 @@
+// Package health reports whether the server can do its job: Redis must answer
+// and pub/sub, which carries every room's messages to its streams, must be
+// delivering. The result is served over HTTP and as the standard
+// grpc.health.v1 service.
+package health
+
+import (
+	"chat_app/internal/logger"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// how often Redis is pinged and a message is sent through pub/sub
+	checkInterval = 5 * time.Second
+	// how long the ping and the pub/sub round trip may take each
+	checkTimeout = 2 * time.Second
+)
+
+type Checker struct {
+	redisClient *redis.Client
+	// channel only this instance subscribes to, so probes test its own subscriptions
+	channel string
+	// services are reported by the gRPC health service, "" being the whole server
+	services   []string
+	grpcHealth *grpchealth.Server
+	// probes sent to channel arrive here
+	received chan struct{}
+
+	mu           sync.Mutex
+	lastErr      error
+	reported     bool
+	wasReady     bool
+	shuttingDown atomic.Bool
+}
+
+func NewChecker(redisClient *redis.Client, services ...string) *Checker {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	c := &Checker{
+		redisClient: redisClient,
+		channel:     "health:" + hex.EncodeToString(id),
+		services:    append([]string{""}, services...),
+		grpcHealth:  grpchealth.NewServer(),
+		received:    make(chan struct{}, 1),
+		// the first probe has not run yet, so start out not ready
+		lastErr: fmt.Errorf("not checked yet"),
+	}
+	for _, service := range c.services {
+		c.grpcHealth.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	return c
+}
+
+// GRPCServer is the grpc.health.v1 implementation to register on the gRPC server
+func (c *Checker) GRPCServer() healthpb.HealthServer {
+	return c.grpcHealth
+}
+
+// Run checks Redis and pub/sub every few seconds until ctx is done
+func (c *Checker) Run(ctx context.Context) {
+	pubsub := c.redisClient.Subscribe(ctx, c.channel)
+	defer pubsub.Close()
+	// wait for the subscription, or the first probe would be published too early
+	if _, err := pubsub.Receive(ctx); err != nil {
+		logger.Log.Error("Failed to subscribe to health channel", zap.Error(err))
+	}
+
+	go func() {
+		for range pubsub.Channel() {
+			select {
+			case c.received <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		c.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Checker) probe(ctx context.Context) {
+	err := c.roundTrip(ctx)
+
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+	c.report()
+}
+
+// roundTrip pings Redis and waits for a message published to the checker's
+// own channel, which is how room messages reach their streams
+func (c *Checker) roundTrip(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	if err := c.redisClient.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+
+	// drop a late answer to an earlier probe
+	select {
+	case <-c.received:
+	default:
+	}
+
+	if err := c.redisClient.Publish(ctx, c.channel, "ping").Err(); err != nil {
+		return fmt.Errorf("pub/sub: %w", err)
+	}
+	select {
+	case <-c.received:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("pub/sub: message not delivered within %s", checkTimeout)
+	}
+}
+
+// Check returns why the server is unhealthy, or nil
+func (c *Checker) Check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastErr
+}
+
+// Ready is Check, but also fails once the server started shutting down so
+// load balancers stop sending new connections
+func (c *Checker) Ready() error {
+	if c.shuttingDown.Load() {
+		return fmt.Errorf("shutting down")
+	}
+	return c.Check()
+}
+
+// Shutdown makes the server report not ready from now on
+func (c *Checker) Shutdown() {
+	c.shuttingDown.Store(true)
+	c.report()
+	// also stops later probes from setting SERVING again
+	c.grpcHealth.Shutdown()
+}
+
+// report updates the gRPC health service and logs changes
+func (c *Checker) report() {
+	err := c.Ready()
+	ready := err == nil
+
+	c.mu.Lock()
+	changed := !c.reported || c.wasReady != ready
+	c.reported, c.wasReady = true, ready
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	status := healthpb.HealthCheckResponse_SERVING
+	if ready {
+		logger.Log.Info("Server is ready")
+	} else {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+		logger.Log.Warn("Server is not ready", zap.Error(err))
+	}
+	for _, service := range c.services {
+		c.grpcHealth.SetServingStatus(service, status)
+	}
+}
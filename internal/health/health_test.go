@@ -0,0 +1,86 @@
+package health
+
+import (
+	"chat_app/internal/logger"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestChecker(t *testing.T) {
+	previousLog := logger.Log
+	logger.Log = zap.NewNop()
+	t.Cleanup(func() { logger.Log = previousLog })
+
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { redisClient.Close() })
+	c := NewChecker(redisClient, "chat.ChatService")
+
+	// status returns what the gRPC health service reports for service
+	status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		resp, err := c.GRPCServer().Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+	// probeUntil probes until the checker's readiness is ready
+	probeUntil := func(ready bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); (c.Ready() == nil) != ready; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("readiness did not become %v: %v", ready, c.Ready())
+			}
+			c.probe(context.Background())
+		}
+	}
+
+	if c.Ready() == nil || status("") != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("ready before the first probe")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	probeUntil(true)
+	for _, service := range []string{"", "chat.ChatService"} {
+		if got := status(service); got != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("service %q is %v", service, got)
+		}
+	}
+
+	mr.Close()
+	probeUntil(false)
+	if c.Check() == nil {
+		t.Error("healthy without Redis")
+	}
+	for _, service := range []string{"", "chat.ChatService"} {
+		if got := status(service); got != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("service %q is %v without Redis", service, got)
+		}
+	}
+
+	// the subscription is restored once Redis is back
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	probeUntil(true)
+	if got := status("chat.ChatService"); got != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("service is %v after Redis came back", got)
+	}
+
+	c.Shutdown()
+	if c.Ready() == nil || c.Check() != nil {
+		t.Errorf("after shutdown: ready %v, healthy %v", c.Ready(), c.Check())
+	}
+	if got := status(""); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("server is %v after shutdown", got)
+	}
+}
@@ -0,0 +1,594 @@
+// Package irc is an IRC front-end for the chat server. IRC clients log in
+// with PASS and NICK, or PASS <password> <code> with two-factor
+// authentication enabled, rooms are joined as #<room>, and PRIVMSG to a channel
+// sends a message to the room. Room traffic is relayed back as PRIVMSG, with
+// joins, parts and topic changes mapped to their IRC counterparts.
+//
+// Only the commands needed by common clients are supported; there are no
+// direct messages or channel modes.
+package irc
+
+import (
+	"bufio"
+	"chat_app/internal/chat"
+	"chat_app/internal/logger"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// longer lines are cut, RFC 1459 clients never send more than 512 bytes
+	maxLineLength = 8 << 10
+	// the client must finish registering within this time
+	registrationTimeout = 30 * time.Second
+	// idle clients are pinged, and dropped if they do not answer
+	pingInterval = 2 * time.Minute
+)
+
+// ErrServerClosed is returned by Serve after Shutdown
+var ErrServerClosed = errors.New("irc: server closed")
+
+type Server struct {
+	chatServer  *chat.ChatServer
+	redisClient *redis.Client
+	name        string
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	clients   map[*client]struct{}
+	closed    bool
+}
+
+// NewServer returns an IRC server that announces itself as name
+func NewServer(chatServer *chat.ChatServer, redisClient *redis.Client, name string) *Server {
+	return &Server{
+		chatServer:  chatServer,
+		redisClient: redisClient,
+		name:        name,
+		listeners:   make(map[net.Listener]struct{}),
+		clients:     make(map[*client]struct{}),
+	}
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(lis)
+}
+
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		lis.Close()
+		return ErrServerClosed
+	}
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+
+	logger.Log.Info("Starting IRC server", zap.String("Address", lis.Addr().String()))
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Shutdown stops accepting connections and disconnects every client with an
+// ERROR message, which IRC clients show as the reason they were dropped
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	s.closed = true
+	for lis := range s.listeners {
+		lis.Close()
+	}
+	clients := s.clients
+	s.clients = make(map[*client]struct{})
+	s.mu.Unlock()
+
+	for c := range clients {
+		c.send("", "ERROR", "Closing link: server shutting down")
+		c.conn.Close()
+	}
+}
+
+// client is one IRC connection
+type client struct {
+	server *Server
+	conn   net.Conn
+
+	writeMu sync.Mutex
+
+	// registration state
+	pass string
+	// two-factor code, the second parameter of PASS
+	code string
+	nick string
+	user string
+
+	// set once the client is logged in
+	ctx   context.Context
+	token string
+
+	mu       sync.Mutex
+	channels map[string]context.CancelFunc
+}
+
+func (s *Server) handle(conn net.Conn) {
+	c := &client{
+		server:   s,
+		conn:     conn,
+		channels: make(map[string]context.CancelFunc),
+	}
+	defer c.close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	logger.Log.Info("IRC client connected", zap.String("remote", conn.RemoteAddr().String()))
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxLineLength)
+
+	conn.SetReadDeadline(time.Now().Add(registrationTimeout))
+	for scanner.Scan() {
+		msg := parseMessage(scanner.Text())
+		if msg.command == "" {
+			continue
+		}
+		if !c.dispatch(msg) {
+			return
+		}
+
+		if c.ctx != nil {
+			conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+		}
+	}
+}
+
+func (c *client) close() {
+	c.mu.Lock()
+	for _, cancel := range c.channels {
+		cancel()
+	}
+	c.channels = nil
+	c.mu.Unlock()
+
+	c.conn.Close()
+	logger.Log.Info("IRC client disconnected", zap.String("nick", c.nick))
+}
+
+// dispatch handles one command and returns false if the connection should be closed
+func (c *client) dispatch(msg message) bool {
+	switch msg.command {
+	case "CAP":
+		// no capabilities, but answering lets IRCv3 clients carry on
+		if len(msg.params) > 0 && msg.params[0] == "LS" {
+			c.send(c.server.name, "CAP", "*", "LS", "")
+		}
+		return true
+	case "PING":
+		c.send(c.server.name, "PONG", c.server.name, msg.param(0))
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		c.send("", "ERROR", "Closing link")
+		return false
+	}
+
+	if c.ctx == nil {
+		return c.register(msg)
+	}
+	if !c.checkSession() {
+		return false
+	}
+
+	switch msg.command {
+	case "JOIN":
+		for _, channel := range strings.Split(msg.param(0), ",") {
+			c.join(channel)
+		}
+	case "PART":
+		for _, channel := range strings.Split(msg.param(0), ",") {
+			c.part(channel)
+		}
+	case "PRIVMSG":
+		c.privmsg(msg.param(0), msg.param(1))
+	case "NOTICE":
+		// notices must never be answered, and there is nowhere to send them
+	case "TOPIC":
+		c.topic(msg)
+	case "NAMES":
+		for _, channel := range strings.Split(msg.param(0), ",") {
+			c.names(channel)
+		}
+	case "WHO":
+		c.numeric("315", msg.param(0), "End of WHO list")
+	case "MODE":
+		if strings.HasPrefix(msg.param(0), "#") {
+			c.numeric("324", msg.param(0), "+")
+		} else {
+			c.numeric("221", "+")
+		}
+	case "NICK", "USER", "PASS":
+		c.numeric("462", "You may not reregister")
+	default:
+		c.numeric("421", msg.command, "Unknown command")
+	}
+	return true
+}
+
+// register collects PASS, NICK and USER and logs in once all of them arrived
+func (c *client) register(msg message) bool {
+	switch msg.command {
+	case "PASS":
+		c.pass = msg.param(0)
+		c.code = msg.param(1)
+	case "NICK":
+		c.nick = msg.param(0)
+	case "USER":
+		c.user = msg.param(0)
+	default:
+		c.numeric("451", "You have not registered")
+		return true
+	}
+
+	if c.nick == "" || c.user == "" {
+		return true
+	}
+	if c.pass == "" {
+		c.numeric("464", "Password required, send PASS before NICK")
+		c.send("", "ERROR", "Password required")
+		return false
+	}
+
+	// the connection is one long request, everything it does is logged under one ID
+	ctx := logger.NewRequestContext(context.Background(), logger.RequestID(""), zap.String("remote", c.conn.RemoteAddr().String()))
+	// and audited with the client's address
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: c.conn.RemoteAddr()})
+
+	resp, err := c.server.chatServer.Login(ctx, &pb.LoginRequest{Username: c.nick, Password: c.pass})
+	c.pass = ""
+	if err != nil {
+		c.numeric("464", "Password incorrect")
+		c.send("", "ERROR", "Login failed")
+		return false
+	}
+	if resp.TwoFactorRequired {
+		if c.code == "" {
+			c.numeric("464", "Two-factor code required, send PASS <password> <code>")
+			c.send("", "ERROR", "Login failed")
+			return false
+		}
+		resp, err = c.server.chatServer.VerifyTwoFactor(ctx, &pb.VerifyTwoFactorRequest{Challenge: resp.Challenge, Code: c.code})
+		c.code = ""
+		if err != nil {
+			c.numeric("464", "Two-factor code incorrect")
+			c.send("", "ERROR", "Login failed")
+			return false
+		}
+	}
+
+	ctx, err = c.server.chatServer.Authenticate(ctx, resp.Token)
+	if err != nil {
+		c.send("", "ERROR", "Login failed")
+		return false
+	}
+	c.ctx = ctx
+	c.token = resp.Token
+
+	logger.FromContext(ctx).Info("IRC client logged in", zap.String("nick", c.nick))
+	c.numeric("001", fmt.Sprintf("Welcome to the chat server, %s", c.nick))
+	c.numeric("002", fmt.Sprintf("Your host is %s", c.server.name))
+	c.numeric("003", "This server has no creation date")
+	c.numeric("004", c.server.name, "chat", "o", "nt")
+	c.numeric("422", "MOTD File is missing")
+
+	go c.keepAlive()
+	return true
+}
+
+func (c *client) keepAlive() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		closed := c.channels == nil
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		// an idle client is only relaying, so check its session here too
+		if !c.checkSession() {
+			c.conn.Close()
+			return
+		}
+		c.send("", "PING", c.server.name)
+	}
+}
+
+// checkSession tells the client to log in again once its session token has
+// expired or been revoked, as changing or resetting the password does
+func (c *client) checkSession() bool {
+	if err := c.server.chatServer.CheckSession(c.ctx, c.token); err != nil {
+		logger.FromContext(c.ctx).Info("IRC session ended", zap.String("nick", c.nick), zap.Error(err))
+		c.send("", "ERROR", "Session ended, reconnect to log in again")
+		return false
+	}
+	return true
+}
+
+func (c *client) join(channel string) {
+	room, ok := roomName(channel)
+	if !ok {
+		c.numeric("403", channel, "No such channel")
+		return
+	}
+
+	c.mu.Lock()
+	if c.channels == nil {
+		c.mu.Unlock()
+		return
+	}
+	if _, joined := c.channels[room]; joined {
+		c.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.channels[room] = cancel
+	c.mu.Unlock()
+
+	// only live traffic is relayed, IRC clients do not expect history
+	latest, err := storage.GetRoomSeq(c.server.redisClient.WithContext(c.ctx), room)
+	if err != nil {
+		logger.Log.Error("Failed to get room sequence", zap.Error(err))
+	}
+
+	stream := &relayStream{ctx: ctx, client: c, channel: channelName(room), after: latest}
+	go func() {
+		err := c.server.chatServer.StreamMessages(&pb.StreamMessagesRequest{Room: room}, stream)
+		if err != nil {
+			c.notice(channelName(room), "Error: "+status.Convert(err).Message())
+		}
+	}()
+
+	c.send(c.prefix(), "JOIN", channelName(room))
+	c.sendTopic(room)
+	c.names(channelName(room))
+}
+
+func (c *client) part(channel string) {
+	room, _ := roomName(channel)
+
+	c.mu.Lock()
+	cancel, joined := c.channels[room]
+	delete(c.channels, room)
+	c.mu.Unlock()
+
+	if !joined {
+		c.numeric("442", channel, "You're not on that channel")
+		return
+	}
+	cancel()
+	c.send(c.prefix(), "PART", channelName(room))
+}
+
+func (c *client) privmsg(target, text string) {
+	room, ok := roomName(target)
+	if !ok {
+		c.numeric("401", target, "Direct messages are not supported")
+		return
+	}
+	if text == "" {
+		c.numeric("412", "No text to send")
+		return
+	}
+
+	// CTCP ACTION is what clients send for /me
+	if action, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+		text = "/me " + strings.TrimSuffix(action, "\x01")
+	} else if strings.HasPrefix(text, "\x01") {
+		return
+	}
+
+	err := c.server.chatServer.PostMessage(c.ctx, &pb.ChatMessage{
+		Message:   text,
+		Timestamp: time.Now().Unix(),
+		Room:      room,
+	})
+	if err != nil {
+		c.notice(target, "Error: "+status.Convert(err).Message())
+	}
+}
+
+func (c *client) topic(msg message) {
+	room, ok := roomName(msg.param(0))
+	if !ok {
+		c.numeric("403", msg.param(0), "No such channel")
+		return
+	}
+
+	if len(msg.params) < 2 {
+		c.sendTopic(room)
+		return
+	}
+
+	// setting the topic is the /topic slash command
+	err := c.server.chatServer.PostMessage(c.ctx, &pb.ChatMessage{
+		Message:   "/topic " + msg.param(1),
+		Timestamp: time.Now().Unix(),
+		Room:      room,
+	})
+	if err != nil {
+		c.numeric("482", msg.param(0), status.Convert(err).Message())
+	}
+}
+
+func (c *client) sendTopic(room string) {
+	topic, err := storage.GetRoomTopic(c.server.redisClient.WithContext(c.ctx), room)
+	if err != nil {
+		logger.Log.Error("Failed to get topic", zap.Error(err))
+	}
+	if topic == "" {
+		c.numeric("331", channelName(room), "No topic is set")
+		return
+	}
+	c.numeric("332", channelName(room), topic)
+}
+
+func (c *client) names(channel string) {
+	room, ok := roomName(channel)
+	if !ok {
+		c.numeric("366", channel, "End of NAMES list")
+		return
+	}
+
+	online, err := c.server.chatServer.ListRoomMembersOnline(c.ctx, &pb.ListRoomMembersOnlineRequest{Room: room})
+	if err != nil {
+		online = &pb.ListRoomMembersOnlineResponse{}
+	}
+
+	names := []string{c.nick}
+	for _, p := range online.Members {
+		if p.Username != c.nick {
+			names = append(names, p.Username)
+		}
+	}
+	c.numeric("353", "=", channel, strings.Join(names, " "))
+	c.numeric("366", channel, "End of NAMES list")
+}
+
+// relay turns a room event into IRC lines
+func (c *client) relay(channel string, msg *pb.ChatMessage) {
+	from := userPrefix(msg.User)
+	own := msg.User == c.nick
+
+	switch msg.Type {
+	case pb.EventType_EVENT_MESSAGE:
+		// clients already show what they sent themselves
+		if own {
+			return
+		}
+		text := msg.Message
+		for _, attachment := range msg.Attachments {
+			text += fmt.Sprintf(" [attachment %s: %s]", attachment.Id, attachment.Filename)
+		}
+		for _, line := range lines(text) {
+			c.send(from, "PRIVMSG", channel, line)
+		}
+	case pb.EventType_EVENT_ACTION:
+		if own {
+			return
+		}
+		c.send(from, "PRIVMSG", channel, "\x01ACTION "+msg.Message+"\x01")
+	case pb.EventType_EVENT_JOIN:
+		if !own {
+			c.send(from, "JOIN", channel)
+		}
+	case pb.EventType_EVENT_LEAVE:
+		if !own {
+			c.send(from, "PART", channel)
+		}
+	case pb.EventType_EVENT_TOPIC:
+		c.send(from, "TOPIC", channel, msg.Message)
+	case pb.EventType_EVENT_NICK:
+		// nicks are per room here, but global on IRC
+		if msg.Message == "" {
+			c.notice(channel, msg.User+" cleared their nick")
+		} else {
+			c.notice(channel, msg.User+" is now known as "+msg.Message)
+		}
+	case pb.EventType_EVENT_EDIT:
+		c.notice(channel, fmt.Sprintf("%s edited a message: %s", msg.User, msg.Message))
+	case pb.EventType_EVENT_SYSTEM, pb.EventType_EVENT_GOING_AWAY:
+		c.notice(channel, msg.Message)
+	}
+}
+
+func (c *client) notice(target, text string) {
+	for _, line := range lines(text) {
+		c.send(c.server.name, "NOTICE", target, line)
+	}
+}
+
+func (c *client) numeric(code string, params ...string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(c.server.name, code, append([]string{nick}, params...)...)
+}
+
+func (c *client) send(prefix, command string, params ...string) {
+	line := formatMessage(prefix, command, params)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		logger.Log.Debug("Failed to write to IRC client", zap.Error(err))
+	}
+}
+
+func (c *client) prefix() string {
+	return userPrefix(c.nick)
+}
+
+func userPrefix(nick string) string {
+	return nick + "!" + nick + "@chat"
+}
+
+func channelName(room string) string {
+	return "#" + room
+}
+
+func roomName(channel string) (string, bool) {
+	room, ok := strings.CutPrefix(channel, "#")
+	return room, ok && room != ""
+}
+
+// lines splits text for IRC, which has no multi-line messages
+func lines(text string) []string {
+	var out []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
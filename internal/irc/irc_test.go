@@ -0,0 +1,220 @@
+package irc
+
+import (
+	"bufio"
+	"chat_app/config"
+	"chat_app/internal/audit"
+	"chat_app/internal/blob"
+	"chat_app/internal/chat"
+	"chat_app/internal/logger"
+	"chat_app/internal/notifier"
+	"chat_app/internal/ratelimit"
+	"chat_app/internal/search"
+	"chat_app/internal/storage"
+	"chat_app/internal/webhook"
+	pb "chat_app/pb"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/time/rate"
+)
+
+const testPassword = "Password123!"
+
+// newTestServer starts an IRC server on a local port with alice and bob registered
+func newTestServer(t *testing.T) (*chat.ChatServer, *redis.Client, string) {
+	t.Helper()
+	if config.AppConfig == nil {
+		if err := config.LoadConfig(""); err != nil {
+			t.Fatal(err)
+		}
+		config.AppConfig.Logger.Level = "error"
+		if err := logger.InitLogger(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	blobStore, err := blob.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks := webhook.NewDispatcher(redisClient, webhook.Options{MaxAttempts: 1, Timeout: time.Second, MaxConcurrent: 1})
+	chatServer := chat.NewChatServer(ratelimit.NewRateLimiter(rate.Inf, 100), redisClient, search.NewRedisIndex(redisClient), blobStore, webhooks, audit.NewLog(audit.NewRedisSink(redisClient, 0)), notifier.NewLogNotifier(), nil)
+
+	for _, username := range []string{"alice", "bob"} {
+		if _, err := chatServer.Register(context.Background(), &pb.RegisterRequest{Username: username, Password: testPassword}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(chatServer, redisClient, "irc.test")
+	go server.Serve(lis)
+	t.Cleanup(server.Shutdown)
+	return chatServer, redisClient, lis.Addr().String()
+}
+
+// testClient is a scripted IRC connection
+type testClient struct {
+	t     *testing.T
+	conn  net.Conn
+	lines chan string
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{t: t, conn: conn, lines: make(chan string, 100)}
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+		close(c.lines)
+	}()
+	return c
+}
+
+// login registers the connection like an IRC client does
+func login(t *testing.T, addr, nick string) *testClient {
+	t.Helper()
+	c := dial(t, addr)
+	c.send("CAP LS 302", "PASS "+testPassword, "NICK "+nick, "USER "+nick+" 0 * :"+nick, "CAP END")
+	c.expect(" 001 " + nick + " ")
+	return c
+}
+
+func (c *testClient) send(lines ...string) {
+	c.t.Helper()
+	for _, line := range lines {
+		if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// expect skips lines until one contains want and returns it
+func (c *testClient) expect(want string) string {
+	c.t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %q", want)
+			}
+			if strings.Contains(line, want) {
+				return line
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.lines:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			c.t.Fatal("connection was not closed")
+		}
+	}
+}
+
+func TestJoinAndPrivmsg(t *testing.T) {
+	_, redisClient, addr := newTestServer(t)
+	alice := login(t, addr, "alice")
+	bob := login(t, addr, "bob")
+
+	alice.send("JOIN #general")
+	alice.expect(":alice!alice@chat JOIN #general")
+	alice.expect(" 331 alice #general :No topic is set")
+	alice.expect(" 366 alice #general ")
+
+	bob.send("JOIN #general")
+	bob.expect(" 353 bob = #general :bob alice")
+	alice.expect(":bob!bob@chat JOIN #general")
+
+	alice.send("PRIVMSG #general :hello bob", "PRIVMSG #general :\x01ACTION waves\x01")
+	bob.expect(":alice!alice@chat PRIVMSG #general :hello bob")
+	bob.expect(":alice!alice@chat PRIVMSG #general :\x01ACTION waves\x01")
+
+	messages, err := storage.GetLastNMessages(redisClient, "general", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].User != "alice" || messages[0].Message != "hello bob" || messages[1].Type != pb.EventType_EVENT_ACTION {
+		t.Errorf("got history %v", messages)
+	}
+
+	bob.send("PRIVMSG alice :hi")
+	bob.expect(" 401 bob alice ")
+	bob.send("PART #general")
+	alice.expect(":bob!bob@chat PART #general")
+}
+
+func TestRegistration(t *testing.T) {
+	_, _, addr := newTestServer(t)
+
+	wrong := dial(t, addr)
+	wrong.send("PASS nope", "NICK alice", "USER alice 0 * :alice")
+	wrong.expect(" 464 alice :Password incorrect")
+	wrong.expect("ERROR :Login failed")
+	wrong.expectClosed()
+
+	noPass := dial(t, addr)
+	noPass.send("NICK alice", "USER alice 0 * :alice")
+	noPass.expect(" 464 alice :Password required")
+	noPass.expectClosed()
+
+	early := dial(t, addr)
+	early.send("JOIN #general")
+	early.expect(" 451 * :You have not registered")
+
+	alice := login(t, addr, "alice")
+	alice.send("NICK mallory")
+	alice.expect(" 462 alice :You may not reregister")
+}
+
+func TestPasswordChangeEndsSession(t *testing.T) {
+	chatServer, redisClient, addr := newTestServer(t)
+	alice := login(t, addr, "alice")
+	alice.send("JOIN #general")
+	alice.expect(" 366 alice #general ")
+
+	// change the password with the IRC connection's own session
+	token, err := storage.GetToken(redisClient, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := chatServer.Authenticate(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chatServer.ChangePassword(ctx, &pb.ChangePasswordRequest{CurrentPassword: testPassword, NewPassword: "Different456!"}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.send("PRIVMSG #general :still here?")
+	alice.expect("ERROR :Session ended")
+	alice.expectClosed()
+}
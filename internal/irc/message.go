@@ -0,0 +1,110 @@
+package irc
+
+import (
+	pb "chat_app/pb"
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// message is a parsed IRC line: [:prefix] COMMAND params... [:trailing]
+type message struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+func parseMessage(line string) message {
+	var msg message
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, ":") {
+		msg.prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			msg.params = append(msg.params, line[1:])
+			break
+		}
+
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		if param == "" {
+			continue
+		}
+		if msg.command == "" {
+			msg.command = strings.ToUpper(param)
+		} else {
+			msg.params = append(msg.params, param)
+		}
+	}
+
+	return msg
+}
+
+func (m message) param(i int) string {
+	if i < len(m.params) {
+		return m.params[i]
+	}
+	return ""
+}
+
+// formatMessage builds a line to send. Line breaks in params are replaced so
+// that room messages cannot inject IRC commands.
+func formatMessage(prefix, command string, params []string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+
+	for i, param := range params {
+		param = strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == 0 {
+				return ' '
+			}
+			return r
+		}, param)
+
+		last := i == len(params)-1
+		if last && (param == "" || strings.Contains(param, " ") || strings.HasPrefix(param, ":")) {
+			param = ":" + param
+		}
+		b.WriteString(" " + param)
+	}
+
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// relayStream lets the IRC client use ChatServer.StreamMessages, so it gets
+// the same presence, join and leave handling as gRPC clients
+type relayStream struct {
+	ctx     context.Context
+	client  *client
+	channel string
+	// history up to this seq has been sent before the client joined
+	after int64
+}
+
+func (s *relayStream) Send(msg *pb.ChatMessage) error {
+	history := msg.Type == pb.EventType_EVENT_MESSAGE || msg.Type == pb.EventType_EVENT_ACTION
+	if history && msg.Seq <= s.after {
+		return nil
+	}
+	s.client.relay(s.channel, msg)
+	return nil
+}
+
+func (s *relayStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *relayStream) SetHeader(metadata.MD) error  { return nil }
+func (s *relayStream) SendHeader(metadata.MD) error { return nil }
+func (s *relayStream) SetTrailer(metadata.MD)       {}
+func (s *relayStream) SendMsg(m interface{}) error  { return s.Send(m.(*pb.ChatMessage)) }
+func (s *relayStream) RecvMsg(m interface{}) error  { return nil }
@@ -0,0 +1,90 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader carries the request ID in HTTP requests and responses. In
+// gRPC metadata it is the lowercase "x-request-id".
+const RequestIDHeader = "X-Request-ID"
+
+// IDs sent by clients are kept if they look like one, so they can't inject
+// anything into log lines
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+type contextKey struct{}
+
+// requestLogger is shared by every context derived from the request's, so
+// fields added deeper in the call, like the authenticated user, also end up
+// on the line logged when the request finishes
+type requestLogger struct {
+	id string
+
+	mu  sync.Mutex
+	log *zap.Logger
+}
+
+// RequestID returns id if a client may choose it as its request ID, and a new
+// random ID otherwise
+func RequestID(id string) string {
+	if requestIDPattern.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewRequestContext returns ctx with a logger for the request id, which logs
+// id, the trace ID if ctx is traced, and fields on every line
+func NewRequestContext(ctx context.Context, id string, fields ...zap.Field) context.Context {
+	fields = append([]zap.Field{zap.String("requestId", id)}, fields...)
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		fields = append(fields, zap.String("traceId", spanContext.TraceID().String()))
+	}
+	return context.WithValue(ctx, contextKey{}, &requestLogger{id: id, log: Log.With(fields...)})
+}
+
+// FromContext returns the logger of the request in ctx, or Log for work done
+// outside any request
+func FromContext(ctx context.Context) *zap.Logger {
+	if rl := requestLoggerFrom(ctx); rl != nil {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		return rl.log
+	}
+	return Log
+}
+
+// AddFields adds fields to the rest of the request's log lines. It does
+// nothing outside a request.
+func AddFields(ctx context.Context, fields ...zap.Field) {
+	if rl := requestLoggerFrom(ctx); rl != nil {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		rl.log = rl.log.With(fields...)
+	}
+}
+
+// RequestIDFromContext returns the ID of the request in ctx, or ""
+func RequestIDFromContext(ctx context.Context) string {
+	if rl := requestLoggerFrom(ctx); rl != nil {
+		return rl.id
+	}
+	return ""
+}
+
+func requestLoggerFrom(ctx context.Context) *requestLogger {
+	if ctx == nil {
+		return nil
+	}
+	rl, _ := ctx.Value(contextKey{}).(*requestLogger)
+	return rl
+}
@@ -0,0 +1,85 @@
+package logger
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var requestIDKey = strings.ToLower(RequestIDHeader)
+
+// UnaryServerInterceptor gives each call a request ID and a logger carrying
+// it, and logs the call when it returns
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, finish := startRPC(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	finish(err)
+	return resp, err
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streams, which are
+// logged when they end
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, finish := startRPC(ss.Context(), info.FullMethod)
+	err := handler(srv, &loggedStream{ServerStream: ss, ctx: ctx})
+	finish(err)
+	return err
+}
+
+type loggedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *loggedStream) Context() context.Context {
+	return s.ctx
+}
+
+func startRPC(ctx context.Context, method string) (context.Context, func(error)) {
+	// calls through the HTTP gateways already belong to a request, which is logged there
+	if requestLoggerFrom(ctx) != nil {
+		AddFields(ctx, zap.String("method", method))
+		return ctx, func(error) {}
+	}
+	// health probes would drown out everything else
+	if strings.HasPrefix(method, "/grpc.health.v1.Health/") {
+		return ctx, func(error) {}
+	}
+
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestIDKey); len(values) > 0 {
+			id = values[0]
+		}
+	}
+	id = RequestID(id)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+
+	ctx = NewRequestContext(ctx, id, zap.String("method", method))
+	start := time.Now()
+	return ctx, func(err error) {
+		code := status.Code(err)
+		FromContext(ctx).Log(levelFor(code), "Finished RPC",
+			zap.String("code", code.String()),
+			zap.Duration("duration", time.Since(start)),
+			zap.Error(err),
+		)
+	}
+}
+
+// levelFor logs failures that are the server's fault as errors
+func levelFor(code codes.Code) zapcore.Level {
+	switch code {
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		return zapcore.ErrorLevel
+	default:
+		return zapcore.InfoLevel
+	}
+}
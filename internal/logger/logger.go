@@ -10,6 +10,9 @@ import (
 
 var Log *zap.Logger
 
+// level is shared by every logger built from Log, so SetLevel applies to all of them
+var level = zap.NewAtomicLevel()
+
 func InitLogger() error {
 	if config.AppConfig == nil {
 		return fmt.Errorf("configuration not loaded")
@@ -20,16 +23,30 @@ func InitLogger() error {
 	zapConfig.OutputPaths = config.AppConfig.Logger.OutputPaths
 	zapConfig.ErrorOutputPaths = config.AppConfig.Logger.ErrorOutputPaths
 
-	level, err := zapcore.ParseLevel(config.AppConfig.Logger.Level)
-	if err != nil {
+	if err := SetLevel(config.AppConfig.Logger.Level); err != nil {
 		return err
 	}
-	zapConfig.Level = zap.NewAtomicLevelAt(level)
+	zapConfig.Level = level
+
+	SetRedaction(config.AppConfig.Logger.Redact.Messages, config.AppConfig.Logger.Redact.Credentials)
 
-	Log, err = zapConfig.Build()
+	var err error
+	Log, err = zapConfig.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &redactingCore{Core: core}
+	}))
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// SetLevel changes the log level without rebuilding the logger
+func SetLevel(name string) error {
+	l, err := zapcore.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.SetLevel(l)
+	return nil
+}
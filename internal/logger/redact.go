@@ -0,0 +1,72 @@
+package logger
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const redacted = "[redacted]"
+
+// fields with these keys hold what users wrote
+var messageKeys = map[string]bool{
+	"message": true,
+	"text":    true,
+}
+
+// fields with these keys hold secrets
+var credentialKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"secret":        true,
+	"authorization": true,
+}
+
+var redactMessages, redactCredentials atomic.Bool
+
+// SetRedaction chooses whether message content and credentials are replaced
+// by "[redacted]" in log lines. Redaction goes by field key, so code logging
+// such a value must use one of the keys above.
+func SetRedaction(messages, credentials bool) {
+	redactMessages.Store(messages)
+	redactCredentials.Store(credentials)
+}
+
+// redactingCore rewrites fields before they reach the wrapped core
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(redact(fields))}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(entry, redact(fields))
+}
+
+func redact(fields []zapcore.Field) []zapcore.Field {
+	var out []zapcore.Field
+	for i, field := range fields {
+		if !(redactMessages.Load() && messageKeys[field.Key]) && !(redactCredentials.Load() && credentialKeys[field.Key]) {
+			continue
+		}
+		// copy before the first change, the caller owns fields
+		if out == nil {
+			out = append([]zapcore.Field(nil), fields...)
+		}
+		out[i] = zap.String(field.Key, redacted)
+	}
+	if out == nil {
+		return fields
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package logger
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func newObservedLogger(t *testing.T, messages, credentials bool) (*zap.Logger, *observer.ObservedLogs) {
+	t.Helper()
+	SetRedaction(messages, credentials)
+	t.Cleanup(func() { SetRedaction(false, false) })
+	core, logs := observer.New(zapcore.DebugLevel)
+	return zap.New(&redactingCore{Core: core}), logs
+}
+
+func TestRedaction(t *testing.T) {
+	tests := []struct {
+		name        string
+		messages    bool
+		credentials bool
+		want        map[string]interface{}
+	}{
+		{"nothing", false, false, map[string]interface{}{"message": "hi", "text": "hello", "password": "hunter2", "token": "abc", "user": "alice"}},
+		{"messages", true, false, map[string]interface{}{"message": redacted, "text": redacted, "password": "hunter2", "token": "abc", "user": "alice"}},
+		{"credentials", false, true, map[string]interface{}{"message": "hi", "text": "hello", "password": redacted, "token": redacted, "user": "alice"}},
+		{"both", true, true, map[string]interface{}{"message": redacted, "text": redacted, "password": redacted, "token": redacted, "user": "alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log, logs := newObservedLogger(t, tt.messages, tt.credentials)
+
+			// fields added with With go through the core's With
+			log.With(zap.String("token", "abc")).Info("Sent",
+				zap.String("message", "hi"),
+				zap.String("text", "hello"),
+				zap.String("password", "hunter2"),
+				zap.String("user", "alice"),
+			)
+
+			got := logs.All()[0].ContextMap()
+			for key, want := range tt.want {
+				if got[key] != want {
+					t.Errorf("%s = %v, want %v", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactionOfOtherFieldTypes(t *testing.T) {
+	log, logs := newObservedLogger(t, false, true)
+
+	log.Info("Configured",
+		zap.Any("secret", map[string]string{"key": "value"}),
+		zap.ByteString("authorization", []byte("Bearer abc")),
+		zap.Int("attempts", 3),
+	)
+
+	got := logs.All()[0].ContextMap()
+	if got["secret"] != redacted || got["authorization"] != redacted || got["attempts"] != int64(3) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestRedactionKeepsCallersFields(t *testing.T) {
+	SetRedaction(true, true)
+	t.Cleanup(func() { SetRedaction(false, false) })
+
+	fields := []zapcore.Field{zap.String("user", "alice"), zap.String("password", "hunter2")}
+	out := redact(fields)
+	if out[1].String != redacted {
+		t.Errorf("got %v", out[1])
+	}
+	if fields[1].String != "hunter2" {
+		t.Error("redact changed the caller's fields")
+	}
+	if clean := []zapcore.Field{zap.String("user", "alice")}; &redact(clean)[0] != &clean[0] {
+		t.Error("fields without anything to redact were copied")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for _, id := range []string{"abc-123", "trace.span:1_2"} {
+		if got := RequestID(id); got != id {
+			t.Errorf("RequestID(%q) = %q", id, got)
+		}
+	}
+	for _, id := range []string{"", "has space", "line\nbreak", `{"injected":true}`, string(make([]byte, 65))} {
+		if got := RequestID(id); got == id || !requestIDPattern.MatchString(got) {
+			t.Errorf("RequestID(%q) = %q", id, got)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package markdown parses the small Markdown dialect used in chat messages
+// into a flat list of segments. Segments only ever carry plain text, so
+// clients can render them without interpreting any user supplied markup.
+//
+// Supported syntax:
+//
+//	**bold**  *italic*  _italic_  `code`  [text](url)  @mention
+//	```lang
+//	code block
+//	```
+//
+// Bare http and https URLs are turned into links.
+package markdown
+
+import (
+	pb "chat_app/pb"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const fence = "```"
+
+// Parse splits a message into segments. Anything that does not form valid
+// markup is kept as plain text.
+func Parse(text string) []*pb.Segment {
+	var p parser
+
+	lines := strings.SplitAfter(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(trimmed, fence) {
+			p.inline(lines[i])
+			continue
+		}
+
+		// look for the closing fence, otherwise the line is plain text
+		end := -1
+		for j := i + 1; j < len(lines); j++ {
+			if strings.TrimSpace(lines[j]) == fence {
+				end = j
+				break
+			}
+		}
+		if end == -1 {
+			p.inline(lines[i])
+			continue
+		}
+
+		code := strings.TrimSuffix(strings.Join(lines[i+1:end], ""), "\n")
+		p.add(pb.SegmentType_SEGMENT_CODE_BLOCK, code, "")
+		p.segments[len(p.segments)-1].Language = sanitizeLanguage(strings.TrimPrefix(trimmed, fence))
+		i = end
+	}
+
+	p.flush()
+	return p.segments
+}
+
+// Mentions returns the distinct usernames mentioned in the segments
+func Mentions(segments []*pb.Segment) []string {
+	seen := make(map[string]bool)
+	var mentions []string
+	for _, seg := range segments {
+		if seg.Type == pb.SegmentType_SEGMENT_MENTION && !seen[seg.Text] {
+			seen[seg.Text] = true
+			mentions = append(mentions, seg.Text)
+		}
+	}
+	return mentions
+}
+
+// SafeURL reports whether a link target may be shown to clients
+func SafeURL(raw string) bool {
+	for _, r := range raw {
+		if unicode.IsControl(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	default:
+		return false
+	}
+}
+
+type parser struct {
+	segments []*pb.Segment
+	text     strings.Builder
+}
+
+func (p *parser) add(segmentType pb.SegmentType, text, url string) {
+	p.flush()
+	p.segments = append(p.segments, &pb.Segment{Type: segmentType, Text: text, Url: url})
+}
+
+// flush turns pending plain text into a text segment
+func (p *parser) flush() {
+	if p.text.Len() == 0 {
+		return
+	}
+	p.segments = append(p.segments, &pb.Segment{Type: pb.SegmentType_SEGMENT_TEXT, Text: p.text.String()})
+	p.text.Reset()
+}
+
+func (p *parser) inline(s string) {
+	for i := 0; i < len(s); {
+		if n := p.inlineAt(s, i); n > 0 {
+			i += n
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		p.text.WriteRune(r)
+		i += size
+	}
+}
+
+// inlineAt tries to parse markup starting at s[i] and returns the number of bytes consumed
+func (p *parser) inlineAt(s string, i int) int {
+	rest := s[i:]
+	prev, _ := utf8.DecodeLastRuneInString(s[:i])
+	atBoundary := i == 0 || !isWordRune(prev)
+
+	switch {
+	case rest[0] == '\\' && len(rest) > 1 && isPunct(rest[1]):
+		p.text.WriteByte(rest[1])
+		return 2
+
+	case rest[0] == '`':
+		if end := strings.IndexByte(rest[1:], '`'); end > 0 {
+			p.add(pb.SegmentType_SEGMENT_CODE, rest[1:1+end], "")
+			return end + 2
+		}
+
+	case strings.HasPrefix(rest, "**"):
+		if end := strings.Index(rest[2:], "**"); end > 0 {
+			p.add(pb.SegmentType_SEGMENT_BOLD, rest[2:2+end], "")
+			return end + 4
+		}
+
+	case (rest[0] == '*' || rest[0] == '_') && atBoundary:
+		if end := closingEmphasis(rest, rest[0]); end > 0 {
+			p.add(pb.SegmentType_SEGMENT_ITALIC, rest[1:end], "")
+			return end + 1
+		}
+
+	case rest[0] == '[':
+		return p.link(rest)
+
+	case rest[0] == '@' && atBoundary:
+		name := mentionName(rest[1:])
+		if name != "" {
+			p.add(pb.SegmentType_SEGMENT_MENTION, name, "")
+			return len(name) + 1
+		}
+
+	case (strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")) && atBoundary:
+		raw := bareURL(rest)
+		if SafeURL(raw) {
+			p.add(pb.SegmentType_SEGMENT_LINK, raw, raw)
+			return len(raw)
+		}
+	}
+
+	return 0
+}
+
+// link parses [text](url); unsafe targets fall back to plain text
+func (p *parser) link(rest string) int {
+	closeText := strings.Index(rest, "](")
+	if closeText < 1 {
+		return 0
+	}
+	closeURL := closingParen(rest[closeText+2:])
+	if closeURL < 1 {
+		return 0
+	}
+
+	text := rest[1:closeText]
+	target := rest[closeText+2 : closeText+2+closeURL]
+	consumed := closeText + 2 + closeURL + 1
+
+	if !SafeURL(target) {
+		p.text.WriteString(text)
+		return consumed
+	}
+
+	p.add(pb.SegmentType_SEGMENT_LINK, text, target)
+	return consumed
+}
+
+// closingParen finds the ")" ending a link target, allowing balanced parentheses inside it
+func closingParen(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case '\n':
+			return -1
+		}
+	}
+	return -1
+}
+
+func closingEmphasis(rest string, marker byte) int {
+	end := strings.IndexByte(rest[1:], marker)
+	if end < 1 {
+		return -1
+	}
+	end++
+
+	// "* foo *" is not emphasis, and neither is "*foo*bar"
+	if rest[1] == ' ' || rest[end-1] == ' ' {
+		return -1
+	}
+	if next, _ := utf8.DecodeRuneInString(rest[end+1:]); end+1 < len(rest) && isWordRune(next) {
+		return -1
+	}
+	return end
+}
+
+func mentionName(s string) string {
+	end := 0
+	for end < len(s) {
+		c := s[end]
+		if c == '_' || c == '-' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			end++
+			continue
+		}
+		break
+	}
+	// a trailing dot ends the sentence rather than the name
+	return strings.TrimRight(s[:end], ".")
+}
+
+func bareURL(s string) string {
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '<' || r == '>' || r == '"'
+	})
+	if end == -1 {
+		end = len(s)
+	}
+	return strings.TrimRight(s[:end], ".,;:!?)")
+}
+
+func sanitizeLanguage(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '+' || r == '_' || r == '#' || r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return -1
+	}, strings.TrimSpace(s))
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isPunct(c byte) bool {
+	return strings.IndexByte("\\`*_[]()@#!~", c) >= 0
+}
@@ -0,0 +1,93 @@
+package markdown
+
+import (
+	pb "chat_app/pb"
+	"testing"
+)
+
+func text(s string) *pb.Segment { return &pb.Segment{Type: pb.SegmentType_SEGMENT_TEXT, Text: s} }
+
+func link(s, url string) *pb.Segment {
+	return &pb.Segment{Type: pb.SegmentType_SEGMENT_LINK, Text: s, Url: url}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		safe bool
+	}{
+		{"https://example.com/a?b=c#d", true},
+		{"http://example.com", true},
+		{"HTTPS://EXAMPLE.COM/", true},
+		{"mailto:alice@example.com", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"JAVASCRIPT:alert(1)", false},
+		{"javascript://example.com/%0Aalert(1)", false},
+		{" javascript:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		{"java\nscript:alert(1)", false},
+		{"\x01javascript:alert(1)", false},
+		{"data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==", false},
+		{"DaTa:text/html,<script>alert(1)</script>", false},
+		{"vbscript:msgbox(1)", false},
+		{"VBScript:msgbox(1)", false},
+		{"file:///etc/passwd", false},
+		{"//evil.example.com/", false},
+		{"/relative/path", false},
+		{"http:///no-host", false},
+		{"mailto:", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := SafeURL(tt.url); got != tt.safe {
+			t.Errorf("SafeURL(%q) = %v, want %v", tt.url, got, tt.safe)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []*pb.Segment
+	}{
+		{"javascript link", "[x](javascript:alert(1))", []*pb.Segment{text("x")}},
+		{"mixed-case javascript link", "[x](JaVaScRiPt:alert(1)) ok", []*pb.Segment{text("x ok")}},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", []*pb.Segment{text("x")}},
+		{"vbscript link", "a [x](VBScript:msgbox(1)) b", []*pb.Segment{text("a x b")}},
+		{"link with a space", "[x](java script:alert(1))", []*pb.Segment{text("x")}},
+		{"bare javascript url", "javascript:alert(1)", []*pb.Segment{text("javascript:alert(1)")}},
+		{"script tag in text", "<script>alert(1)</script>", []*pb.Segment{text("<script>alert(1)</script>")}},
+		{"script tag in code span", "run `<script>alert(1)</script>` now", []*pb.Segment{
+			text("run "),
+			{Type: pb.SegmentType_SEGMENT_CODE, Text: "<script>alert(1)</script>"},
+			text(" now"),
+		}},
+		{"script tag in bold", "**<b onload=x>hi</b>**", []*pb.Segment{{Type: pb.SegmentType_SEGMENT_BOLD, Text: "<b onload=x>hi</b>"}}},
+		{"script tag in code block", "```<script>\"\n<script>alert(1)</script>\n```", []*pb.Segment{
+			{Type: pb.SegmentType_SEGMENT_CODE_BLOCK, Text: "<script>alert(1)</script>", Language: "script"},
+		}},
+		{"safe link", "[docs](https://example.com/docs)", []*pb.Segment{link("docs", "https://example.com/docs")}},
+		{"bare url", "see https://example.com/a.", []*pb.Segment{text("see "), link("https://example.com/a", "https://example.com/a"), text(".")}},
+		{"bare url stops at a tag", "https://example.com/<script>", []*pb.Segment{link("https://example.com/", "https://example.com/"), text("<script>")}},
+		{"mention", "hi @alice.", []*pb.Segment{text("hi "), {Type: pb.SegmentType_SEGMENT_MENTION, Text: "alice"}, text(".")}},
+		{"escaped markup", `\[x\](javascript:alert(1))`, []*pb.Segment{text("[x](javascript:alert(1))")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse(tt.in)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Parse(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+			for i := range got {
+				if got[i].Type != tt.want[i].Type || got[i].Text != tt.want[i].Text || got[i].Url != tt.want[i].Url || got[i].Language != tt.want[i].Language {
+					t.Errorf("Parse(%q)[%d] = %v, want %v", tt.in, i, got[i], tt.want[i])
+				}
+				if got[i].Url != "" && !SafeURL(got[i].Url) {
+					t.Errorf("Parse(%q)[%d] links to unsafe url %q", tt.in, i, got[i].Url)
+				}
+			}
+		})
+	}
+}
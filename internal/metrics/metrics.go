@@ -0,0 +1,90 @@
+// Package metrics defines the Prometheus metrics of the server. They are
+// registered with the default registry and served at /metrics.
+package metrics
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	RPCRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_rpc_requests_total",
+		Help: "ChatService calls by method and status code, over gRPC and the HTTP gateways.",
+	}, []string{"method", "code"})
+
+	RPCDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chat_rpc_duration_seconds",
+		Help:    "Duration of unary ChatService calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	ActiveStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chat_streams_active",
+		Help: "Open server streams by method, including server-sent event streams.",
+	}, []string{"method"})
+
+	ActiveWebSockets = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_websockets_active",
+		Help: "Open /ws connections.",
+	})
+
+	MessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_messages_sent_total",
+		Help: "Messages saved and published to rooms, by event type.",
+	}, []string{"type"})
+
+	RateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_rate_limited_total",
+		Help: "Messages rejected by the rate limiter.",
+	})
+
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_logins_total",
+		Help: "Login attempts by result: success, failure, or locked when refused during a lockout.",
+	}, []string{"result"})
+
+	StorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chat_storage_duration_seconds",
+		Help:    "Duration of storage functions, which each make one or more Redis calls.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"operation"})
+)
+
+const servicePrefix = "/chat.ChatService/"
+
+// UnaryServerInterceptor counts and times ChatService calls
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method, ok := strings.CutPrefix(info.FullMethod, servicePrefix)
+	if !ok {
+		return handler(ctx, req)
+	}
+	start := time.Now()
+
+	resp, err := handler(ctx, req)
+
+	RPCDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	RPCRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// StreamServerInterceptor counts ChatService streams and tracks how many are open
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	method, ok := strings.CutPrefix(info.FullMethod, servicePrefix)
+	if !ok {
+		return handler(srv, ss)
+	}
+	ActiveStreams.WithLabelValues(method).Inc()
+	defer ActiveStreams.WithLabelValues(method).Dec()
+
+	err := handler(srv, ss)
+
+	RPCRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	return err
+}
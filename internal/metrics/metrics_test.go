@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// calls returns how many calls to method were timed
+func calls(t *testing.T, method string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := RPCDuration.WithLabelValues(method).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	call := func(fullMethod string, err error) {
+		UnaryServerInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: fullMethod}, func(context.Context, interface{}) (interface{}, error) {
+			return nil, err
+		})
+	}
+
+	call("/chat.ChatService/ListRooms", nil)
+	call("/chat.ChatService/ListRooms", nil)
+	call("/chat.ChatService/ListRooms", status.Error(codes.NotFound, "no such room"))
+	// other services, such as health checks, are left out
+	call("/grpc.health.v1.Health/Check", nil)
+
+	if got := testutil.ToFloat64(RPCRequests.WithLabelValues("ListRooms", "OK")); got != 2 {
+		t.Errorf("ListRooms OK counted %v times", got)
+	}
+	if got := testutil.ToFloat64(RPCRequests.WithLabelValues("ListRooms", "NotFound")); got != 1 {
+		t.Errorf("ListRooms NotFound counted %v times", got)
+	}
+	if got := calls(t, "ListRooms"); got != 3 {
+		t.Errorf("ListRooms timed %d times", got)
+	}
+	if got := testutil.ToFloat64(RPCRequests.WithLabelValues("/grpc.health.v1.Health/Check", "OK")) + testutil.ToFloat64(RPCRequests.WithLabelValues("Check", "OK")); got != 0 {
+		t.Errorf("health checks counted %v times", got)
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	info := &grpc.StreamServerInfo{FullMethod: "/chat.ChatService/StreamMessages", IsServerStream: true}
+	err := StreamServerInterceptor(nil, nil, info, func(interface{}, grpc.ServerStream) error {
+		if got := testutil.ToFloat64(ActiveStreams.WithLabelValues("StreamMessages")); got != 1 {
+			t.Errorf("%v active streams while one is open", got)
+		}
+		return status.Error(codes.Unavailable, "going away")
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v", err)
+	}
+
+	if got := testutil.ToFloat64(ActiveStreams.WithLabelValues("StreamMessages")); got != 0 {
+		t.Errorf("%v active streams after it ended", got)
+	}
+	if got := testutil.ToFloat64(RPCRequests.WithLabelValues("StreamMessages", "Unavailable")); got != 1 {
+		t.Errorf("StreamMessages Unavailable counted %v times", got)
+	}
+}
@@ -0,0 +1,395 @@
+// Package mockidp is an OpenID Connect provider for development and tests.
+// It knows no passwords: whoever uses it types a username and is logged in
+// as that user. Any client ID and redirect URI are accepted.
+//
+// It supports the authorization code flow, with or without PKCE, and the
+// device flow, and signs ID tokens with a key generated when it starts.
+package mockidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	keyID          = "mockidp"
+	codeTTL        = time.Minute
+	deviceCodeTTL  = 10 * time.Minute
+	tokenTTL       = time.Hour
+	deviceGrant    = "urn:ietf:params:oauth:grant-type:device_code"
+	pollInterval   = 1
+	userCodeLength = 8
+)
+
+// authCode is an authorization code waiting to be redeemed at the token endpoint
+type authCode struct {
+	clientID      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	username      string
+	expires       time.Time
+}
+
+// deviceCode is a device login; username is set once the user approved it
+type deviceCode struct {
+	clientID string
+	userCode string
+	username string
+	expires  time.Time
+}
+
+type Server struct {
+	issuer string
+	key    *rsa.PrivateKey
+	mux    *http.ServeMux
+
+	mu          sync.Mutex
+	codes       map[string]*authCode
+	deviceCodes map[string]*deviceCode
+	// user code -> device code
+	userCodes map[string]string
+}
+
+// New returns a provider that is reachable at issuer, which is where it
+// points clients to in its discovery document
+func New(issuer string) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		issuer:      strings.TrimSuffix(issuer, "/"),
+		key:         key,
+		mux:         http.NewServeMux(),
+		codes:       make(map[string]*authCode),
+		deviceCodes: make(map[string]*deviceCode),
+		userCodes:   make(map[string]string),
+	}
+	s.mux.HandleFunc("/.well-known/openid-configuration", s.handleDiscovery)
+	s.mux.HandleFunc("/jwks", s.handleJWKS)
+	s.mux.HandleFunc("/authorize", s.handleAuthorize)
+	s.mux.HandleFunc("/token", s.handleToken)
+	s.mux.HandleFunc("/device/code", s.handleDeviceCode)
+	s.mux.HandleFunc("/device", s.handleDevice)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.issuer,
+		"authorization_endpoint":                s.issuer + "/authorize",
+		"token_endpoint":                        s.issuer + "/token",
+		"jwks_uri":                              s.issuer + "/jwks",
+		"device_authorization_endpoint":         s.issuer + "/device/code",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"grant_types_supported":                 []string{"authorization_code", deviceGrant},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"claims_supported":                      []string{"sub", "preferred_username", "email"},
+	})
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	pub := s.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+var authorizeForm = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mock identity provider</title></head>
+<body>
+    <h1>Log in to {{.client_id}}</h1>
+    <form method="post">
+        {{range $name, $value := .}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+        {{end}}<input name="username" placeholder="username" autofocus>
+        <button type="submit">Log in</button>
+        <button type="submit" name="deny" value="1">Deny</button>
+    </form>
+</body>
+</html>
+`))
+
+// handleAuthorize shows a login form for the request's parameters, and
+// redirects back to the client with a code once it is submitted
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() || r.Form.Get("client_id") == "" {
+		http.Error(w, "client_id and an absolute redirect_uri are required", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("response_type") != "code" {
+		http.Error(w, "only the code response type is supported", http.StatusBadRequest)
+		return
+	}
+	if method := r.Form.Get("code_challenge_method"); r.Form.Get("code_challenge") != "" && method != "S256" {
+		http.Error(w, "only the S256 code challenge method is supported", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		params := make(map[string]string)
+		for _, name := range []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+			params[name] = r.Form.Get(name)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		authorizeForm.Execute(w, params)
+		return
+	}
+
+	query := redirectURI.Query()
+	query.Set("state", r.Form.Get("state"))
+	username := strings.TrimSpace(r.Form.Get("username"))
+	if r.Form.Get("deny") != "" || username == "" {
+		query.Set("error", "access_denied")
+		query.Set("error_description", "the user did not log in")
+	} else {
+		code := newID()
+		s.mu.Lock()
+		s.codes[code] = &authCode{
+			clientID:      r.Form.Get("client_id"),
+			redirectURI:   r.Form.Get("redirect_uri"),
+			nonce:         r.Form.Get("nonce"),
+			codeChallenge: r.Form.Get("code_challenge"),
+			username:      username,
+			expires:       time.Now().Add(codeTTL),
+		}
+		s.mu.Unlock()
+		query.Set("code", code)
+	}
+	redirectURI.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+	// clients with a secret send their ID as basic auth, the others as a parameter
+	clientID := r.Form.Get("client_id")
+	if id, _, ok := r.BasicAuth(); ok {
+		clientID = id
+	}
+
+	switch r.Form.Get("grant_type") {
+	case "authorization_code":
+		s.mu.Lock()
+		code, ok := s.codes[r.Form.Get("code")]
+		delete(s.codes, r.Form.Get("code"))
+		s.mu.Unlock()
+		if !ok || time.Now().After(code.expires) || code.clientID != clientID || code.redirectURI != r.Form.Get("redirect_uri") {
+			tokenError(w, "invalid_grant", "unknown or expired code")
+			return
+		}
+		if code.codeChallenge != "" {
+			sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != code.codeChallenge {
+				tokenError(w, "invalid_grant", "code_verifier does not match the code challenge")
+				return
+			}
+		}
+		s.issueTokens(w, clientID, code.username, code.nonce)
+
+	case deviceGrant:
+		s.mu.Lock()
+		device, ok := s.deviceCodes[r.Form.Get("device_code")]
+		if ok && (device.username != "" || time.Now().After(device.expires)) {
+			delete(s.deviceCodes, r.Form.Get("device_code"))
+			delete(s.userCodes, device.userCode)
+		}
+		s.mu.Unlock()
+		switch {
+		case !ok || device.clientID != clientID:
+			tokenError(w, "invalid_grant", "unknown device code")
+		case time.Now().After(device.expires):
+			tokenError(w, "expired_token", "the device code expired")
+		case device.username == "":
+			tokenError(w, "authorization_pending", "the user has not logged in yet")
+		default:
+			s.issueTokens(w, clientID, device.username, "")
+		}
+
+	default:
+		tokenError(w, "unsupported_grant_type", "only authorization_code and device_code are supported")
+	}
+}
+
+// IDToken returns an ID token for username as the token endpoint issues
+// them, issued at issuedAt, for tests to skip the login flows
+func (s *Server) IDToken(clientID, username, nonce string, issuedAt time.Time) (string, error) {
+	claims := jwt.MapClaims{
+		"iss":                s.issuer,
+		"jti":                newID(),
+		"sub":                username,
+		"aud":                clientID,
+		"iat":                issuedAt.Unix(),
+		"exp":                issuedAt.Add(tokenTTL).Unix(),
+		"preferred_username": username,
+		"email":              username + "@example.com",
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	return token.SignedString(s.key)
+}
+
+func (s *Server) issueTokens(w http.ResponseWriter, clientID, username, nonce string) {
+	idToken, err := s.IDToken(clientID, username, nonce, time.Now())
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": newID(),
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenTTL / time.Second),
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) handleDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.Form.Get("client_id") == "" {
+		tokenError(w, "invalid_request", "client_id is required")
+		return
+	}
+
+	code := newID()
+	userCode := newUserCode()
+	s.mu.Lock()
+	s.deviceCodes[code] = &deviceCode{
+		clientID: r.Form.Get("client_id"),
+		userCode: userCode,
+		expires:  time.Now().Add(deviceCodeTTL),
+	}
+	s.userCodes[userCode] = code
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":               code,
+		"user_code":                 userCode,
+		"verification_uri":          s.issuer + "/device",
+		"verification_uri_complete": s.issuer + "/device?user_code=" + url.QueryEscape(userCode),
+		"expires_in":                int(deviceCodeTTL / time.Second),
+		"interval":                  pollInterval,
+	})
+}
+
+var deviceForm = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mock identity provider</title></head>
+<body>
+    <h1>Log in on a device</h1>
+    {{if .Message}}<p>{{.Message}}</p>{{end}}
+    <form method="post">
+        <input name="user_code" placeholder="code" value="{{.UserCode}}">
+        <input name="username" placeholder="username" autofocus>
+        <button type="submit">Log in</button>
+    </form>
+</body>
+</html>
+`))
+
+// handleDevice is where the user approves a device login by entering the
+// code the device shows
+func (s *Server) handleDevice(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userCode := strings.ToUpper(strings.TrimSpace(r.Form.Get("user_code")))
+	data := map[string]string{"UserCode": userCode}
+
+	if r.Method == http.MethodPost {
+		username := strings.TrimSpace(r.Form.Get("username"))
+		s.mu.Lock()
+		device, ok := s.deviceCodes[s.userCodes[userCode]]
+		if ok && username != "" && time.Now().Before(device.expires) {
+			device.username = username
+		}
+		s.mu.Unlock()
+
+		switch {
+		case !ok:
+			data["Message"] = "Unknown or expired code."
+		case username == "":
+			data["Message"] = "Enter a username."
+		default:
+			data = map[string]string{"Message": "Logged in as " + username + ", you can return to your device."}
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	deviceForm.Execute(w, data)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// tokenError is an OAuth 2.0 error response of the token endpoint
+func tokenError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newUserCode returns a code that is easy to type, without 0/O and 1/I
+func newUserCode() string {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, userCodeLength)
+	rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b)
+}
@@ -0,0 +1,49 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileNotifier appends one JSON message per line to a file, which a mail
+// relay can tail. The file holds reset tokens, so only the server's user may
+// read it.
+type FileNotifier struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileNotifier(path string) (*FileNotifier, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileNotifier{file: file}, nil
+}
+
+func (n *FileNotifier) Notify(ctx context.Context, msg *Message) error {
+	msg.Timestamp = time.Now().Unix()
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err = n.file.Write(line)
+	return err
+}
+
+func (n *FileNotifier) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.file.Close()
+}
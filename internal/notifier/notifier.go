@@ -0,0 +1,40 @@
+// Package notifier sends messages to users outside of chat, such as password
+// reset tokens. It stands in for email until there is a mail backend: messages
+// are written to the server log or appended to a file.
+package notifier
+
+import (
+	"context"
+	"fmt"
+)
+
+// Message is addressed to a username, since accounts have no email address
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	// Timestamp is set by the notifier when the message is sent
+	Timestamp int64 `json:"timestamp"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, msg *Message) error
+	Close() error
+}
+
+type Options struct {
+	Backend string // "log" or "file"
+	File    string
+}
+
+// New returns the notifier for the configured backend
+func New(opts Options) (Notifier, error) {
+	switch opts.Backend {
+	case "log":
+		return NewLogNotifier(), nil
+	case "file":
+		return NewFileNotifier(opts.File)
+	default:
+		return nil, fmt.Errorf("unknown notifier backend %q", opts.Backend)
+	}
+}
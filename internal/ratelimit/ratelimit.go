@@ -1,6 +1,8 @@
 package ratelimit
 
 import (
+	"chat_app/internal/metrics"
+
 	"golang.org/x/time/rate"
 	//"time"
 )
@@ -14,5 +16,15 @@ func NewRateLimiter(r rate.Limit, b int) *RateLimiter { // create a new rate lim
 }
 
 func (rl *RateLimiter) Allow() bool {
-	return rl.limiter.Allow()
+	if !rl.limiter.Allow() {
+		metrics.RateLimited.Inc()
+		return false
+	}
+	return true
+}
+
+// SetLimit changes the rate and burst of a limiter that is in use
+func (rl *RateLimiter) SetLimit(r rate.Limit, b int) {
+	rl.limiter.SetLimit(r)
+	rl.limiter.SetBurst(b)
 }
@@ -0,0 +1,113 @@
+package search
+
+import (
+	pb "chat_app/pb"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// MemoryIndex is an in-process inverted index. It is lost on restart and is
+// not shared between server instances, so it suits tests and single nodes.
+type MemoryIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]struct{}
+	docs     map[string]*pb.ChatMessage
+}
+
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{
+		postings: make(map[string]map[string]struct{}),
+		docs:     make(map[string]*pb.ChatMessage),
+	}
+}
+
+func (idx *MemoryIndex) Index(msg *pb.ChatMessage) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(msg.Id)
+
+	idx.docs[msg.Id] = proto.Clone(msg).(*pb.ChatMessage)
+	for _, term := range Tokenize(msg.Message) {
+		ids, ok := idx.postings[term]
+		if !ok {
+			ids = make(map[string]struct{})
+			idx.postings[term] = ids
+		}
+		ids[msg.Id] = struct{}{}
+	}
+
+	return nil
+}
+
+func (idx *MemoryIndex) Remove(id string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(id)
+	return nil
+}
+
+func (idx *MemoryIndex) remove(id string) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+
+	for _, term := range Tokenize(doc.Message) {
+		delete(idx.postings[term], id)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docs, id)
+}
+
+func (idx *MemoryIndex) Search(q Query) ([]*pb.ChatMessage, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var results []*pb.ChatMessage
+	for _, id := range idx.candidates(Tokenize(q.Text)) {
+		doc := idx.docs[id]
+		if doc != nil && q.matches(doc) {
+			results = append(results, proto.Clone(doc).(*pb.ChatMessage))
+		}
+	}
+
+	return finish(q, results), nil
+}
+
+// candidates returns the ids containing every term, or every id when there are no terms
+func (idx *MemoryIndex) candidates(terms []string) []string {
+	var ids []string
+	if len(terms) == 0 {
+		for id := range idx.docs {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	// start from the rarest term to keep the intersection small
+	smallest := idx.postings[terms[0]]
+	for _, term := range terms[1:] {
+		if len(idx.postings[term]) < len(smallest) {
+			smallest = idx.postings[term]
+		}
+	}
+
+	for id := range smallest {
+		matchesAll := true
+		for _, term := range terms {
+			if _, ok := idx.postings[term][id]; !ok {
+				matchesAll = false
+				break
+			}
+		}
+		if matchesAll {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
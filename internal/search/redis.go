@@ -0,0 +1,149 @@
+package search
+
+import (
+	pb "chat_app/pb"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisIndex keeps an inverted index in Redis so it survives restarts and is
+// shared by every server instance.
+//
+//	search:term:<term>  set of message ids containing the term
+//	search:room:<room>  sorted set of message ids scored by timestamp
+//	search:doc:<id>     the indexed message as json
+type RedisIndex struct {
+	client *redis.Client
+}
+
+func NewRedisIndex(client *redis.Client) *RedisIndex {
+	return &RedisIndex{client: client}
+}
+
+func (idx *RedisIndex) Index(msg *pb.ChatMessage) error {
+	ctx := context.Background()
+
+	// drop the terms of a previous version of the message
+	if err := idx.Remove(msg.Id); err != nil {
+		return err
+	}
+
+	jsonMessage, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	pipe := idx.client.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("search:doc:%s", msg.Id), jsonMessage, 0)
+	pipe.ZAdd(ctx, fmt.Sprintf("search:room:%s", msg.Room), &redis.Z{
+		Score:  float64(msg.Timestamp),
+		Member: msg.Id,
+	})
+	for _, term := range Tokenize(msg.Message) {
+		pipe.SAdd(ctx, fmt.Sprintf("search:term:%s", term), msg.Id)
+	}
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+func (idx *RedisIndex) Remove(id string) error {
+	ctx := context.Background()
+	docKey := fmt.Sprintf("search:doc:%s", id)
+
+	jsonData, err := idx.client.Get(ctx, docKey).Bytes()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var msg pb.ChatMessage
+	if err := json.Unmarshal(jsonData, &msg); err != nil {
+		return err
+	}
+
+	pipe := idx.client.TxPipeline()
+	pipe.Del(ctx, docKey)
+	pipe.ZRem(ctx, fmt.Sprintf("search:room:%s", msg.Room), id)
+	for _, term := range Tokenize(msg.Message) {
+		pipe.SRem(ctx, fmt.Sprintf("search:term:%s", term), id)
+	}
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+func (idx *RedisIndex) Search(q Query) ([]*pb.ChatMessage, error) {
+	ctx := context.Background()
+
+	ids, err := idx.candidates(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*pb.ChatMessage
+	for _, id := range ids {
+		jsonData, err := idx.client.Get(ctx, fmt.Sprintf("search:doc:%s", id)).Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var msg pb.ChatMessage
+		if err := json.Unmarshal(jsonData, &msg); err != nil {
+			return nil, err
+		}
+
+		if q.matches(&msg) {
+			results = append(results, &msg)
+		}
+	}
+
+	return finish(q, results), nil
+}
+
+func (idx *RedisIndex) candidates(ctx context.Context, q Query) ([]string, error) {
+	terms := Tokenize(q.Text)
+	if len(terms) > 0 {
+		keys := make([]string, len(terms))
+		for i, term := range terms {
+			keys[i] = fmt.Sprintf("search:term:%s", term)
+		}
+		return idx.client.SInter(ctx, keys...).Result()
+	}
+
+	// no text, so walk the time range of each room
+	min, max := "-inf", "+inf"
+	if q.Since != 0 {
+		min = strconv.FormatInt(q.Since, 10)
+	}
+	if q.Until != 0 {
+		max = strconv.FormatInt(q.Until, 10)
+	}
+
+	// filtering by author happens afterwards, so only cap the range without one
+	var count int64
+	if q.User == "" {
+		count = int64(q.limit())
+	}
+
+	var ids []string
+	for _, room := range q.Rooms {
+		roomIDs, err := idx.client.ZRevRangeByScore(ctx, fmt.Sprintf("search:room:%s", room), &redis.ZRangeBy{
+			Min:   min,
+			Max:   max,
+			Count: count,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, roomIDs...)
+	}
+	return ids, nil
+}
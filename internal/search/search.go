@@ -0,0 +1,107 @@
+package search
+
+import (
+	pb "chat_app/pb"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Query describes a search. Rooms limits the search to the given rooms and
+// must be set by the caller to the rooms the user is allowed to read.
+type Query struct {
+	Text  string
+	Rooms []string
+	User  string
+	Since int64
+	Until int64
+	Limit int
+}
+
+// Index is implemented by the search backends
+type Index interface {
+	Index(msg *pb.ChatMessage) error
+	Remove(id string) error
+	Search(q Query) ([]*pb.ChatMessage, error)
+}
+
+const defaultLimit = 50
+
+// NewIndex returns the index for the configured backend
+func NewIndex(backend string, client *redis.Client) (Index, error) {
+	switch backend {
+	case "redis":
+		return NewRedisIndex(client), nil
+	case "memory":
+		return NewMemoryIndex(), nil
+	default:
+		return nil, fmt.Errorf("unknown search backend %q", backend)
+	}
+}
+
+// Tokenize splits text into lowercase terms
+func Tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	seen := make(map[string]bool, len(fields))
+	terms := fields[:0]
+	for _, f := range fields {
+		if !seen[f] {
+			seen[f] = true
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+func (q Query) matches(msg *pb.ChatMessage) bool {
+	if !contains(q.Rooms, msg.Room) {
+		return false
+	}
+	if q.User != "" && msg.User != q.User {
+		return false
+	}
+	if q.Since != 0 && msg.Timestamp < q.Since {
+		return false
+	}
+	if q.Until != 0 && msg.Timestamp > q.Until {
+		return false
+	}
+	return true
+}
+
+func (q Query) limit() int {
+	if q.Limit <= 0 || q.Limit > defaultLimit {
+		return defaultLimit
+	}
+	return q.Limit
+}
+
+// finish sorts results newest first and applies the limit
+func finish(q Query, results []*pb.ChatMessage) []*pb.ChatMessage {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Timestamp != results[j].Timestamp {
+			return results[i].Timestamp > results[j].Timestamp
+		}
+		return results[i].Seq > results[j].Seq
+	})
+
+	if len(results) > q.limit() {
+		results = results[:q.limit()]
+	}
+	return results
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
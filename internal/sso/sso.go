@@ -0,0 +1,123 @@
+// Package sso logs users in with an OpenID Connect provider. Browsers go
+// through the authorization code flow with PKCE; other clients, such as the
+// CLI with the device flow, get an ID token themselves and hand it over.
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+type Options struct {
+	Issuer         string
+	ClientID       string
+	ClientSecret   string
+	RedirectURL    string
+	DeviceClientID string
+	Scopes         []string
+	UsernameClaim  string
+}
+
+// Identity is a user as the provider knows them. Issuer and Subject identify
+// them for good; Username may change and is only used to name new accounts.
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Email    string
+	// IssuedAt and Expiry are the ID token's
+	IssuedAt time.Time
+	Expiry   time.Time
+}
+
+type Provider struct {
+	oauth2        oauth2.Config
+	verifier      *oidc.IDTokenVerifier
+	audiences     []string
+	usernameClaim string
+}
+
+// New reads the provider's discovery document, so the provider must be reachable
+func New(ctx context.Context, opts Options) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, opts.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discover %s: %w", opts.Issuer, err)
+	}
+
+	audiences := []string{opts.ClientID}
+	if opts.DeviceClientID != "" && opts.DeviceClientID != opts.ClientID {
+		audiences = append(audiences, opts.DeviceClientID)
+	}
+	return &Provider{
+		oauth2: oauth2.Config{
+			ClientID:     opts.ClientID,
+			ClientSecret: opts.ClientSecret,
+			RedirectURL:  opts.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       opts.Scopes,
+		},
+		// the audience is checked in Verify, against both clients
+		verifier:      provider.Verifier(&oidc.Config{SkipClientIDCheck: true}),
+		audiences:     audiences,
+		usernameClaim: opts.UsernameClaim,
+	}, nil
+}
+
+// AuthCodeURL is where to send the browser to log in. state, nonce and
+// verifier must be kept for Exchange.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange redeems the code the provider redirected back with
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (*Identity, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchange code: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+	return p.Verify(ctx, rawIDToken, nonce)
+}
+
+// Verify checks an ID token's signature, issuer, audience and expiry, and
+// its nonce unless nonce is empty
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (*Identity, error) {
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(idToken.Audience, func(aud string) bool { return slices.Contains(p.audiences, aud) }) {
+		return nil, fmt.Errorf("id token is for %q, not this server", idToken.Audience)
+	}
+	if nonce != "" && idToken.Nonce != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	username, _ := claims[p.usernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("id token has no %s claim", p.usernameClaim)
+	}
+	email, _ := claims["email"].(string)
+
+	return &Identity{
+		Issuer:   idToken.Issuer,
+		Subject:  idToken.Subject,
+		Username: username,
+		Email:    email,
+		IssuedAt: idToken.IssuedAt,
+		Expiry:   idToken.Expiry,
+	}, nil
+}
@@ -0,0 +1,128 @@
+package sso
+
+import (
+	"chat_app/internal/mockidp"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *mockidp.Server) {
+	t.Helper()
+	idpServer := httptest.NewUnstartedServer(nil)
+	idp, err := mockidp.New("http://" + idpServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpServer.Config.Handler = idp
+	idpServer.Start()
+	t.Cleanup(idpServer.Close)
+
+	provider, err := New(context.Background(), Options{
+		Issuer:         idpServer.URL,
+		ClientID:       "chat-web",
+		ClientSecret:   "secret",
+		RedirectURL:    "http://chat.test/auth/oidc/callback",
+		DeviceClientID: "chat-cli",
+		Scopes:         []string{"openid", "profile", "email"},
+		UsernameClaim:  "preferred_username",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider, idp
+}
+
+// logIn goes through the provider's login form as username and returns the
+// code it redirects back with
+func logIn(t *testing.T, authURL, username string) string {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(authURL, url.Values{"username": {username}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Query().Get("state") != "state" {
+		t.Fatalf("redirected to %s without the state", location)
+	}
+	return location.Query().Get("code")
+}
+
+func TestAuthCodeFlow(t *testing.T) {
+	provider, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	verifier := oauth2.GenerateVerifier()
+	code := logIn(t, provider.AuthCodeURL("state", "nonce", verifier), "alice")
+	identity, err := provider.Exchange(ctx, code, "nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "alice" || identity.Subject != "alice" || identity.Email != "alice@example.com" {
+		t.Errorf("got identity %+v", identity)
+	}
+	if time.Since(identity.IssuedAt) > time.Minute || time.Until(identity.Expiry) <= 0 {
+		t.Errorf("got issued at %s and expiry %s", identity.IssuedAt, identity.Expiry)
+	}
+
+	if _, err := provider.Exchange(ctx, code, "nonce", verifier); err == nil {
+		t.Error("a code was redeemed twice")
+	}
+}
+
+func TestAuthCodeFlowRejects(t *testing.T) {
+	provider, _ := newTestProvider(t)
+	ctx := context.Background()
+
+	verifier := oauth2.GenerateVerifier()
+	code := logIn(t, provider.AuthCodeURL("state", "nonce", verifier), "alice")
+	if _, err := provider.Exchange(ctx, code, "nonce", oauth2.GenerateVerifier()); err == nil {
+		t.Error("exchanged a code with the wrong PKCE verifier")
+	}
+
+	code = logIn(t, provider.AuthCodeURL("state", "nonce", verifier), "alice")
+	if _, err := provider.Exchange(ctx, code, "other nonce", verifier); err == nil {
+		t.Error("accepted an ID token with the wrong nonce")
+	}
+}
+
+func TestVerifyAudience(t *testing.T) {
+	provider, idp := newTestProvider(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		clientID string
+		ok       bool
+	}{
+		{"chat-web", true},
+		{"chat-cli", true},
+		{"someone-else", false},
+	}
+	for _, tt := range tests {
+		idToken, err := idp.IDToken(tt.clientID, "bob", "", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		identity, err := provider.Verify(ctx, idToken, "")
+		if tt.ok && (err != nil || identity.Username != "bob") {
+			t.Errorf("token for %s: got %+v, %v", tt.clientID, identity, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("token for %s was accepted", tt.clientID)
+		}
+	}
+
+	if _, err := provider.Verify(ctx, "not a token", ""); err == nil {
+		t.Error("accepted garbage")
+	}
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	pb "chat_app/pb"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func SaveAttachment(client *redis.Client, attachment *pb.Attachment) (err error) {
+	defer observe(client, "SaveAttachment")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("attachment:%s", attachment.Id)
+
+	jsonAttachment, err := json.Marshal(attachment)
+	if err != nil {
+		return err
+	}
+
+	return client.Set(ctx, key, jsonAttachment, 0).Err()
+}
+
+// GetAttachment returns redis.Nil when the attachment does not exist
+func GetAttachment(client *redis.Client, id string) (_ *pb.Attachment, err error) {
+	defer observe(client, "GetAttachment")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("attachment:%s", id)
+
+	jsonData, err := client.Get(ctx, key).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var attachment pb.Attachment
+	if err := json.Unmarshal(jsonData, &attachment); err != nil {
+		return nil, err
+	}
+
+	return &attachment, nil
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	pb "chat_app/pb"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// SaveBot creates the bot and returns false if the name is already taken
+func SaveBot(client *redis.Client, bot *pb.Bot) (_ bool, err error) {
+	defer observe(client, "SaveBot")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("bot:%s", bot.Name)
+
+	jsonBot, err := json.Marshal(bot)
+	if err != nil {
+		return false, err
+	}
+
+	return client.SetNX(ctx, key, jsonBot, 0).Result()
+}
+
+// GetBot returns redis.Nil if the bot does not exist
+func GetBot(client *redis.Client, name string) (_ *pb.Bot, err error) {
+	defer observe(client, "GetBot")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("bot:%s", name)
+
+	jsonData, err := client.Get(ctx, key).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var bot pb.Bot
+	if err := json.Unmarshal(jsonData, &bot); err != nil {
+		return nil, err
+	}
+
+	return &bot, nil
+}
+
+// SaveAPIToken stores the token metadata together with the hash of its secret.
+// The secret itself is never stored.
+func SaveAPIToken(client *redis.Client, token *pb.APIToken, secretHash string) (err error) {
+	defer observe(client, "SaveAPIToken")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("apitoken:%s", token.Id)
+	botKey := fmt.Sprintf("bot:%s:tokens", token.Bot)
+
+	jsonToken, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	pipe := client.TxPipeline()
+	pipe.HSet(ctx, key, "token", jsonToken, "hash", secretHash)
+	pipe.SAdd(ctx, botKey, token.Id)
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+// GetAPIToken returns the token metadata and secret hash, or redis.Nil if it does not exist
+func GetAPIToken(client *redis.Client, id string) (_ *pb.APIToken, _ string, err error) {
+	defer observe(client, "GetAPIToken")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("apitoken:%s", id)
+
+	values, err := client.HMGet(ctx, key, "token", "hash").Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	jsonToken, ok := values[0].(string)
+	secretHash, _ := values[1].(string)
+	if !ok {
+		return nil, "", redis.Nil
+	}
+
+	var token pb.APIToken
+	if err := json.Unmarshal([]byte(jsonToken), &token); err != nil {
+		return nil, "", err
+	}
+
+	return &token, secretHash, nil
+}
+
+func GetBotAPITokens(client *redis.Client, bot string) (_ []*pb.APIToken, err error) {
+	defer observe(client, "GetBotAPITokens")(&err)
+	ctx := client.Context()
+	botKey := fmt.Sprintf("bot:%s:tokens", bot)
+
+	ids, err := client.SMembers(ctx, botKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*pb.APIToken
+	for _, id := range ids {
+		token, _, err := GetAPIToken(client, id)
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// DeleteAPIToken returns redis.Nil if the bot has no such token
+func DeleteAPIToken(client *redis.Client, bot, id string) (err error) {
+	defer observe(client, "DeleteAPIToken")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("apitoken:%s", id)
+	botKey := fmt.Sprintf("bot:%s:tokens", bot)
+
+	removed, err := client.SRem(ctx, botKey, id).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return redis.Nil
+	}
+
+	return client.Del(ctx, key).Err()
+}
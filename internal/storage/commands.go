@@ -0,0 +1,101 @@
+package storage
+
+import (
+	pb "chat_app/pb"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func commandsKey(room string) string {
+	return fmt.Sprintf("commands:%s", room)
+}
+
+// SaveCommand registers a bot command in command.Room, replacing the bot's
+// earlier registration of the name. If another bot already registered the
+// name there, nothing is saved and its command is returned.
+func SaveCommand(client *redis.Client, command *pb.Command) (_ *pb.Command, err error) {
+	defer observe(client, "SaveCommand")(&err)
+	ctx := client.Context()
+	key := commandsKey(command.Room)
+
+	jsonCommand, err := json.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+
+	var taken *pb.Command
+	err = client.Watch(ctx, func(tx *redis.Tx) error {
+		jsonData, err := tx.HGet(ctx, key, command.Name).Bytes()
+		if err == nil {
+			var existing pb.Command
+			if err := json.Unmarshal(jsonData, &existing); err != nil {
+				return err
+			}
+			if existing.Bot != command.Bot {
+				taken = &existing
+				return nil
+			}
+		} else if err != redis.Nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, command.Name, jsonCommand)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return taken, nil
+}
+
+// GetCommand returns redis.Nil if no bot registered the command in the room
+func GetCommand(client *redis.Client, room, name string) (_ *pb.Command, err error) {
+	defer observe(client, "GetCommand")(&err)
+	ctx := client.Context()
+
+	jsonData, err := client.HGet(ctx, commandsKey(room), name).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var command pb.Command
+	if err := json.Unmarshal(jsonData, &command); err != nil {
+		return nil, err
+	}
+
+	return &command, nil
+}
+
+func GetCommands(client *redis.Client, room string) (_ []*pb.Command, err error) {
+	defer observe(client, "GetCommands")(&err)
+	ctx := client.Context()
+
+	values, err := client.HVals(ctx, commandsKey(room)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	commands := make([]*pb.Command, 0, len(values))
+	for _, value := range values {
+		var command pb.Command
+		if err := json.Unmarshal([]byte(value), &command); err != nil {
+			return nil, err
+		}
+		commands = append(commands, &command)
+	}
+
+	return commands, nil
+}
+
+func DeleteCommand(client *redis.Client, room, name string) (err error) {
+	defer observe(client, "DeleteCommand")(&err)
+	ctx := client.Context()
+
+	return client.HDel(ctx, commandsKey(room), name).Err()
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RecordLoginFailure counts a failed login for key, which names an account or
+// a client address, and returns how many failures it has had. The count is
+// forgotten once there has been no failure for window.
+func RecordLoginFailure(client *redis.Client, key string, window time.Duration) (_ int64, err error) {
+	defer observe(client, "RecordLoginFailure")(&err)
+	ctx := client.Context()
+	failuresKey := fmt.Sprintf("login_failures:%s", key)
+
+	pipe := client.TxPipeline()
+	count := pipe.Incr(ctx, failuresKey)
+	pipe.Expire(ctx, failuresKey, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// ClearLoginFailures forgets the failed logins of key and lifts its lock
+func ClearLoginFailures(client *redis.Client, key string) (err error) {
+	defer observe(client, "ClearLoginFailures")(&err)
+	ctx := client.Context()
+
+	return client.Del(ctx, fmt.Sprintf("login_failures:%s", key), fmt.Sprintf("login_lock:%s", key)).Err()
+}
+
+// LockLogin blocks logins for key until ttl runs out. An existing longer lock is kept.
+func LockLogin(client *redis.Client, key string, ttl time.Duration) (err error) {
+	defer observe(client, "LockLogin")(&err)
+	ctx := client.Context()
+	lockKey := fmt.Sprintf("login_lock:%s", key)
+
+	remaining, err := client.PTTL(ctx, lockKey).Result()
+	if err != nil {
+		return err
+	}
+	if remaining >= ttl {
+		return nil
+	}
+	return client.Set(ctx, lockKey, time.Now().Unix(), ttl).Err()
+}
+
+// GetLoginLock returns how long logins for key stay blocked, or 0
+func GetLoginLock(client *redis.Client, key string) (_ time.Duration, err error) {
+	defer observe(client, "GetLoginLock")(&err)
+	ctx := client.Context()
+
+	remaining, err := client.PTTL(ctx, fmt.Sprintf("login_lock:%s", key)).Result()
+	if err != nil {
+		return 0, err
+	}
+	// negative when the key does not exist or has no expiry
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"chat_app/internal/metrics"
+	"chat_app/internal/tracing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// observe records the latency of a storage function and traces it, called
+// with the function's named error result as
+//
+//	defer observe(client, "SaveMessage")(&err)
+//
+// so failed calls mark their span as failed. redis.Nil, which storage
+// functions return for missing keys, is not a failure.
+//
+// Storage functions run with client.Context(), so callers pass
+// client.WithContext(ctx) to make them part of a request's trace.
+func observe(client *redis.Client, operation string) func(*error) {
+	start := time.Now()
+	_, span := tracing.Start(client.Context(), "storage."+operation)
+	return func(err *error) {
+		if *err != nil && *err != redis.Nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+		metrics.StorageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+}
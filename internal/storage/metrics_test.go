@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"chat_app/internal/metrics"
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// storageCalls returns how often operation was timed
+func storageCalls(t *testing.T, operation string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.StorageDuration.WithLabelValues(operation).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestObserveTimesStorageCalls(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	saves, gets := storageCalls(t, "SaveToken"), storageCalls(t, "GetToken")
+	if err := SaveToken(client, "alice", "token", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetToken(client, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetToken(client, "bob"); err == nil {
+		t.Fatal("got a token for bob")
+	}
+
+	if got := storageCalls(t, "SaveToken") - saves; got != 1 {
+		t.Errorf("SaveToken timed %d times", got)
+	}
+	if got := storageCalls(t, "GetToken") - gets; got != 2 {
+		t.Errorf("GetToken timed %d times", got)
+	}
+}
+
+func TestObserveMarksFailedSpans(t *testing.T) {
+	client, mr := newTestClient(t)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	// storage spans are only started inside a trace
+	ctx, root := provider.Tracer("test").Start(context.Background(), "request")
+	defer root.End()
+	client = client.WithContext(ctx)
+	if err := SaveToken(client, "alice", "token", 0); err != nil {
+		t.Fatal(err)
+	}
+	// a missing key is an answer, not a failure
+	GetToken(client, "bob")
+	mr.Close()
+	if _, err := GetToken(client, "alice"); err == nil {
+		t.Fatal("no error with redis gone")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans", len(spans))
+	}
+	for i, want := range []codes.Code{codes.Unset, codes.Unset, codes.Error} {
+		if spans[i].Name() != []string{"storage.SaveToken", "storage.GetToken", "storage.GetToken"}[i] || spans[i].Status().Code != want {
+			t.Errorf("span %d: %s with status %v, want %v", i, spans[i].Name(), spans[i].Status().Code, want)
+		}
+	}
+	if len(spans[2].Events()) != 1 || spans[2].Events()[0].Name != "exception" {
+		t.Errorf("the error was not recorded: %v", spans[2].Events())
+	}
+}
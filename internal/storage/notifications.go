@@ -0,0 +1,158 @@
+package storage
+
+import (
+	pb "chat_app/pb"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// keep the inbox bounded, the oldest notifications are dropped first
+const maxNotifications = 200
+
+// SaveNotification adds the notification to the user's inbox. Notifications
+// are kept as json in a hash, ordered by a sorted set of their ids.
+func SaveNotification(client *redis.Client, username string, notification *pb.Notification) (err error) {
+	defer observe(client, "SaveNotification")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("notifications:%s", username)
+	orderKey := fmt.Sprintf("notifications:%s:order", username)
+
+	jsonNotification, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	pipe := client.TxPipeline()
+	pipe.HSet(ctx, key, notification.Id, jsonNotification)
+	pipe.ZAdd(ctx, orderKey, &redis.Z{
+		Score:  float64(notification.CreatedAt),
+		Member: notification.Id,
+	})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	stale, err := client.ZRange(ctx, orderKey, 0, -maxNotifications-1).Result()
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+
+	pipe = client.TxPipeline()
+	pipe.HDel(ctx, key, stale...)
+	pipe.ZRem(ctx, orderKey, toInterfaces(stale)...)
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+// GetNotifications returns the newest notifications first
+func GetNotifications(client *redis.Client, username string, includeAcked bool, limit int) (_ []*pb.Notification, err error) {
+	defer observe(client, "GetNotifications")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("notifications:%s", username)
+	orderKey := fmt.Sprintf("notifications:%s:order", username)
+
+	ids, err := client.ZRevRange(ctx, orderKey, 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	values, err := client.HMGet(ctx, key, ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var notifications []*pb.Notification
+	for _, value := range values {
+		jsonData, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var notification pb.Notification
+		if err := json.Unmarshal([]byte(jsonData), &notification); err != nil {
+			return nil, err
+		}
+
+		if notification.Acked && !includeAcked {
+			continue
+		}
+		notifications = append(notifications, &notification)
+		if len(notifications) == limit {
+			break
+		}
+	}
+
+	return notifications, nil
+}
+
+// AckNotification marks one notification as read, or all of them when id is empty.
+// It returns redis.Nil if the notification does not exist.
+func AckNotification(client *redis.Client, username, id string) (err error) {
+	defer observe(client, "AckNotification")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("notifications:%s", username)
+
+	ids := []string{id}
+	if id == "" {
+		var err error
+		ids, err = client.HKeys(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ids {
+		jsonData, err := client.HGet(ctx, key, id).Bytes()
+		if err != nil {
+			return err
+		}
+
+		var notification pb.Notification
+		if err := json.Unmarshal(jsonData, &notification); err != nil {
+			return err
+		}
+		if notification.Acked {
+			continue
+		}
+
+		notification.Acked = true
+		jsonNotification, err := json.Marshal(&notification)
+		if err != nil {
+			return err
+		}
+		if err := client.HSet(ctx, key, id, jsonNotification).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func PublishNotification(client *redis.Client, username string, notification *pb.Notification) (err error) {
+	defer observe(client, "PublishNotification")(&err)
+	ctx := client.Context()
+	channel := fmt.Sprintf("user_notifications:%s", username)
+
+	jsonNotification, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	return client.Publish(ctx, channel, jsonNotification).Err()
+}
+
+func SubscribeToNotifications(client *redis.Client, username string) *redis.PubSub {
+	return client.Subscribe(context.Background(), fmt.Sprintf("user_notifications:%s", username))
+}
+
+func toInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// deletePasswordResetsScript deletes every reset token in the user's set
+var deletePasswordResetsScript = redis.NewScript(`
+local hashes = redis.call("SMEMBERS", KEYS[1])
+for _, hash in ipairs(hashes) do
+	redis.call("DEL", ARGV[1] .. hash)
+end
+redis.call("DEL", KEYS[1])
+return #hashes
+`)
+
+func passwordResetsKey(username string) string {
+	return fmt.Sprintf("password_resets:%s", username)
+}
+
+// SavePasswordReset stores a reset token for username under the hash of the
+// token. The token itself is never stored.
+func SavePasswordReset(client *redis.Client, tokenHash, username string, ttl time.Duration) (err error) {
+	defer observe(client, "SavePasswordReset")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("password_reset:%s", tokenHash)
+
+	// the user's tokens are listed too, so all of them can be revoked at once
+	pipe := client.TxPipeline()
+	pipe.Set(ctx, key, username, ttl)
+	pipe.SAdd(ctx, passwordResetsKey(username), tokenHash)
+	pipe.Expire(ctx, passwordResetsKey(username), ttl)
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+// GetPasswordReset returns the username of a reset token, or redis.Nil if the
+// token does not exist or has expired
+func GetPasswordReset(client *redis.Client, tokenHash string) (_ string, err error) {
+	defer observe(client, "GetPasswordReset")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("password_reset:%s", tokenHash)
+
+	return client.Get(ctx, key).Result()
+}
+
+// TakePasswordReset returns the username of a reset token and deletes the
+// token, so it works only once. It returns redis.Nil if the token does not
+// exist or has expired.
+func TakePasswordReset(client *redis.Client, tokenHash string) (_ string, err error) {
+	defer observe(client, "TakePasswordReset")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("password_reset:%s", tokenHash)
+
+	return client.GetDel(ctx, key).Result()
+}
+
+// DeletePasswordResets revokes all of the user's reset tokens
+func DeletePasswordResets(client *redis.Client, username string) (err error) {
+	defer observe(client, "DeletePasswordResets")(&err)
+	ctx := client.Context()
+
+	return deletePasswordResetsScript.Run(ctx, client, []string{passwordResetsKey(username)}, "password_reset:").Err()
+}
+
+// StartPasswordResetCooldown returns false if username was already sent a
+// reset token within cooldown
+func StartPasswordResetCooldown(client *redis.Client, username string, cooldown time.Duration) (_ bool, err error) {
+	defer observe(client, "StartPasswordResetCooldown")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("password_reset_sent:%s", username)
+
+	if cooldown <= 0 {
+		return true, nil
+	}
+	return client.SetNX(ctx, key, time.Now().Unix(), cooldown).Result()
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+type Presence struct {
+	Username string
+	LastSeen int64
+	Typing   bool
+}
+
+// Presence is kept in two keys per room: a sorted set of usernames scored by
+// when they were last seen, and a hash counting each user's open streams, so
+// closing one of several streams does not take the user offline. Both keys
+// expire unless some stream in the room refreshes them, which also clears
+// counts left behind by a server that died.
+
+func presenceKey(room string) string {
+	return fmt.Sprintf("presence:%s", room)
+}
+
+func connectionsKey(room string) string {
+	return fmt.Sprintf("connections:%s", room)
+}
+
+func typingKey(room, username string) string {
+	return fmt.Sprintf("typing:%s:%s", room, username)
+}
+
+// drop the user once their last stream closes
+var removePresenceScript = redis.NewScript(`
+local count = redis.call("HINCRBY", KEYS[2], ARGV[1], -1)
+if count > 0 then
+	return count
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("DEL", KEYS[3])
+return 0
+`)
+
+// AddPresence counts a new stream of the user in the room, marks them as
+// online and returns how many streams they have open
+func AddPresence(client *redis.Client, room, username string, ttl time.Duration) (_ int64, err error) {
+	defer observe(client, "AddPresence")(&err)
+	ctx := client.Context()
+
+	var connections *redis.IntCmd
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		connections = pipe.HIncrBy(ctx, connectionsKey(room), username, 1)
+		refreshPresence(ctx, pipe, room, username, ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return connections.Val(), nil
+}
+
+// SetPresence marks the user as online in the room until the ttl runs out.
+// Callers are expected to refresh it periodically while the user stays connected.
+func SetPresence(client *redis.Client, room, username string, ttl time.Duration) (err error) {
+	defer observe(client, "SetPresence")(&err)
+	ctx := client.Context()
+
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		refreshPresence(ctx, pipe, room, username, ttl)
+		return nil
+	})
+	return err
+}
+
+func refreshPresence(ctx context.Context, pipe redis.Pipeliner, room, username string, ttl time.Duration) {
+	now := time.Now()
+	pipe.ZAdd(ctx, presenceKey(room), &redis.Z{Score: float64(now.Unix()), Member: username})
+	pipe.ZRemRangeByScore(ctx, presenceKey(room), "-inf", fmt.Sprintf("(%d", now.Add(-ttl).Unix()))
+	pipe.Expire(ctx, presenceKey(room), ttl)
+	pipe.Expire(ctx, connectionsKey(room), ttl)
+}
+
+// RemovePresence closes one of the user's streams in the room and returns how
+// many are left. The user is offline once none are.
+func RemovePresence(client *redis.Client, room, username string) (_ int64, err error) {
+	defer observe(client, "RemovePresence")(&err)
+	ctx := client.Context()
+	keys := []string{presenceKey(room), connectionsKey(room), typingKey(room, username)}
+
+	return removePresenceScript.Run(ctx, client, keys, username).Int64()
+}
+
+func SetTyping(client *redis.Client, room, username string, typing bool, ttl time.Duration) (err error) {
+	defer observe(client, "SetTyping")(&err)
+	ctx := client.Context()
+	key := typingKey(room, username)
+
+	if !typing {
+		return client.Del(ctx, key).Err()
+	}
+	return client.Set(ctx, key, time.Now().Unix(), ttl).Err()
+}
+
+// GetOnlineUsers returns the users seen in the room within the ttl
+func GetOnlineUsers(client *redis.Client, room string, ttl time.Duration) (_ []Presence, err error) {
+	defer observe(client, "GetOnlineUsers")(&err)
+	ctx := client.Context()
+
+	seen, err := client.ZRangeByScoreWithScores(ctx, presenceKey(room), &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().Add(-ttl).Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	typing := make([]*redis.IntCmd, len(seen))
+	_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, z := range seen {
+			typing[i] = pipe.Exists(ctx, typingKey(room, z.Member.(string)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]Presence, 0, len(seen))
+	for i, z := range seen {
+		members = append(members, Presence{
+			Username: z.Member.(string),
+			LastSeen: int64(z.Score),
+			Typing:   typing[i].Val() > 0,
+		})
+	}
+
+	return members, nil
+}
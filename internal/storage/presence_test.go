@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestClient(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	return redis.NewClient(&redis.Options{Addr: mr.Addr()}), mr
+}
+
+func onlineUsers(t *testing.T, client *redis.Client, room string) map[string]Presence {
+	t.Helper()
+	online, err := GetOnlineUsers(client, room, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make(map[string]Presence)
+	for _, p := range online {
+		users[p.Username] = p
+	}
+	return users
+}
+
+func TestPresenceCountsStreams(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	for _, want := range []int64{1, 2} {
+		if n, err := AddPresence(client, "general", "alice", time.Minute); err != nil || n != want {
+			t.Fatalf("AddPresence: got %d, %v, want %d", n, err, want)
+		}
+	}
+	if _, err := AddPresence(client, "general", "bob", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTyping(client, "general", "alice", true, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	online := onlineUsers(t, client, "general")
+	if len(online) != 2 || !online["alice"].Typing || online["bob"].Typing || online["alice"].LastSeen == 0 {
+		t.Fatalf("got %v", online)
+	}
+
+	// closing one of alice's two streams keeps alice online
+	if n, err := RemovePresence(client, "general", "alice"); err != nil || n != 1 {
+		t.Fatalf("RemovePresence: got %d, %v, want 1", n, err)
+	}
+	if _, ok := onlineUsers(t, client, "general")["alice"]; !ok {
+		t.Error("alice went offline with a stream still open")
+	}
+
+	if n, err := RemovePresence(client, "general", "alice"); err != nil || n != 0 {
+		t.Fatalf("RemovePresence: got %d, %v, want 0", n, err)
+	}
+	online = onlineUsers(t, client, "general")
+	if _, ok := online["alice"]; ok || len(online) != 1 {
+		t.Errorf("got %v after alice's last stream closed", online)
+	}
+	if n, _ := client.Exists(client.Context(), typingKey("general", "alice")).Result(); n != 0 {
+		t.Error("alice is still typing after leaving")
+	}
+}
+
+func TestPresenceIgnoresStaleUsers(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := client.Context()
+
+	// left behind by a server that stopped without closing its streams
+	stale := time.Now().Add(-time.Hour).Unix()
+	client.ZAdd(ctx, presenceKey("general"), &redis.Z{Score: float64(stale), Member: "carol"})
+	if err := SetPresence(client, "general", "alice", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	online := onlineUsers(t, client, "general")
+	if _, ok := online["carol"]; ok || len(online) != 1 {
+		t.Errorf("got %v", online)
+	}
+	if n, _ := client.ZCard(ctx, presenceKey("general")).Result(); n != 1 {
+		t.Errorf("the stale user was not pruned, %d members left", n)
+	}
+}
+
+func TestPresenceKeepsRoomsApart(t *testing.T) {
+	client, mr := newTestClient(t)
+
+	if _, err := AddPresence(client, "ab", "alice", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddPresence(client, "a:b", "bob", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, room := range []string{"a*", "a?", "a", "a:"} {
+		if online := onlineUsers(t, client, room); len(online) != 0 {
+			t.Errorf("%s: got %v", room, online)
+		}
+	}
+	if online := onlineUsers(t, client, "ab"); len(online) != 1 || online["alice"].Username != "alice" {
+		t.Errorf("ab: got %v", online)
+	}
+
+	// rooms nobody refreshes expire
+	mr.FastForward(2 * time.Minute)
+	if mr.Exists(presenceKey("ab")) || mr.Exists(connectionsKey("ab")) {
+		t.Error("presence of an idle room did not expire")
+	}
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// only move the cursor forward so late or duplicate receipts are harmless
+var setReadCursorScript = redis.NewScript(`
+local current = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+local seq = tonumber(ARGV[2])
+if seq > current then
+	redis.call("HSET", KEYS[1], ARGV[1], seq)
+	return seq
+end
+return current
+`)
+
+func GetRoomSeq(client *redis.Client, room string) (_ int64, err error) {
+	defer observe(client, "GetRoomSeq")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("chat:seq:%s", room)
+
+	seq, err := client.Get(ctx, key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// SetReadCursor records that the user has read the room up to seq and
+// returns the resulting cursor
+func SetReadCursor(client *redis.Client, username, room string, seq int64) (_ int64, err error) {
+	defer observe(client, "SetReadCursor")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("read:%s", username)
+
+	return setReadCursorScript.Run(ctx, client, []string{key}, room, seq).Int64()
+}
+
+func GetReadCursor(client *redis.Client, username, room string) (_ int64, err error) {
+	defer observe(client, "GetReadCursor")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("read:%s", username)
+
+	seq, err := client.HGet(ctx, key, room).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+func AddUserRoom(client *redis.Client, username, room string) (err error) {
+	defer observe(client, "AddUserRoom")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("user:%s:rooms", username)
+
+	return client.SAdd(ctx, key, room).Err()
+}
+
+func GetUserRooms(client *redis.Client, username string) (_ []string, err error) {
+	defer observe(client, "GetUserRooms")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("user:%s:rooms", username)
+
+	rooms, err := client.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rooms)
+
+	return rooms, nil
+}
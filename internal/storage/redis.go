@@ -2,6 +2,7 @@ package storage
 
 import (
 	"chat_app/internal/logger"
+	"chat_app/internal/tracing"
 	pb "chat_app/pb"
 	"context"
 	"encoding/json"
@@ -10,13 +11,14 @@ import (
 
 	"github.com/go-redis/redis/v8"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 )
 
-func NewRedisClient(addr string) (*redis.Client, error) {
+func NewRedisClient(addr, password string, db int) (*redis.Client, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr:     addr,
-		Password: "",
-		DB:       0,
+		Password: password,
+		DB:       db,
 	})
 
 	// Test the connection
@@ -28,9 +30,19 @@ func NewRedisClient(addr string) (*redis.Client, error) {
 	return client, nil
 }
 
-func SaveMessage(client *redis.Client, message *pb.ChatMessage) error {
-	ctx := context.Background()
-	key := fmt.Sprintf("chat:message:%s:%d", message.Room, message.Timestamp)
+// SaveMessage assigns the message the next sequence number for its room and
+// appends it to the room history, which is trimmed to the last keep messages
+func SaveMessage(client *redis.Client, message *pb.ChatMessage, keep int) (err error) {
+	defer observe(client, "SaveMessage")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("chat:messages:%s", message.Room)
+
+	seq, err := client.Incr(ctx, fmt.Sprintf("chat:seq:%s", message.Room)).Result()
+	if err != nil {
+		return err
+	}
+	message.Seq = seq
+	message.Id = fmt.Sprintf("%s:%d", message.Room, seq)
 
 	jsonMessage, err := json.Marshal(message)
 	if err != nil {
@@ -38,16 +50,17 @@ func SaveMessage(client *redis.Client, message *pb.ChatMessage) error {
 	}
 
 	err = client.ZAdd(ctx, key, &redis.Z{
-		Score:  float64(message.Timestamp),
+		Score:  float64(message.Seq),
 		Member: jsonMessage,
 	}).Err()
 	if err != nil {
 		return err
 	}
 
-	// trim sorted set to keep only last 100 messages
+	// trim sorted set to keep only the last messages
 	go func() {
-		err := client.ZRemRangeByRank(ctx, key, 0, -101).Err()
+		// the caller's request may be over by now
+		err := client.ZRemRangeByRank(context.WithoutCancel(ctx), key, 0, int64(-keep-1)).Err()
 		if err != nil {
 			logger.Log.Error("Failed to trim message list", zap.Error(err), zap.String("room", message.Room))
 		}
@@ -56,48 +69,87 @@ func SaveMessage(client *redis.Client, message *pb.ChatMessage) error {
 	return nil
 }
 
-func GetMessages(client *redis.Client, room string) ([]*pb.ChatMessage, error) {
-	ctx := context.Background()
-
-	var cursor uint64
-	var messages []*pb.ChatMessage
-	pattern := fmt.Sprintf("chat:message:%s:*", room)
+func GetMessages(client *redis.Client, room string) (_ []*pb.ChatMessage, err error) {
+	defer observe(client, "GetMessages")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("chat:messages:%s", room)
 
-	for {
-		var keys []string
-		var err error
+	results, err := client.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
 
-		keys, cursor, err := client.Scan(ctx, cursor, pattern, 10).Result()
+	var messages []*pb.ChatMessage
+	for _, result := range results {
+		var msg pb.ChatMessage
+		err = json.Unmarshal([]byte(result), &msg)
 		if err != nil {
 			return nil, err
 		}
+		messages = append(messages, &msg)
+	}
 
-		for _, key := range keys {
-			jsonData, err := client.Get(ctx, key).Bytes()
-			if err != nil {
-				return nil, err
-			}
+	return messages, nil
+}
 
-			var msg pb.ChatMessage
-			err = json.Unmarshal(jsonData, &msg)
-			if err != nil {
-				return nil, err
-			}
+// GetMessage returns redis.Nil if the message is not in the room history
+func GetMessage(client *redis.Client, room string, seq int64) (_ *pb.ChatMessage, err error) {
+	defer observe(client, "GetMessage")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("chat:messages:%s", room)
+	score := fmt.Sprint(seq)
 
-			messages = append(messages, &msg)
-		}
+	results, err := client.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: score, Max: score}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, redis.Nil
+	}
 
-		// if cursor is 0, we've scanned all keys
-		if cursor == 0 {
-			break
-		}
+	var msg pb.ChatMessage
+	if err := json.Unmarshal([]byte(results[0]), &msg); err != nil {
+		return nil, err
 	}
 
-	return messages, nil
+	return &msg, nil
+}
+
+// UpdateMessage replaces the stored message with the same sequence number
+func UpdateMessage(client *redis.Client, message *pb.ChatMessage) (err error) {
+	defer observe(client, "UpdateMessage")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("chat:messages:%s", message.Room)
+	score := fmt.Sprint(message.Seq)
+
+	jsonMessage, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	pipe := client.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, score, score)
+	pipe.ZAdd(ctx, key, &redis.Z{
+		Score:  float64(message.Seq),
+		Member: jsonMessage,
+	})
+	_, err = pipe.Exec(ctx)
+
+	return err
 }
 
-func GetLastNMessages(client *redis.Client, room string, n int) ([]*pb.ChatMessage, error) {
-	ctx := context.Background()
+func DeleteMessage(client *redis.Client, room string, seq int64) (err error) {
+	defer observe(client, "DeleteMessage")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("chat:messages:%s", room)
+	score := fmt.Sprint(seq)
+
+	return client.ZRemRangeByScore(ctx, key, score, score).Err()
+}
+
+func GetLastNMessages(client *redis.Client, room string, n int) (_ []*pb.ChatMessage, err error) {
+	defer observe(client, "GetLastNMessages")(&err)
+	ctx := client.Context()
 	key := fmt.Sprintf("chat:messages:%s", room)
 
 	results, err := client.ZRevRange(ctx, key, 0, int64(n-1)).Result()
@@ -124,8 +176,16 @@ func GetLastNMessages(client *redis.Client, room string, n int) ([]*pb.ChatMessa
 	return messages, nil
 }
 
-func PublishMessage(client *redis.Client, channel string, message *pb.ChatMessage) error {
-	ctx := context.Background()
+// PublishMessage sends the message to the channel's subscribers along with
+// the trace context of client.Context()
+func PublishMessage(client *redis.Client, channel string, message *pb.ChatMessage) (err error) {
+	defer observe(client, "PublishMessage")(&err)
+	ctx := client.Context()
+
+	if traceContext := tracing.Inject(ctx); traceContext != nil {
+		message = proto.Clone(message).(*pb.ChatMessage)
+		message.TraceContext = traceContext
+	}
 	jsonMessage, err := json.Marshal(message)
 	if err != nil {
 		return err
@@ -138,8 +198,9 @@ func SubscribeToMessages(client *redis.Client, channel string) *redis.PubSub {
 	return client.Subscribe(context.Background(), channel)
 }
 
-func SaveUser(client *redis.Client, username, hashedPassword string) error {
-	ctx := context.Background()
+func SaveUser(client *redis.Client, username, hashedPassword string) (err error) {
+	defer observe(client, "SaveUser")(&err)
+	ctx := client.Context()
 	key := fmt.Sprintf("user:%s", username)
 
 	return client.HSet(ctx, key,
@@ -148,18 +209,20 @@ func SaveUser(client *redis.Client, username, hashedPassword string) error {
 	).Err()
 }
 
-func GetUser(client *redis.Client, username string) (string, error) {
-	ctx := context.Background()
+func GetUser(client *redis.Client, username string) (_ string, err error) {
+	defer observe(client, "GetUser")(&err)
+	ctx := client.Context()
 	key := fmt.Sprintf("user:%s", username)
 
 	return client.HGet(ctx, key, "password").Result()
 }
 
-func SaveToken(client *redis.Client, username, token string, expiration time.Duration) error {
-	ctx := context.Background()
+func SaveToken(client *redis.Client, username, token string, expiration time.Duration) (err error) {
+	defer observe(client, "SaveToken")(&err)
+	ctx := client.Context()
 	key := fmt.Sprintf("token:%s", username)
 
-	err := client.Set(ctx, key, token, expiration).Err()
+	err = client.Set(ctx, key, token, expiration).Err()
 	if err != nil {
 		return fmt.Errorf("failed to save token: %v", err)
 	}
@@ -167,16 +230,19 @@ func SaveToken(client *redis.Client, username, token string, expiration time.Dur
 	return nil
 }
 
-func GetToken(client *redis.Client, username string) (string, error) {
-	ctx := context.Background()
+func GetToken(client *redis.Client, username string) (_ string, err error) {
+	defer observe(client, "GetToken")(&err)
+	ctx := client.Context()
 	key := fmt.Sprintf("token:%s", username)
 
 	return client.Get(ctx, key).Result()
 }
 
-func deleteToken(client *redis.Client, username string) error {
-	ctx := context.Background()
-	key := fmt.Sprintf("token: %s", username)
+// DeleteToken ends the user's session
+func DeleteToken(client *redis.Client, username string) (err error) {
+	defer observe(client, "DeleteToken")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("token:%s", username)
 
 	return client.Del(ctx, key).Err()
 }
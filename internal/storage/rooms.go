@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func SetRoomTopic(client *redis.Client, room, topic string) (err error) {
+	defer observe(client, "SetRoomTopic")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("room:%s:topic", room)
+
+	if topic == "" {
+		return client.Del(ctx, key).Err()
+	}
+	return client.Set(ctx, key, topic, 0).Err()
+}
+
+// GetRoomTopic returns an empty topic if none was set
+func GetRoomTopic(client *redis.Client, room string) (_ string, err error) {
+	defer observe(client, "GetRoomTopic")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("room:%s:topic", room)
+
+	topic, err := client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return topic, err
+}
+
+// SetNick sets the user's nick in the room, an empty nick clears it
+func SetNick(client *redis.Client, room, username, nick string) (err error) {
+	defer observe(client, "SetNick")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("room:%s:nicks", room)
+
+	if nick == "" {
+		return client.HDel(ctx, key, username).Err()
+	}
+	return client.HSet(ctx, key, username, nick).Err()
+}
+
+// GetNick returns an empty nick if the user has not set one
+func GetNick(client *redis.Client, room, username string) (_ string, err error) {
+	defer observe(client, "GetNick")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("room:%s:nicks", room)
+
+	nick, err := client.HGet(ctx, key, username).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return nick, err
+}
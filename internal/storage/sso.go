@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// GetSSOUser returns the username linked to an identity provider's subject,
+// or redis.Nil if the subject has not logged in before
+func GetSSOUser(client *redis.Client, issuer, subject string) (_ string, err error) {
+	defer observe(client, "GetSSOUser")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("sso:%s:%s", issuer, subject)
+
+	return client.Get(ctx, key).Result()
+}
+
+// SaveSSOUser links the subject to username. The user is created without a
+// password if it does not exist. An existing one is only linked if
+// linkExisting is set, it has neither a password nor two-factor
+// authentication, which the provider's login would bypass, and it is not
+// linked to another subject already; otherwise false is returned and nothing
+// changes.
+func SaveSSOUser(client *redis.Client, issuer, subject, username string, linkExisting bool) (_ bool, err error) {
+	defer observe(client, "SaveSSOUser")(&err)
+	ctx := client.Context()
+	userKey := fmt.Sprintf("user:%s", username)
+
+	// an empty password never matches, and keeps Register from taking the name
+	pipe := client.TxPipeline()
+	created := pipe.HSetNX(ctx, userKey, "password", "")
+	pipe.HSetNX(ctx, userKey, "username", username)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	if !created.Val() {
+		if !linkExisting {
+			return false, nil
+		}
+		linked := false
+		err := client.Watch(ctx, func(tx *redis.Tx) error {
+			values, err := tx.HMGet(ctx, userKey, "password", "totp_secret", "totp_pending", "sso_issuer", "sso_subject").Result()
+			if err != nil {
+				return err
+			}
+			for _, value := range values[:3] {
+				if s, _ := value.(string); s != "" {
+					return nil
+				}
+			}
+			linkedIssuer, _ := values[3].(string)
+			linkedSubject, _ := values[4].(string)
+			if linkedSubject != "" && (linkedIssuer != issuer || linkedSubject != subject) {
+				return nil
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				linkSSOUser(ctx, pipe, issuer, subject, username)
+				return nil
+			})
+			linked = err == nil
+			return err
+		}, userKey)
+		return linked, err
+	}
+
+	pipe = client.TxPipeline()
+	linkSSOUser(ctx, pipe, issuer, subject, username)
+	_, err = pipe.Exec(ctx)
+
+	return err == nil, err
+}
+
+func linkSSOUser(ctx context.Context, pipe redis.Pipeliner, issuer, subject, username string) {
+	pipe.HSet(ctx, fmt.Sprintf("user:%s", username), "sso_issuer", issuer, "sso_subject", subject)
+	pipe.Set(ctx, fmt.Sprintf("sso:%s:%s", issuer, subject), username, 0)
+}
+
+// GetUserSSO returns the provider subject the user is linked to, empty for
+// users that log in with a password
+func GetUserSSO(client *redis.Client, username string) (issuer, subject string, err error) {
+	defer observe(client, "GetUserSSO")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("user:%s", username)
+
+	values, err := client.HMGet(ctx, key, "sso_issuer", "sso_subject").Result()
+	if err != nil {
+		return "", "", err
+	}
+	issuer, _ = values[0].(string)
+	subject, _ = values[1].(string)
+	return issuer, subject, nil
+}
+
+// UseIDToken returns false if an ID token with this hash was used to log in
+// before. It is remembered until the token expires.
+func UseIDToken(client *redis.Client, tokenHash string, ttl time.Duration) (_ bool, err error) {
+	defer observe(client, "UseIDToken")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("sso_token:%s", tokenHash)
+
+	return client.SetNX(ctx, key, time.Now().Unix(), ttl).Result()
+}
+
+// SaveSSOState keeps what the browser's login callback needs to verify it
+func SaveSSOState(client *redis.Client, state, data string, ttl time.Duration) (err error) {
+	defer observe(client, "SaveSSOState")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("sso_state:%s", state)
+
+	return client.Set(ctx, key, data, ttl).Err()
+}
+
+// TakeSSOState returns and deletes the data saved for state, or redis.Nil
+func TakeSSOState(client *redis.Client, state string) (_ string, err error) {
+	defer observe(client, "TakeSSOState")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("sso_state:%s", state)
+
+	return client.GetDel(ctx, key).Result()
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// GetTwoFactor returns the user's TOTP secret, empty unless two-factor
+// authentication is enabled, and the secret of an unconfirmed enrollment
+func GetTwoFactor(client *redis.Client, username string) (secret, pending string, err error) {
+	defer observe(client, "GetTwoFactor")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("user:%s", username)
+
+	values, err := client.HMGet(ctx, key, "totp_secret", "totp_pending").Result()
+	if err != nil {
+		return "", "", err
+	}
+	secret, _ = values[0].(string)
+	pending, _ = values[1].(string)
+	return secret, pending, nil
+}
+
+// SavePendingTwoFactor stores a secret until the user confirms it with a code
+func SavePendingTwoFactor(client *redis.Client, username, secret string) (err error) {
+	defer observe(client, "SavePendingTwoFactor")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("user:%s", username)
+
+	return client.HSet(ctx, key, "totp_pending", secret).Err()
+}
+
+// EnableTwoFactor makes the pending secret the user's, and replaces their
+// recovery codes with the given hashes
+func EnableTwoFactor(client *redis.Client, username, secret string, recoveryCodeHashes []string) (err error) {
+	defer observe(client, "EnableTwoFactor")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("user:%s", username)
+	codesKey := fmt.Sprintf("user:%s:recovery_codes", username)
+
+	pipe := client.TxPipeline()
+	pipe.HSet(ctx, key, "totp_secret", secret)
+	pipe.HDel(ctx, key, "totp_pending")
+	pipe.Del(ctx, codesKey)
+	for _, hash := range recoveryCodeHashes {
+		pipe.SAdd(ctx, codesKey, hash)
+	}
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+func DisableTwoFactor(client *redis.Client, username string) (err error) {
+	defer observe(client, "DisableTwoFactor")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("user:%s", username)
+
+	pipe := client.TxPipeline()
+	pipe.HDel(ctx, key, "totp_secret", "totp_pending")
+	pipe.Del(ctx, fmt.Sprintf("user:%s:recovery_codes", username))
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+// UseRecoveryCode removes the recovery code with the given hash and returns
+// false if the user did not have it
+func UseRecoveryCode(client *redis.Client, username, codeHash string) (_ bool, err error) {
+	defer observe(client, "UseRecoveryCode")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("user:%s:recovery_codes", username)
+
+	removed, err := client.SRem(ctx, key, codeHash).Result()
+	return removed == 1, err
+}
+
+// UseTOTPCounter returns false if the user already logged in with a code of
+// the given time step, so a code that was seen cannot be replayed
+func UseTOTPCounter(client *redis.Client, username string, counter int64, ttl time.Duration) (_ bool, err error) {
+	defer observe(client, "UseTOTPCounter")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("totp_used:%s:%d", username, counter)
+
+	return client.SetNX(ctx, key, time.Now().Unix(), ttl).Result()
+}
+
+// SaveTwoFactorChallenge stores the username of a login that still needs its
+// second factor, under the hash of the challenge
+func SaveTwoFactorChallenge(client *redis.Client, challengeHash, username string, ttl time.Duration) (err error) {
+	defer observe(client, "SaveTwoFactorChallenge")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("2fa_challenge:%s", challengeHash)
+
+	return client.Set(ctx, key, username, ttl).Err()
+}
+
+// GetTwoFactorChallenge returns redis.Nil if the challenge does not exist or has expired
+func GetTwoFactorChallenge(client *redis.Client, challengeHash string) (_ string, err error) {
+	defer observe(client, "GetTwoFactorChallenge")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("2fa_challenge:%s", challengeHash)
+
+	return client.Get(ctx, key).Result()
+}
+
+func DeleteTwoFactorChallenge(client *redis.Client, challengeHash string) (err error) {
+	defer observe(client, "DeleteTwoFactorChallenge")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("2fa_challenge:%s", challengeHash)
+
+	return client.Del(ctx, key).Err()
+}
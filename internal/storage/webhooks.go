@@ -0,0 +1,104 @@
+package storage
+
+import (
+	pb "chat_app/pb"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const maxDeadLetters = 100
+
+func SaveWebhook(client *redis.Client, webhook *pb.Webhook) (err error) {
+	defer observe(client, "SaveWebhook")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("webhooks:%s", webhook.Room)
+
+	jsonWebhook, err := json.Marshal(webhook)
+	if err != nil {
+		return err
+	}
+
+	return client.HSet(ctx, key, webhook.Id, jsonWebhook).Err()
+}
+
+func GetWebhooks(client *redis.Client, room string) (_ []*pb.Webhook, err error) {
+	defer observe(client, "GetWebhooks")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("webhooks:%s", room)
+
+	values, err := client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var webhooks []*pb.Webhook
+	for _, value := range values {
+		var webhook pb.Webhook
+		if err := json.Unmarshal([]byte(value), &webhook); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook returns redis.Nil if the webhook does not exist
+func DeleteWebhook(client *redis.Client, room, id string) (err error) {
+	defer observe(client, "DeleteWebhook")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("webhooks:%s", room)
+
+	deleted, err := client.HDel(ctx, key, id).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return redis.Nil
+	}
+
+	return nil
+}
+
+// SaveDeadLetter records a delivery that failed every retry, newest first
+func SaveDeadLetter(client *redis.Client, room string, deadLetter *pb.WebhookDeadLetter) (err error) {
+	defer observe(client, "SaveDeadLetter")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("webhooks:%s:deadletters", room)
+
+	jsonDeadLetter, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+
+	pipe := client.TxPipeline()
+	pipe.LPush(ctx, key, jsonDeadLetter)
+	pipe.LTrim(ctx, key, 0, maxDeadLetters-1)
+	_, err = pipe.Exec(ctx)
+
+	return err
+}
+
+func GetDeadLetters(client *redis.Client, room string) (_ []*pb.WebhookDeadLetter, err error) {
+	defer observe(client, "GetDeadLetters")(&err)
+	ctx := client.Context()
+	key := fmt.Sprintf("webhooks:%s:deadletters", room)
+
+	values, err := client.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var deadLetters []*pb.WebhookDeadLetter
+	for _, value := range values {
+		var deadLetter pb.WebhookDeadLetter
+		if err := json.Unmarshal([]byte(value), &deadLetter); err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, &deadLetter)
+	}
+
+	return deadLetters, nil
+}
@@ -0,0 +1,90 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// EventCommand is the X-Chat-Event of bot command invocations. Unlike room
+// events they are delivered once and synchronously, since the sender waits
+// for the reply.
+const EventCommand = "command"
+
+// bot replies larger than this are rejected
+const maxReplySize = 64 << 10
+
+// Invocation is the JSON body posted to a bot command's url
+type Invocation struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Command   string `json:"command"`
+	Args      string `json:"args"`
+	Room      string `json:"room"`
+	User      string `json:"user"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Reply is the JSON body a bot answers an invocation with. An empty text
+// means there is nothing to post.
+type Reply struct {
+	Text string `json:"text"`
+	// only show the reply to the user who ran the command
+	Private bool `json:"private"`
+}
+
+// Invoke posts a command invocation to url and returns the bot's reply
+func (d *Dispatcher) Invoke(url, secret string, invocation Invocation) (*Reply, error) {
+	id, err := newDeliveryID()
+	if err != nil {
+		return nil, err
+	}
+	invocation.ID = id
+	invocation.Type = EventCommand
+	invocation.Timestamp = time.Now().Unix()
+
+	body, err := json.Marshal(invocation)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chat-app-webhook")
+	req.Header.Set("X-Chat-Event", EventCommand)
+	req.Header.Set("X-Chat-Delivery", id)
+	req.Header.Set("X-Chat-Signature-256", Sign(secret, body))
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxReplySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxReplySize {
+		return nil, fmt.Errorf("reply larger than %d bytes", maxReplySize)
+	}
+
+	var reply Reply
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &reply, nil
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	return &reply, nil
+}
@@ -0,0 +1,320 @@
+// Package webhook delivers room events to outgoing webhooks. Every request is
+// a JSON POST signed with the webhook's secret:
+//
+//	X-Chat-Event:         message, edit, delete, join or command
+//	X-Chat-Delivery:      unique id of the delivery, the same for every retry
+//	X-Chat-Signature-256: sha256=<hex hmac of the body>
+//
+// Failed deliveries are retried with exponential backoff and end up in the
+// room's dead letter list once every attempt has failed. Webhooks are only
+// sent to public addresses unless private networks are allowed.
+package webhook
+
+import (
+	"bytes"
+	"chat_app/internal/logger"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+const (
+	EventMessage = "message"
+	EventEdit    = "edit"
+	EventDelete  = "delete"
+	EventJoin    = "join"
+)
+
+var Events = []string{EventMessage, EventEdit, EventDelete, EventJoin}
+
+// Event is the JSON body posted to webhooks
+type Event struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Room      string          `json:"room"`
+	User      string          `json:"user"`
+	Timestamp int64           `json:"timestamp"`
+	Message   *pb.ChatMessage `json:"message,omitempty"`
+}
+
+type Options struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	Timeout        time.Duration
+	// MaxConcurrent is the number of requests sent at the same time
+	MaxConcurrent int
+	// QueueSize limits the deliveries waiting to be sent or retried. Events
+	// for a full queue go straight to the dead letters.
+	QueueSize int
+	// AllowPrivateNetworks lets webhooks and bot commands reach loopback,
+	// private and link-local addresses, such as services next to the server
+	AllowPrivateNetworks bool
+}
+
+// delivery is one event on its way to one webhook
+type delivery struct {
+	webhook   *pb.Webhook
+	eventType string
+	id        string
+	body      []byte
+	attempt   int
+	backoff   time.Duration
+}
+
+type Dispatcher struct {
+	redisClient *redis.Client
+	httpClient  *http.Client
+	opts        Options
+	queue       chan *delivery
+	// holds a slot for every delivery until it succeeds or is dead, so the
+	// queue always has room for retries
+	pending chan struct{}
+}
+
+// NewDispatcher starts opts.MaxConcurrent workers that send deliveries for
+// as long as the process runs
+func NewDispatcher(redisClient *redis.Client, opts Options) *Dispatcher {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+	if opts.MaxConcurrent <= 0 {
+		opts.MaxConcurrent = 1
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be dialed instead of the webhook, defeating the address check
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout: opts.Timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			return checkAddress(address, opts.AllowPrivateNetworks)
+		},
+	}).DialContext
+
+	d := &Dispatcher{
+		redisClient: redisClient,
+		httpClient:  &http.Client{Timeout: opts.Timeout, Transport: transport},
+		opts:        opts,
+		queue:       make(chan *delivery, opts.QueueSize),
+		pending:     make(chan struct{}, opts.QueueSize),
+	}
+	for i := 0; i < opts.MaxConcurrent; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// CheckURL returns an error for urls webhooks and bot commands cannot be sent
+// to. Hosts are only checked once they are dialed, as their addresses may change.
+func (d *Dispatcher) CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an http or https url")
+	}
+	if d.opts.AllowPrivateNetworks {
+		return nil
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		return errPrivateAddress
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && isPrivate(addr) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+var errPrivateAddress = errors.New("must not point to a loopback, private or link-local address")
+
+// checkAddress runs on the resolved address of every connection, so names
+// that resolve to internal addresses or redirects to them are caught too
+func checkAddress(address string, allowPrivate bool) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !allowPrivate && isPrivate(addrPort.Addr()) {
+		return fmt.Errorf("refusing to connect to %s: %w", addrPort.Addr(), errPrivateAddress)
+	}
+	return nil
+}
+
+func isPrivate(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified()
+}
+
+// Dispatch sends the event to every webhook of its room that subscribed to it.
+// Delivery happens in the background, so Dispatch never blocks the caller.
+func (d *Dispatcher) Dispatch(eventType, room, user string, msg *pb.ChatMessage) {
+	webhooks, err := storage.GetWebhooks(d.redisClient, room)
+	if err != nil {
+		logger.Log.Error("Failed to load webhooks", zap.Error(err), zap.String("room", room))
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	id, err := newDeliveryID()
+	if err != nil {
+		logger.Log.Error("Failed to generate delivery id", zap.Error(err))
+		return
+	}
+
+	body, err := json.Marshal(Event{
+		ID:        id,
+		Type:      eventType,
+		Room:      room,
+		User:      user,
+		Timestamp: time.Now().Unix(),
+		Message:   msg,
+	})
+	if err != nil {
+		logger.Log.Error("Failed to marshal webhook event", zap.Error(err))
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !Subscribed(webhook, eventType) {
+			continue
+		}
+		del := &delivery{webhook: webhook, eventType: eventType, id: id, body: body, backoff: d.opts.InitialBackoff}
+		select {
+		case d.pending <- struct{}{}:
+			d.queue <- del
+		default:
+			logger.Log.Warn("Webhook queue full, dropping delivery", zap.String("webhook", webhook.Id))
+			d.deadLetter(del, errors.New("delivery queue full"))
+		}
+	}
+}
+
+func (d *Dispatcher) work() {
+	for del := range d.queue {
+		d.deliver(del)
+	}
+}
+
+// deliver makes one attempt. Retries wait on a timer rather than a worker,
+// so slow or dead endpoints only hold up the workers for their timeout.
+func (d *Dispatcher) deliver(del *delivery) {
+	del.attempt++
+	err := d.post(del.webhook, del.eventType, del.id, del.body)
+	if err == nil {
+		<-d.pending
+		return
+	}
+
+	logger.Log.Warn("Webhook delivery failed",
+		zap.Error(err),
+		zap.String("webhook", del.webhook.Id),
+		zap.Int("attempt", del.attempt))
+
+	if del.attempt < d.opts.MaxAttempts {
+		backoff := del.backoff
+		del.backoff *= 2
+		// the pending slot guarantees the queue has room
+		time.AfterFunc(backoff, func() { d.queue <- del })
+		return
+	}
+	d.deadLetter(del, err)
+	<-d.pending
+}
+
+func (d *Dispatcher) deadLetter(del *delivery, err error) {
+	deadLetter := &pb.WebhookDeadLetter{
+		WebhookId: del.webhook.Id,
+		Url:       del.webhook.Url,
+		Event:     del.eventType,
+		Payload:   string(del.body),
+		Error:     err.Error(),
+		Attempts:  int32(del.attempt),
+		FailedAt:  time.Now().Unix(),
+	}
+	if err := storage.SaveDeadLetter(d.redisClient, del.webhook.Room, deadLetter); err != nil {
+		logger.Log.Error("Failed to save webhook dead letter", zap.Error(err), zap.String("webhook", del.webhook.Id))
+	}
+}
+
+func (d *Dispatcher) post(webhook *pb.Webhook, eventType, id string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chat-app-webhook")
+	req.Header.Set("X-Chat-Event", eventType)
+	req.Header.Set("X-Chat-Delivery", id)
+	req.Header.Set("X-Chat-Signature-256", Sign(webhook.Secret, body))
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the value of the X-Chat-Signature-256 header for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header in constant time, for receivers written in Go
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+func Subscribed(webhook *pb.Webhook, eventType string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, e := range webhook.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newDeliveryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
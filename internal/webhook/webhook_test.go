@@ -0,0 +1,236 @@
+package webhook
+
+import (
+	"chat_app/internal/logger"
+	"chat_app/internal/storage"
+	pb "chat_app/pb"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// request is what a test endpoint received
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// newEndpoint records requests and answers them with the next of statuses,
+// repeating the last one
+func newEndpoint(t *testing.T, statuses ...int) (*httptest.Server, <-chan request) {
+	t.Helper()
+	requests := make(chan request, 100)
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.Header.Clone(), body}
+		mu.Lock()
+		code := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		mu.Unlock()
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func newTestDispatcher(t *testing.T, opts Options) (*Dispatcher, *redis.Client) {
+	t.Helper()
+	if logger.Log == nil {
+		logger.Log = zap.NewNop()
+	}
+	redisClient := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	return NewDispatcher(redisClient, opts), redisClient
+}
+
+func saveWebhook(t *testing.T, redisClient *redis.Client, id, url string) *pb.Webhook {
+	t.Helper()
+	hook := &pb.Webhook{Id: id, Room: "general", Url: url, Secret: "secret-" + id, CreatedBy: "alice"}
+	if err := storage.SaveWebhook(redisClient, hook); err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func receive(t *testing.T, requests <-chan request) request {
+	t.Helper()
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+		return request{}
+	}
+}
+
+func waitForDeadLetters(t *testing.T, redisClient *redis.Client, n int) []*pb.WebhookDeadLetter {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deadLetters, err := storage.GetDeadLetters(redisClient, "general")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deadLetters) >= n {
+			return deadLetters
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d dead letters, want %d", len(deadLetters), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"type":"message"}`)
+	signature := Sign("secret", body)
+	if !strings.HasPrefix(signature, "sha256=") || len(signature) != len("sha256=")+64 {
+		t.Fatalf("got signature %q", signature)
+	}
+	if !Verify("secret", body, signature) {
+		t.Error("signature does not verify")
+	}
+	if Verify("other secret", body, signature) {
+		t.Error("signature verifies with another secret")
+	}
+	if Verify("secret", []byte(`{"type":"delete"}`), signature) {
+		t.Error("signature verifies for another body")
+	}
+}
+
+func TestDeliveryIsSignedAndRetried(t *testing.T) {
+	server, requests := newEndpoint(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK)
+	d, redisClient := newTestDispatcher(t, Options{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, Timeout: time.Second, MaxConcurrent: 2, AllowPrivateNetworks: true})
+	hook := saveWebhook(t, redisClient, "hook1", server.URL)
+
+	d.Dispatch(EventMessage, "general", "alice", &pb.ChatMessage{Message: "hi", Room: "general"})
+
+	var deliveryID string
+	for attempt := 1; attempt <= 3; attempt++ {
+		req := receive(t, requests)
+		if !Verify(hook.Secret, req.body, req.header.Get("X-Chat-Signature-256")) {
+			t.Errorf("attempt %d: bad signature %q", attempt, req.header.Get("X-Chat-Signature-256"))
+		}
+		if req.header.Get("X-Chat-Event") != EventMessage {
+			t.Errorf("attempt %d: got event %q", attempt, req.header.Get("X-Chat-Event"))
+		}
+		if attempt == 1 {
+			deliveryID = req.header.Get("X-Chat-Delivery")
+		} else if req.header.Get("X-Chat-Delivery") != deliveryID {
+			t.Errorf("attempt %d: delivery id changed from %q to %q", attempt, deliveryID, req.header.Get("X-Chat-Delivery"))
+		}
+
+		var event Event
+		if err := json.Unmarshal(req.body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.ID != deliveryID || event.Room != "general" || event.User != "alice" || event.Message.GetMessage() != "hi" {
+			t.Errorf("attempt %d: got event %+v", attempt, event)
+		}
+	}
+
+	select {
+	case <-requests:
+		t.Error("delivered again after it succeeded")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if deadLetters, _ := storage.GetDeadLetters(redisClient, "general"); len(deadLetters) != 0 {
+		t.Errorf("got dead letters %v", deadLetters)
+	}
+}
+
+func TestDeadLetterAfterLastAttempt(t *testing.T) {
+	server, requests := newEndpoint(t, http.StatusServiceUnavailable)
+	d, redisClient := newTestDispatcher(t, Options{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond, Timeout: time.Second, AllowPrivateNetworks: true})
+	saveWebhook(t, redisClient, "hook1", server.URL)
+
+	d.Dispatch(EventDelete, "general", "alice", nil)
+
+	deadLetters := waitForDeadLetters(t, redisClient, 1)
+	if len(requests) != 2 {
+		t.Errorf("got %d requests, want 2", len(requests))
+	}
+	if dl := deadLetters[0]; dl.WebhookId != "hook1" || dl.Event != EventDelete || dl.Attempts != 2 || !strings.Contains(dl.Error, "503") {
+		t.Errorf("got dead letter %+v", dl)
+	}
+}
+
+func TestFullQueueDropsDeliveries(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	d, redisClient := newTestDispatcher(t, Options{MaxAttempts: 1, Timeout: 5 * time.Second, MaxConcurrent: 1, QueueSize: 1, AllowPrivateNetworks: true})
+	saveWebhook(t, redisClient, "hook1", server.URL)
+
+	// the first one is stuck at the endpoint and holds the only slot
+	for i := 0; i < 3; i++ {
+		d.Dispatch(EventMessage, "general", "alice", nil)
+	}
+
+	deadLetters := waitForDeadLetters(t, redisClient, 2)
+	for _, dl := range deadLetters {
+		if dl.Error != "delivery queue full" || dl.Attempts != 0 {
+			t.Errorf("got dead letter %+v", dl)
+		}
+	}
+}
+
+func TestPrivateAddressesAreRefused(t *testing.T) {
+	server, requests := newEndpoint(t, http.StatusOK)
+	d, redisClient := newTestDispatcher(t, Options{MaxAttempts: 1, Timeout: time.Second})
+	saveWebhook(t, redisClient, "hook1", server.URL)
+
+	d.Dispatch(EventMessage, "general", "alice", nil)
+
+	deadLetters := waitForDeadLetters(t, redisClient, 1)
+	if !strings.Contains(deadLetters[0].Error, "private") {
+		t.Errorf("got error %q", deadLetters[0].Error)
+	}
+	if len(requests) != 0 {
+		t.Error("the request reached a loopback address")
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowPrivate bool
+		ok           bool
+	}{
+		{"https://hooks.example.com/chat", false, true},
+		{"http://93.184.216.34/hook", false, true},
+		{"ftp://hooks.example.com/", false, false},
+		{"https://", false, false},
+		{"http://localhost:8080/", false, false},
+		{"http://127.0.0.1/", false, false},
+		{"http://10.1.2.3/", false, false},
+		{"http://192.168.0.1/", false, false},
+		{"http://169.254.169.254/latest/meta-data/", false, false},
+		{"http://[::1]/", false, false},
+		{"http://[fe80::1]/", false, false},
+		{"http://[::ffff:127.0.0.1]/", false, false},
+		{"http://0.0.0.0/", false, false},
+		{"http://localhost:8080/", true, true},
+		{"http://10.1.2.3/", true, true},
+	}
+	for _, tt := range tests {
+		d := &Dispatcher{opts: Options{AllowPrivateNetworks: tt.allowPrivate}}
+		if err := d.CheckURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("CheckURL(%q) with private networks %v: got %v", tt.url, tt.allowPrivate, err)
+		}
+	}
+}